@@ -2,14 +2,16 @@ module exp1
 
 go 1.22.2
 
-require github.com/hibiken/asynq v0.24.1
+require (
+	github.com/hibiken/asynq v0.24.1
+	github.com/lmittmann/tint v1.0.4
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/lmittmann/tint v1.0.4 // indirect
 	github.com/redis/go-redis/v9 v9.5.1 // indirect
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	github.com/spf13/cast v1.6.0 // indirect
@@ -3,8 +3,10 @@ package db
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -13,6 +15,7 @@ import (
 // schedule:<task_type> -> <cronspec>
 // eg: schedule:notification:email -> "*/5 * * * *"
 // eg: schedule:notification:push -> "@every 30s"
+// eg: schedule:notification:sms -> "CRON_TZ=Europe/Paris 0 9 * * *"
 
 // Run populate first time
 // redis-cli < data.redis
@@ -20,41 +23,114 @@ import (
 type ScheduleConfig struct {
 	CronSpec string
 	TaskType string
+	Timezone string // IANA name, empty for the scheduler's default location
 }
 
-const redisAddr = "127.0.0.1:6379"
+const defaultRedisAddr = "127.0.0.1:6379"
 
 var (
-	rdb  *redis.Client
-	once sync.Once
+	mu  sync.Mutex
+	rdb *redis.Client
 )
 
-func GetScheduleConfigs(ctx context.Context) ([]ScheduleConfig, error) {
-	once.Do(func() {
+// client returns the package Redis client, connecting on first use.
+// The address can be overridden with the REDIS_ADDR environment variable.
+func client() *redis.Client {
+	mu.Lock()
+	defer mu.Unlock()
+	if rdb == nil {
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = defaultRedisAddr
+		}
 		rdb = redis.NewClient(&redis.Options{
-			Addr:     redisAddr,
+			Addr:     addr,
 			Password: "", // no password set
 			DB:       0,  // use default DB
 		})
-	})
+	}
+	return rdb
+}
+
+// Close closes the package Redis client, if it was ever opened.
+// A later call to the package functions opens a new one.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if rdb == nil {
+		return nil
+	}
+	err := rdb.Close()
+	rdb = nil
+	return err
+}
+
+// Ping checks the connection to Redis.
+func Ping(ctx context.Context) error {
+	return client().Ping(ctx).Err()
+}
+
+// ScheduleError reports a stored schedule that could not be parsed.
+type ScheduleError struct {
+	Key string
+	Err error
+}
+
+func (e *ScheduleError) Error() string { return fmt.Sprintf("invalid schedule %s: %v", e.Key, e.Err) }
+func (e *ScheduleError) Unwrap() error { return e.Err }
+
+// GetScheduleConfigs returns the stored schedules. Schedules that cannot be
+// parsed, such as an unknown time zone, are skipped and returned in invalid,
+// so that one bad schedule does not stop the others from firing.
+func GetScheduleConfigs(ctx context.Context) (configs []ScheduleConfig, invalid []*ScheduleError, err error) {
+	rdb := client()
 
 	keys, err := rdb.Keys(ctx, "schedule:*").Result()
 	if err != nil {
-		return nil, fmt.Errorf("rdb.Keys failed: %v", err)
+		return nil, nil, fmt.Errorf("rdb.Keys failed: %v", err)
 	}
 
-	var configs []ScheduleConfig
 	for _, key := range keys {
 		value, err := rdb.Get(ctx, key).Result()
 		if err != nil {
-			return nil, fmt.Errorf("rdb.Get failed: %v", err)
+			return nil, nil, fmt.Errorf("rdb.Get failed: %v", err)
 		}
 		parts := strings.Split(key, ":")
 		if len(parts) != 3 {
-			return nil, fmt.Errorf("invalid key: %s", key)
+			invalid = append(invalid, &ScheduleError{Key: key, Err: fmt.Errorf("invalid key: %s", key)})
+			continue
 		}
 		taskType := strings.Join(parts[1:], ":")
-		configs = append(configs, ScheduleConfig{CronSpec: value, TaskType: taskType})
+		config := ScheduleConfig{CronSpec: value, TaskType: taskType}
+		if err := config.splitTimezone(); err != nil {
+			invalid = append(invalid, &ScheduleError{Key: key, Err: err})
+			continue
+		}
+		configs = append(configs, config)
+	}
+	return configs, invalid, nil
+}
+
+// splitTimezone moves a CRON_TZ= (or TZ=) prefix of the cron spec to
+// Timezone and checks that the zone exists.
+func (c *ScheduleConfig) splitTimezone() error {
+	for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+		rest, ok := strings.CutPrefix(c.CronSpec, prefix)
+		if !ok {
+			continue
+		}
+		tz, spec, ok := strings.Cut(rest, " ")
+		if !ok {
+			return fmt.Errorf("invalid cron spec: %q", c.CronSpec)
+		}
+		c.Timezone = tz
+		c.CronSpec = strings.TrimSpace(spec)
+	}
+	if c.Timezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
 	}
-	return configs, nil
+	return nil
 }
@@ -11,7 +11,7 @@ import (
 
 func TestGetScheduleConfigs(t *testing.T) {
 	ctx := context.Background()
-	configs, err := db.GetScheduleConfigs(ctx)
+	configs, _, err := db.GetScheduleConfigs(ctx)
 	if err != nil {
 		t.Fatalf("db.GetScheduleConfigs failed: %v", err)
 	}
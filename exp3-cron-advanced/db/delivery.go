@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The delivery status of a notification learned after its task was
+// processed, from a provider callback or the preferences of its recipient,
+// is kept in a hash named after the task ID:
+//
+//	HSET delivery:<task id> status delivered reason "" at 1709283600
+//
+// It expires deliveryTTL after its last update.
+const deliveryTTL = 7 * 24 * time.Hour
+
+// Fields of a delivery hash.
+const (
+	fieldStatus = "status"
+	fieldReason = "reason"
+	fieldAt     = "at"
+)
+
+// DeliveryStatus is the status of a notification, see the tasks.Status*
+// constants.
+type DeliveryStatus struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func deliveryKey(taskID string) string {
+	return "delivery:" + taskID
+}
+
+// SetDeliveryStatus sets the delivery status of the notification of a task.
+func SetDeliveryStatus(ctx context.Context, taskID string, s DeliveryStatus) error {
+	if taskID == "" || s.Status == "" {
+		return errors.New("a delivery status needs a task ID and a status")
+	}
+	key := deliveryKey(taskID)
+	pipe := client().TxPipeline()
+	pipe.HSet(ctx, key, fieldStatus, s.Status, fieldReason, s.Reason, fieldAt, s.At.Unix())
+	pipe.Expire(ctx, key, deliveryTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("pipe.Exec failed: %v", err)
+	}
+	return nil
+}
+
+// updateDeliveryCmd sets a delivery status unless the current one is
+// later.
+//
+// KEYS[1] -> delivery:<task id>
+// ARGV[1] -> status
+// ARGV[2] -> reason
+// ARGV[3] -> at, unix seconds
+// ARGV[4] -> TTL in seconds
+// ARGV[5] -> current status when none is set
+// ARGV[6:] -> statuses later than ARGV[1]
+//
+// Returns 1 if the status was set, 0 otherwise.
+var updateDeliveryCmd = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], "status") or ARGV[5]
+for i = 6, #ARGV do
+	if current == ARGV[i] then
+		return 0
+	end
+end
+redis.call("HSET", KEYS[1], "status", ARGV[1], "reason", ARGV[2], "at", ARGV[3])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+return 1
+`)
+
+// UpdateDeliveryStatus sets the delivery status of the notification of a
+// task, unless its current status, or current when none was set, is one of
+// later. It reports whether the status was set. Concurrent updates are
+// checked against each other.
+func UpdateDeliveryStatus(ctx context.Context, taskID string, s DeliveryStatus, current string, later ...string) (bool, error) {
+	if taskID == "" || s.Status == "" {
+		return false, errors.New("a delivery status needs a task ID and a status")
+	}
+	args := []any{s.Status, s.Reason, s.At.Unix(), int(deliveryTTL.Seconds()), current}
+	for _, status := range later {
+		args = append(args, status)
+	}
+	n, err := updateDeliveryCmd.Run(ctx, client(), []string{deliveryKey(taskID)}, args...).Int()
+	if err != nil {
+		return false, fmt.Errorf("update delivery script failed: %v", err)
+	}
+	return n == 1, nil
+}
+
+// GetDeliveryStatus returns the delivery status of the notification of a
+// task, and false if none was set.
+func GetDeliveryStatus(ctx context.Context, taskID string) (DeliveryStatus, bool, error) {
+	values, err := client().HGetAll(ctx, deliveryKey(taskID)).Result()
+	if err != nil {
+		return DeliveryStatus{}, false, fmt.Errorf("rdb.HGetAll failed: %v", err)
+	}
+	if values[fieldStatus] == "" {
+		return DeliveryStatus{}, false, nil
+	}
+	s := DeliveryStatus{Status: values[fieldStatus], Reason: values[fieldReason]}
+	if at, err := strconv.ParseInt(values[fieldAt], 10, 64); err == nil {
+		s.At = time.Unix(at, 0).UTC()
+	}
+	return s, true, nil
+}
+
+// A notification enqueued with tasks.Digest is sent by the digest task it
+// is grouped in: its task ID is mapped to the digest's for deliveryTTL.
+//
+//	SET digested:<task id> <digest task id>
+func digestedKey(taskID string) string {
+	return "digested:" + taskID
+}
+
+// SetDigest records that the notifications of taskIDs are sent by the
+// digest task digestID.
+func SetDigest(ctx context.Context, digestID string, taskIDs []string) error {
+	pipe := client().Pipeline()
+	for _, id := range taskIDs {
+		pipe.Set(ctx, digestedKey(id), digestID, deliveryTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("pipe.Exec failed: %v", err)
+	}
+	return nil
+}
+
+// GetDigest returns the ID of the digest task that sends the notification
+// of a task, and false if it was not digested.
+func GetDigest(ctx context.Context, taskID string) (string, bool, error) {
+	digestID, err := client().Get(ctx, digestedKey(taskID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("rdb.Get failed: %v", err)
+	}
+	return digestID, true, nil
+}
@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"exp1/db"
+)
+
+func TestUpdateDeliveryStatus(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	at := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		status, current string
+		later           []string
+		want            bool
+	}{
+		// Without a status, the current one is checked.
+		{status: "sent", current: "delivered", later: []string{"delivered"}, want: false},
+		{status: "sent", current: "queued", later: []string{"delivered"}, want: true},
+		{status: "delivered", current: "queued", want: true},
+		// Then the status set is.
+		{status: "sent", current: "queued", later: []string{"delivered"}, want: false},
+	} {
+		ok, err := db.UpdateDeliveryStatus(ctx, "a", db.DeliveryStatus{Status: tc.status, At: at}, tc.current, tc.later...)
+		if err != nil {
+			t.Fatalf("db.UpdateDeliveryStatus failed: %v", err)
+		}
+		if ok != tc.want {
+			t.Errorf("update to %s from %s: got %v, want %v", tc.status, tc.current, ok, tc.want)
+		}
+	}
+	s, ok, err := db.GetDeliveryStatus(ctx, "a")
+	if err != nil || !ok || s.Status != "delivered" || !s.At.Equal(at) {
+		t.Errorf("got %+v, %v, %v, want delivered", s, ok, err)
+	}
+}
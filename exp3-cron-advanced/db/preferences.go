@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The notification preferences of a recipient on a channel (email, sms or
+// push) are kept in a hash, and the latest skipped sends in a list:
+//
+//	HSET preferences:email:bob@example.com opt_out 1 quiet_start 22:00 quiet_end 07:00 timezone Europe/Paris
+//	HSET preferences:sms:+15552223333 suppressed "550 no such user" suppressed_at 1709283600
+//	LPUSH preferences:skips '{"channel":"email","recipient":"bob@example.com","reason":"opt_out",...}'
+//
+// Only the last skipsMaxLen skipped sends are kept.
+const skipsMaxLen = 1000
+
+const skipsKey = "preferences:skips"
+
+// Fields of a preferences hash.
+const (
+	fieldOptOut       = "opt_out"
+	fieldQuietStart   = "quiet_start"
+	fieldQuietEnd     = "quiet_end"
+	fieldTimezone     = "timezone"
+	fieldSuppressed   = "suppressed"
+	fieldSuppressedAt = "suppressed_at"
+)
+
+// Reasons of a skipped send.
+const (
+	SkipOptOut     = "opt_out"
+	SkipSuppressed = "suppressed"
+)
+
+// Preferences are the notification preferences of a recipient on a channel.
+type Preferences struct {
+	OptOut       bool        `json:"opt_out"`
+	QuietHours   *QuietHours `json:"quiet_hours,omitempty"` // nil when not set
+	Suppressed   string      `json:"suppressed,omitempty"`  // why sends are suppressed, empty when they are not
+	SuppressedAt *time.Time  `json:"suppressed_at,omitempty"`
+}
+
+// QuietHours are the times of day when nothing is sent to a recipient,
+// from Start to End (15:04), which may be on the next day.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"` // IANA name, UTC if empty
+}
+
+// Validate checks the times and the time zone of the quiet hours.
+func (q QuietHours) Validate() error {
+	for _, t := range []string{q.Start, q.End} {
+		if _, err := time.Parse("15:04", t); err != nil {
+			return fmt.Errorf("invalid time of day %q, want HH:MM", t)
+		}
+	}
+	if q.Start == q.End {
+		return fmt.Errorf("quiet hours start and end at the same time")
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %v", err)
+	}
+	return nil
+}
+
+// Until returns the end of the quiet hours if now is within them, and false
+// otherwise. Invalid quiet hours are never quiet.
+func (q QuietHours) Until(now time.Time) (time.Time, bool) {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	start, err1 := time.Parse("15:04", q.Start)
+	end, err2 := time.Parse("15:04", q.End)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, false
+	}
+	local := now.In(loc)
+	minutes := func(t time.Time) int { return t.Hour()*60 + t.Minute() }
+	m, s, e := minutes(local), minutes(start), minutes(end)
+	var quiet bool
+	if s < e {
+		quiet = s <= m && m < e
+	} else {
+		quiet = m >= s || m < e
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	until := time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, loc)
+	if !until.After(now) {
+		until = time.Date(local.Year(), local.Month(), local.Day()+1, end.Hour(), end.Minute(), 0, 0, loc)
+	}
+	return until, true
+}
+
+// Check returns why a send at now must be skipped, if it must, or else
+// until when it must be deferred, zero if it must not.
+func (p Preferences) Check(now time.Time) (skip string, deferUntil time.Time) {
+	switch {
+	case p.Suppressed != "":
+		return SkipSuppressed, time.Time{}
+	case p.OptOut:
+		return SkipOptOut, time.Time{}
+	case p.QuietHours != nil:
+		until, _ := p.QuietHours.Until(now)
+		return "", until
+	}
+	return "", time.Time{}
+}
+
+func preferencesKey(channel, recipient string) string {
+	return "preferences:" + channel + ":" + recipient
+}
+
+// GetPreferences returns the preferences of a recipient on a channel, the
+// zero Preferences if there are none.
+func GetPreferences(ctx context.Context, channel, recipient string) (Preferences, error) {
+	fields, err := client().HGetAll(ctx, preferencesKey(channel, recipient)).Result()
+	if err != nil {
+		return Preferences{}, fmt.Errorf("rdb.HGetAll failed: %v", err)
+	}
+	var p Preferences
+	p.OptOut, _ = strconv.ParseBool(fields[fieldOptOut])
+	if fields[fieldQuietStart] != "" {
+		p.QuietHours = &QuietHours{Start: fields[fieldQuietStart], End: fields[fieldQuietEnd], Timezone: fields[fieldTimezone]}
+	}
+	p.Suppressed = fields[fieldSuppressed]
+	if sec, err := strconv.ParseInt(fields[fieldSuppressedAt], 10, 64); err == nil {
+		at := time.Unix(sec, 0).UTC()
+		p.SuppressedAt = &at
+	}
+	return p, nil
+}
+
+// SetOptOut opts a recipient out of a channel, or back in.
+func SetOptOut(ctx context.Context, channel, recipient string, optOut bool) error {
+	key := preferencesKey(channel, recipient)
+	var err error
+	if optOut {
+		err = client().HSet(ctx, key, fieldOptOut, "1").Err()
+	} else {
+		err = client().HDel(ctx, key, fieldOptOut).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("rdb.HSet failed: %v", err)
+	}
+	return nil
+}
+
+// SetQuietHours sets the quiet hours of a recipient on a channel, nil
+// removes them.
+func SetQuietHours(ctx context.Context, channel, recipient string, q *QuietHours) error {
+	key := preferencesKey(channel, recipient)
+	if q == nil {
+		if err := client().HDel(ctx, key, fieldQuietStart, fieldQuietEnd, fieldTimezone).Err(); err != nil {
+			return fmt.Errorf("rdb.HDel failed: %v", err)
+		}
+		return nil
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	if err := client().HSet(ctx, key, fieldQuietStart, q.Start, fieldQuietEnd, q.End, fieldTimezone, q.Timezone).Err(); err != nil {
+		return fmt.Errorf("rdb.HSet failed: %v", err)
+	}
+	return nil
+}
+
+// SetPreferences sets both the opt-out and the quiet hours of a recipient on
+// a channel, in one transaction: nil quiet hours removes them. The
+// suppression is kept.
+func SetPreferences(ctx context.Context, channel, recipient string, optOut bool, q *QuietHours) error {
+	if q != nil {
+		if err := q.Validate(); err != nil {
+			return err
+		}
+	}
+	key := preferencesKey(channel, recipient)
+	pipe := client().TxPipeline()
+	if optOut {
+		pipe.HSet(ctx, key, fieldOptOut, "1")
+	} else {
+		pipe.HDel(ctx, key, fieldOptOut)
+	}
+	if q != nil {
+		pipe.HSet(ctx, key, fieldQuietStart, q.Start, fieldQuietEnd, q.End, fieldTimezone, q.Timezone)
+	} else {
+		pipe.HDel(ctx, key, fieldQuietStart, fieldQuietEnd, fieldTimezone)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("pipe.Exec failed: %v", err)
+	}
+	return nil
+}
+
+// Suppress stops the sends to a recipient on a channel, eg: after a bounce.
+func Suppress(ctx context.Context, channel, recipient, reason string, at time.Time) error {
+	if reason == "" {
+		return errors.New("a suppression needs a reason")
+	}
+	key := preferencesKey(channel, recipient)
+	if err := client().HSet(ctx, key, fieldSuppressed, reason, fieldSuppressedAt, at.Unix()).Err(); err != nil {
+		return fmt.Errorf("rdb.HSet failed: %v", err)
+	}
+	return nil
+}
+
+// Unsuppress lifts the suppression of a recipient on a channel.
+func Unsuppress(ctx context.Context, channel, recipient string) error {
+	if err := client().HDel(ctx, preferencesKey(channel, recipient), fieldSuppressed, fieldSuppressedAt).Err(); err != nil {
+		return fmt.Errorf("rdb.HDel failed: %v", err)
+	}
+	return nil
+}
+
+// DeletePreferences removes all the preferences of a recipient on a channel.
+func DeletePreferences(ctx context.Context, channel, recipient string) error {
+	if err := client().Del(ctx, preferencesKey(channel, recipient)).Err(); err != nil {
+		return fmt.Errorf("rdb.Del failed: %v", err)
+	}
+	return nil
+}
+
+// Skip is a send that was skipped because of the preferences of its recipient.
+type Skip struct {
+	Channel   string    `json:"channel"`
+	Recipient string    `json:"recipient"`
+	Reason    string    `json:"reason"` // SkipOptOut or SkipSuppressed
+	TaskID    string    `json:"task_id"`
+	At        time.Time `json:"at"`
+}
+
+// RecordSkip records a skipped send, keeping the last skipsMaxLen ones.
+func RecordSkip(ctx context.Context, s Skip) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	pipe := client().TxPipeline()
+	pipe.LPush(ctx, skipsKey, b)
+	pipe.LTrim(ctx, skipsKey, 0, skipsMaxLen-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("pipe.Exec failed: %v", err)
+	}
+	return nil
+}
+
+// GetSkips returns the last n skipped sends, most recent first.
+func GetSkips(ctx context.Context, n int) ([]Skip, error) {
+	values, err := client().LRange(ctx, skipsKey, 0, int64(n)-1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("rdb.LRange failed: %v", err)
+	}
+	skips := make([]Skip, 0, len(values))
+	for _, v := range values {
+		var s Skip
+		if err := json.Unmarshal([]byte(v), &s); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal failed: %v", err)
+		}
+		skips = append(skips, s)
+	}
+	return skips, nil
+}
@@ -0,0 +1,142 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"exp1/db"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	return s
+}
+
+func TestQuietHoursUntil(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatalf("time.LoadLocation failed: %v", err)
+	}
+	night := db.QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Paris"}
+	lunch := db.QuietHours{Start: "12:00", End: "13:30"}
+	for _, tc := range []struct {
+		q    db.QuietHours
+		now  time.Time
+		want time.Time // zero if not quiet
+	}{
+		{night, time.Date(2024, 3, 1, 21, 59, 0, 0, paris), time.Time{}},
+		{night, time.Date(2024, 3, 1, 22, 0, 0, 0, paris), time.Date(2024, 3, 2, 7, 0, 0, 0, paris)},
+		{night, time.Date(2024, 3, 2, 3, 0, 0, 0, paris), time.Date(2024, 3, 2, 7, 0, 0, 0, paris)},
+		{night, time.Date(2024, 3, 2, 7, 0, 0, 0, paris), time.Time{}},
+		// 23:30 UTC is 00:30 in Paris.
+		{night, time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC), time.Date(2024, 3, 2, 7, 0, 0, 0, paris)},
+		{lunch, time.Date(2024, 3, 1, 12, 45, 0, 0, time.UTC), time.Date(2024, 3, 1, 13, 30, 0, 0, time.UTC)},
+		{lunch, time.Date(2024, 3, 1, 13, 30, 0, 0, time.UTC), time.Time{}},
+	} {
+		got, ok := tc.q.Until(tc.now)
+		if ok != !tc.want.IsZero() || !got.Equal(tc.want) {
+			t.Errorf("%+v at %v: got %v, %v, want %v", tc.q, tc.now, got, ok, tc.want)
+		}
+	}
+
+	for _, q := range []db.QuietHours{
+		{Start: "22h", End: "07:00"},
+		{Start: "22:00", End: "22:00"},
+		{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"},
+	} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("%+v: got no error", q)
+		}
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	const recipient = "bob@example.com"
+	now := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+
+	prefs, err := db.GetPreferences(ctx, "email", recipient)
+	if err != nil {
+		t.Fatalf("db.GetPreferences failed: %v", err)
+	}
+	if skip, until := prefs.Check(now); skip != "" || !until.IsZero() {
+		t.Errorf("no preferences: got skip %q until %v, want a send", skip, until)
+	}
+
+	quiet := &db.QuietHours{Start: "22:00", End: "07:00"}
+	if err := db.SetQuietHours(ctx, "email", recipient, quiet); err != nil {
+		t.Fatalf("db.SetQuietHours failed: %v", err)
+	}
+	prefs, _ = db.GetPreferences(ctx, "email", recipient)
+	if skip, until := prefs.Check(now); skip != "" || !until.Equal(time.Date(2024, 3, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("quiet hours: got skip %q until %v, want a send deferred to 07:00", skip, until)
+	}
+
+	if err := db.SetOptOut(ctx, "email", recipient, true); err != nil {
+		t.Fatalf("db.SetOptOut failed: %v", err)
+	}
+	prefs, _ = db.GetPreferences(ctx, "email", recipient)
+	if skip, _ := prefs.Check(now); skip != db.SkipOptOut {
+		t.Errorf("opted out: got skip %q, want %q", skip, db.SkipOptOut)
+	}
+
+	if err := db.Suppress(ctx, "email", recipient, "550 no such user", now); err != nil {
+		t.Fatalf("db.Suppress failed: %v", err)
+	}
+	prefs, _ = db.GetPreferences(ctx, "email", recipient)
+	if skip, _ := prefs.Check(now); skip != db.SkipSuppressed || prefs.Suppressed != "550 no such user" || !prefs.SuppressedAt.Equal(now) {
+		t.Errorf("suppressed: got skip %q and preferences %+v", skip, prefs)
+	}
+
+	// Other channels of the same recipient are not affected.
+	if prefs, _ := db.GetPreferences(ctx, "sms", recipient); prefs.OptOut || prefs.QuietHours != nil || prefs.Suppressed != "" {
+		t.Errorf("sms: got preferences %+v, want none", prefs)
+	}
+
+	if err := db.Unsuppress(ctx, "email", recipient); err != nil {
+		t.Fatalf("db.Unsuppress failed: %v", err)
+	}
+	if err := db.SetPreferences(ctx, "email", recipient, false, nil); err != nil {
+		t.Fatalf("db.SetPreferences failed: %v", err)
+	}
+	prefs, _ = db.GetPreferences(ctx, "email", recipient)
+	if prefs.OptOut || prefs.QuietHours != nil || prefs.Suppressed != "" || prefs.SuppressedAt != nil {
+		t.Errorf("after reset: got preferences %+v, want none", prefs)
+	}
+	if err := db.SetQuietHours(ctx, "email", recipient, &db.QuietHours{Start: "7", End: "8"}); err == nil {
+		t.Error("invalid quiet hours: got no error")
+	}
+	// Nothing is set when the quiet hours are invalid.
+	if err := db.SetPreferences(ctx, "email", recipient, true, &db.QuietHours{Start: "7", End: "8"}); err == nil {
+		t.Error("db.SetPreferences with invalid quiet hours: got no error")
+	}
+	if prefs, _ := db.GetPreferences(ctx, "email", recipient); prefs.OptOut {
+		t.Errorf("got preferences %+v, want no opt-out", prefs)
+	}
+}
+
+func TestSkips(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	at := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := db.RecordSkip(ctx, db.Skip{Channel: "sms", Recipient: "+15552223333", Reason: db.SkipOptOut, TaskID: id, At: at}); err != nil {
+			t.Fatalf("db.RecordSkip failed: %v", err)
+		}
+	}
+	skips, err := db.GetSkips(ctx, 2)
+	if err != nil {
+		t.Fatalf("db.GetSkips failed: %v", err)
+	}
+	if len(skips) != 2 || skips[0].TaskID != "c" || skips[1].TaskID != "b" || !skips[0].At.Equal(at) {
+		t.Errorf("got skips %+v, want c then b", skips)
+	}
+}
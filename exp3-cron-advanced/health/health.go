@@ -0,0 +1,185 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Endpoints served by Handler:
+// GET /healthz -> 200 while the process is up (liveness)
+// GET /readyz  -> 200 if every readiness check passes, 503 otherwise
+
+// Check reports whether a dependency is ready. A nil error means ready.
+type Check func(ctx context.Context) error
+
+// Config holds the settings of the health endpoints, read from the environment.
+type Config struct {
+	// Addr is the listen address of the HTTP endpoints (HEALTH_ADDR).
+	Addr string
+	// CheckTimeout bounds a single readiness check (HEALTH_CHECK_TIMEOUT).
+	CheckTimeout time.Duration
+	// MaxSyncAge is how old the last successful schedule sync may be
+	// before a scheduler reports not ready (HEALTH_MAX_SYNC_AGE).
+	MaxSyncAge time.Duration
+	// RedisCheckInterval is how often a server pings Redis (HEALTH_REDIS_CHECK_INTERVAL).
+	RedisCheckInterval time.Duration
+}
+
+// ConfigFromEnv reads Config from the environment, using defaultAddr when
+// HEALTH_ADDR is not set.
+func ConfigFromEnv(defaultAddr string) (Config, error) {
+	cfg := Config{
+		Addr:               defaultAddr,
+		CheckTimeout:       2 * time.Second,
+		MaxSyncAge:         30 * time.Second,
+		RedisCheckInterval: 15 * time.Second,
+	}
+	if addr := os.Getenv("HEALTH_ADDR"); addr != "" {
+		cfg.Addr = addr
+	}
+	for name, d := range map[string]*time.Duration{
+		"HEALTH_CHECK_TIMEOUT":        &cfg.CheckTimeout,
+		"HEALTH_MAX_SYNC_AGE":         &cfg.MaxSyncAge,
+		"HEALTH_REDIS_CHECK_INTERVAL": &cfg.RedisCheckInterval,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*d = v
+	}
+	return cfg, nil
+}
+
+// Handler serves the liveness and readiness endpoints.
+type Handler struct {
+	timeout time.Duration
+	mux     *http.ServeMux
+
+	mu     sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+func NewHandler(timeout time.Duration) *Handler {
+	h := &Handler{
+		timeout: timeout,
+		mux:     http.NewServeMux(),
+		checks:  make(map[string]Check),
+	}
+	h.mux.HandleFunc("/healthz", h.healthz)
+	h.mux.HandleFunc("/readyz", h.readyz)
+	return h
+}
+
+// AddReadinessCheck registers a check reported under name by /readyz.
+func (h *Handler) AddReadinessCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Handle serves other endpoints next to the health ones, with the patterns
+// of http.ServeMux.
+func (h *Handler) Handle(pattern string, handler http.Handler) {
+	h.mux.Handle(pattern, handler)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Start listens on addr and serves the endpoints in the background until ctx is cancelled.
+func (h *Handler) Start(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen failed: %v", err)
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(ln)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	return nil
+}
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, response{Status: "ok"})
+}
+
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make(map[string]Check, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	resp := response{Status: "ok", Checks: make(map[string]string, len(names))}
+	code := http.StatusOK
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			resp.Status = "unavailable"
+			resp.Checks[name] = err.Error()
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		resp.Checks[name] = "ok"
+	}
+	writeJSON(w, code, resp)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Status holds the latest result of a probe that runs in the background,
+// such as the asynq server's HealthCheckFunc, so it can be used as a Check.
+type Status struct {
+	mu       sync.Mutex
+	err      error
+	reported bool
+}
+
+// Set records the result of the latest probe.
+func (s *Status) Set(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	s.reported = true
+}
+
+// Check returns the result of the latest probe.
+func (s *Status) Check(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.reported {
+		return fmt.Errorf("no probe result yet")
+	}
+	return s.err
+}
@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"exp1/db"
+	"exp1/health"
 	"exp1/tasks"
 
 	"github.com/go-faker/faker/v4"
@@ -15,25 +20,49 @@ import (
 	"github.com/lmittmann/tint"
 )
 
-const redisAddr = "127.0.0.1:6379"
+const (
+	defaultRedisAddr  = "127.0.0.1:6379"
+	defaultHealthAddr = ":8081"
+	defaultTimezone   = "America/New_York"
+)
 
 type PeriodicTasks struct {
-	log *slog.Logger
+	ctx      context.Context
+	log      *slog.Logger
+	lastSync atomic.Int64 // unix nanoseconds of the last successful GetConfigs
+
+	// Digest enqueues the email, SMS and push notifications with tasks.DigestGroup,
+	// so that the server sends the ones to the same recipient as one.
+	Digest bool
 }
 
-func NewPeriodicTasks(log *slog.Logger) *PeriodicTasks {
+// NewPeriodicTasks returns a provider whose db reads are bound to ctx,
+// so that a sync in progress is abandoned once ctx is cancelled.
+func NewPeriodicTasks(ctx context.Context, log *slog.Logger) *PeriodicTasks {
 	return &PeriodicTasks{
+		ctx: ctx,
 		log: log.With(slog.String("name", "periodic_tasks")),
 	}
 }
 
+// LastSync returns the time of the last successful GetConfigs call,
+// or the zero time if there was none yet.
+func (p *PeriodicTasks) LastSync() time.Time {
+	n := p.lastSync.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
 func (p *PeriodicTasks) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
-	// TODO: propagate context
-	ctx := context.Background()
-	configs, err := db.GetScheduleConfigs(ctx)
+	configs, invalid, err := db.GetScheduleConfigs(p.ctx)
 	if err != nil {
 		return nil, fmt.Errorf("db.GetScheduleConfigs failed: %v", err)
 	}
+	for _, e := range invalid {
+		p.log.Error("skipping invalid schedule", slog.String("key", e.Key), tint.Err(e.Err))
+	}
 
 	var periodicTaskConfig []*asynq.PeriodicTaskConfig
 	for _, config := range configs {
@@ -43,9 +72,11 @@ func (p *PeriodicTasks) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
 		case tasks.TypeNotificationEmail:
 			task, err = tasks.BuildNotificationEmail(faker.Email(), faker.Sentence(), faker.Paragraph())
 		case tasks.TypeNotificationSMS:
-			task, err = tasks.BuildNotificationSMS(faker.Phonenumber(), faker.Sentence())
+			task, err = tasks.BuildNotificationSMS(faker.E164PhoneNumber(), faker.Sentence())
 		case tasks.TypeNotificationPush:
-			task, err = tasks.BuildNotificationPush(faker.Phonenumber(), faker.Sentence())
+			task, err = tasks.BuildNotificationPush(faker.UUIDDigit(), faker.Sentence())
+		case tasks.TypeNotificationMulti:
+			task, err = buildNotificationMulti()
 		default:
 			p.log.Warn("unknown task type", slog.String("task_type", config.TaskType))
 			continue
@@ -55,29 +86,113 @@ func (p *PeriodicTasks) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
 			continue
 		}
 
+		var opts []asynq.Option
+		if p.Digest && tasks.Channel(config.TaskType) != "" {
+			opt, err := tasks.DigestGroup(task)
+			if err != nil {
+				p.log.Error("could not digest task", tint.Err(err))
+				continue
+			}
+			opts = append(opts, opt)
+		}
+
 		p.log.Info("adding task", slog.String("task_type", config.TaskType), slog.String("cron_spec", config.CronSpec))
 		periodicTaskConfig = append(periodicTaskConfig, &asynq.PeriodicTaskConfig{
-			Cronspec: config.CronSpec,
+			Cronspec: cronSpec(config),
 			Task:     task,
+			Opts:     opts,
 		})
 	}
 
+	p.lastSync.Store(time.Now().UnixNano())
 	return periodicTaskConfig, nil
 }
 
+// buildNotificationMulti builds a push notification falling back to SMS,
+// then to email.
+func buildNotificationMulti() (*asynq.Task, error) {
+	body := faker.Sentence()
+	push, err := tasks.BuildNotificationPush(faker.UUIDDigit(), body)
+	if err != nil {
+		return nil, err
+	}
+	sms, err := tasks.BuildNotificationSMS(faker.E164PhoneNumber(), body)
+	if err != nil {
+		return nil, err
+	}
+	email, err := tasks.BuildNotificationEmail(faker.Email(), faker.Sentence(), body)
+	if err != nil {
+		return nil, err
+	}
+	return tasks.BuildNotificationMulti(push, sms, email)
+}
+
+// cronSpec returns the cron spec of config, prefixed with its time zone if it has one.
+//
+// asynq's PeriodicTaskManager fires the spec with the parser of robfig/cron,
+// which follows the wall clock of the time zone when the clocks change
+// (see TestCronSpecDST):
+//
+//   - wall times skipped when the clocks go forward do not fire that day:
+//     "30 2 * * *" in America/New_York fires next at 02:30 EDT the day after;
+//   - wall times repeated when the clocks go back fire at both occurrences:
+//     "30 1 * * *" fires at 01:30 EDT and again at 01:30 EST;
+//   - specs matching every hour fire in every hour that exists.
+//
+// Schedules that must fire exactly once a day should use @every, a time
+// outside 01:00-03:00, or a zone without DST, such as UTC.
+func cronSpec(config db.ScheduleConfig) string {
+	if config.Timezone == "" {
+		return config.CronSpec
+	}
+	return "CRON_TZ=" + config.Timezone + " " + config.CronSpec
+}
+
 func main() {
 	log := tasks.Logger(os.Stderr, os.Getenv("LOG_LEVEL"))
 
-	loc, err := time.LoadLocation("America/New_York")
+	if err := run(log); err != nil {
+		log.Error("could not run manager", tint.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run starts the manager and blocks until SIGINT or SIGTERM is received.
+func run(log *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer db.Close()
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = defaultRedisAddr
+	}
+
+	healthCfg, err := health.ConfigFromEnv(defaultHealthAddr)
+	if err != nil {
+		return err
+	}
+
+	// Schedules without a time zone of their own fire in this one.
+	timezone := os.Getenv("SCHEDULER_TIMEZONE")
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	loc, err := time.LoadLocation(timezone)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid SCHEDULER_TIMEZONE: %v", err)
 	}
 
-	provider := NewPeriodicTasks(log)
+	provider := NewPeriodicTasks(ctx, log)
+	if value := os.Getenv("SCHEDULER_DIGEST"); value != "" {
+		if provider.Digest, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid SCHEDULER_DIGEST: %v", err)
+		}
+	}
 
 	manager, err := asynq.NewPeriodicTaskManager(
 		asynq.PeriodicTaskManagerOpts{
-			RedisConnOpt:               asynq.RedisClientOpt{Addr: "localhost:6379"},
+			RedisConnOpt:               asynq.RedisClientOpt{Addr: redisAddr},
 			PeriodicTaskConfigProvider: provider,         // this provider object is the interface to your config source
 			SyncInterval:               10 * time.Second, // this field specifies how often sync should happen
 			SchedulerOpts: &asynq.SchedulerOpts{
@@ -86,12 +201,32 @@ func main() {
 			},
 		})
 	if err != nil {
-		log.Error("could not create manager", tint.Err(err))
-		os.Exit(1)
+		return fmt.Errorf("could not create manager: %v", err)
 	}
 
-	log.Info("starting manager", slog.String("addr", "localhost:6379"))
-	if err := manager.Run(); err != nil {
-		log.Error("could not run manager", tint.Err(err))
+	checks := health.NewHandler(healthCfg.CheckTimeout)
+	checks.AddReadinessCheck("redis", db.Ping)
+	checks.AddReadinessCheck("sync", func(ctx context.Context) error {
+		last := provider.LastSync()
+		if last.IsZero() {
+			return fmt.Errorf("no successful sync yet")
+		}
+		if age := time.Since(last); age > healthCfg.MaxSyncAge {
+			return fmt.Errorf("last successful sync %v ago", age.Round(time.Second))
+		}
+		return nil
+	})
+	if err := checks.Start(ctx, healthCfg.Addr); err != nil {
+		return fmt.Errorf("could not start health endpoints: %v", err)
 	}
+
+	log.Info("starting manager", slog.String("addr", redisAddr), slog.String("health_addr", healthCfg.Addr))
+	if err := manager.Start(); err != nil {
+		return fmt.Errorf("manager.Start failed: %v", err)
+	}
+
+	<-ctx.Done()
+	log.Info("shutting down manager")
+	manager.Shutdown()
+	return nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/robfig/cron/v3"
+)
+
+func TestRunStopsOnSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		t.Run(sig.String(), func(t *testing.T) {
+			s := miniredis.RunT(t)
+			s.Set("schedule:notification:email", "* * * * *")
+			t.Setenv("REDIS_ADDR", s.Addr())
+			t.Setenv("HEALTH_ADDR", "127.0.0.1:0")
+
+			done := make(chan error, 1)
+			go func() { done <- run(tasks.Logger(io.Discard, "")) }()
+
+			// The first connection is made by the initial sync, after the signal handler is installed.
+			waitFor(t, func() bool { return s.TotalConnectionCount() > 0 })
+			if err := syscall.Kill(syscall.Getpid(), sig); err != nil {
+				t.Fatalf("syscall.Kill failed: %v", err)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("run failed: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("run did not return after signal")
+			}
+
+			// The scheduler and db Redis clients are closed on the way out.
+			waitFor(t, func() bool { return s.CurrentConnectionCount() == 0 })
+		})
+	}
+}
+
+func TestGetConfigsTimezone(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.Set("schedule:notification:email", "CRON_TZ=Europe/Paris 0 9 * * *")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	p := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""))
+	configs, err := p.GetConfigs()
+	if err != nil {
+		t.Fatalf("GetConfigs failed: %v", err)
+	}
+	if len(configs) != 1 || configs[0].Cronspec != "CRON_TZ=Europe/Paris 0 9 * * *" {
+		t.Fatalf("got configs %v, want one with CRON_TZ=Europe/Paris 0 9 * * *", configs)
+	}
+
+	// An unknown time zone skips its schedule only.
+	s.Set("schedule:notification:sms", "CRON_TZ=Mars/Olympus_Mons 0 9 * * *")
+	configs, err = p.GetConfigs()
+	if err != nil {
+		t.Fatalf("GetConfigs with an unknown time zone failed: %v", err)
+	}
+	if len(configs) != 1 || configs[0].Task.Type() != tasks.TypeNotificationEmail {
+		t.Errorf("got configs %v, want the email one only", configs)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCronSpecDST pins the DST behavior documented on cronSpec, with the
+// parser asynq's scheduler uses.
+func TestCronSpecDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("time.LoadLocation failed: %v", err)
+	}
+	// 2024-03-10: 02:00 EST -> 03:00 EDT, 2024-11-03: 02:00 EDT -> 01:00 EST
+	springEve := time.Date(2024, 3, 9, 12, 0, 0, 0, ny)
+	fallEve := time.Date(2024, 11, 2, 12, 0, 0, 0, ny)
+
+	for _, tc := range []struct {
+		name     string
+		spec     string
+		timezone string
+		start    time.Time
+		want     []string // fire times in UTC
+	}{
+		{
+			name:     "skipped wall time does not fire that day",
+			spec:     "30 2 * * *",
+			timezone: "America/New_York",
+			start:    springEve,
+			want:     []string{"2024-03-11 06:30:00", "2024-03-12 06:30:00"},
+		},
+		{
+			name:     "skipped wall times do not fire",
+			spec:     "*/30 1-3 * * *",
+			timezone: "America/New_York",
+			start:    springEve,
+			want:     []string{"2024-03-10 06:00:00", "2024-03-10 06:30:00", "2024-03-10 07:00:00", "2024-03-10 07:30:00"},
+		},
+		{
+			name:     "repeated wall time fires twice",
+			spec:     "30 1 * * *",
+			timezone: "America/New_York",
+			start:    fallEve,
+			want:     []string{"2024-11-03 05:30:00", "2024-11-03 06:30:00", "2024-11-04 06:30:00"},
+		},
+		{
+			name:     "every hour fires in every hour that exists",
+			spec:     "0 * * * *",
+			timezone: "America/New_York",
+			start:    time.Date(2024, 11, 3, 0, 30, 0, 0, ny),
+			want:     []string{"2024-11-03 05:00:00", "2024-11-03 06:00:00", "2024-11-03 07:00:00"},
+		},
+		{
+			name:  "location of the scheduler without a time zone",
+			spec:  "30 2 * * *",
+			start: springEve,
+			want:  []string{"2024-03-11 06:30:00"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := cron.ParseStandard(cronSpec(db.ScheduleConfig{CronSpec: tc.spec, Timezone: tc.timezone}))
+			if err != nil {
+				t.Fatalf("cron.ParseStandard failed: %v", err)
+			}
+			next := tc.start
+			for i, want := range tc.want {
+				next = schedule.Next(next)
+				if got := next.UTC().Format(time.DateTime); got != want {
+					t.Fatalf("fire %d: got %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
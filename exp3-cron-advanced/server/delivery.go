@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+	"github.com/lmittmann/tint"
+)
+
+// Endpoints of deliveriesAPI, <id> is the ID of the notification task
+// returned by client.Enqueue:
+// GET  /deliveries/<id>?queue=default -> delivery status, the queue is optional
+// POST /deliveries/<id>               -> status callback: {"status": "delivered", "reason": "..."}
+// POST /deliveries/twilio?id=<id>     -> status callback of Twilio (SMS_STATUS_CALLBACK)
+//
+// Requests must have token in the token query parameter or as a bearer
+// token. When it is not set, callbacks are not served, since a forged
+// bounce would suppress its recipient, and statuses are served without
+// their recipient.
+
+// errDeliveryNotFound is returned for IDs that are neither a notification
+// task nor have a delivery status.
+var errDeliveryNotFound = errors.New("notification not found")
+
+// statusRanks orders the delivery statuses: a callback does not replace a
+// status with an earlier one, as providers may post them out of order.
+var statusRanks = map[string]int{
+	tasks.StatusQueued:    0,
+	tasks.StatusSent:      1,
+	tasks.StatusDelivered: 2,
+	tasks.StatusBounced:   2,
+	tasks.StatusFailed:    2,
+	tasks.StatusSkipped:   2,
+}
+
+// deliveryResponse is a delivery status, with the ID of the task it is the
+// status of: notifications digested or deferred by quiet hours are sent by
+// another task.
+type deliveryResponse struct {
+	ID string `json:"id"`
+	tasks.Delivery
+}
+
+func deliveriesAPI(log *slog.Logger, inspector *asynq.Inspector, queues []string, token string) http.Handler {
+	mux := http.NewServeMux()
+	getDelivery := func(w http.ResponseWriter, r *http.Request) {
+		qs := queues
+		if queue := r.URL.Query().Get("queue"); queue != "" {
+			qs = []string{queue}
+		}
+		id := r.PathValue("id")
+		// Follow the notification sent in a digest, see tasks.Digest.
+		digestID, ok, err := db.GetDigest(r.Context(), id)
+		if err != nil {
+			writeDeliveryError(w, err)
+			return
+		}
+		if ok {
+			id = digestID
+		}
+		d, err := findDelivery(r.Context(), inspector, qs, id)
+		if err != nil {
+			writeDeliveryError(w, err)
+			return
+		}
+		// Follow the notification deferred by quiet hours, see deferTask.
+		for {
+			deferred, err := findDelivery(r.Context(), inspector, qs, "deferred:"+id)
+			if errors.Is(err, errDeliveryNotFound) {
+				break
+			}
+			if err != nil {
+				writeDeliveryError(w, err)
+				return
+			}
+			id, d = "deferred:"+id, deferred
+		}
+		if token == "" {
+			d.Recipient = ""
+		}
+		writeJSON(w, http.StatusOK, deliveryResponse{ID: id, Delivery: d})
+	}
+	if token == "" {
+		mux.HandleFunc("GET /deliveries/{id}", getDelivery)
+		return mux
+	}
+	mux.HandleFunc("GET /deliveries/{id}", withToken(token, getDelivery))
+	mux.HandleFunc("POST /deliveries/{id}", withToken(token, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Status string `json:"status"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+			return
+		}
+		if _, ok := statusRanks[body.Status]; !ok || body.Status == tasks.StatusQueued {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid status %q", body.Status))
+			return
+		}
+		if err := updateDelivery(r.Context(), log, inspector, queues, r.PathValue("id"), body.Status, body.Reason); err != nil {
+			writeDeliveryError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /deliveries/twilio", withToken(token, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if err := r.ParseForm(); err != nil || id == "" {
+			writeError(w, http.StatusBadRequest, errors.New("invalid callback, want an id and a form"))
+			return
+		}
+		status, reason := twilioStatus(r.PostForm.Get("MessageStatus"), r.PostForm.Get("ErrorCode"))
+		if status == "" {
+			w.WriteHeader(http.StatusNoContent) // not sent yet
+			return
+		}
+		if err := updateDelivery(r.Context(), log, inspector, queues, id, status, reason); err != nil {
+			writeDeliveryError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return mux
+}
+
+// findDelivery returns the delivery status of the notification task id,
+// looked up in queues: the status set by the callbacks, or else the one
+// asynq knows, while it keeps the task.
+func findDelivery(ctx context.Context, inspector *asynq.Inspector, queues []string, id string) (tasks.Delivery, error) {
+	var d tasks.Delivery
+	found := false
+	for _, queue := range queues {
+		info, err := inspector.GetTaskInfo(queue, id)
+		if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+			continue
+		}
+		if err != nil {
+			return d, fmt.Errorf("inspector.GetTaskInfo failed: %v", err)
+		}
+		d, found = tasks.DeliveryOf(info)
+		break
+	}
+	s, ok, err := db.GetDeliveryStatus(ctx, id)
+	if err != nil {
+		return d, err
+	}
+	if ok {
+		d.Status, d.Reason, d.At = s.Status, s.Reason, s.At
+	} else if !found {
+		return d, errDeliveryNotFound
+	}
+	return d, nil
+}
+
+// updateDelivery sets the delivery status of the notification task id,
+// unless it already has a later one, also when callbacks of the task race
+// (see db.UpdateDeliveryStatus). A bounced recipient is suppressed.
+func updateDelivery(ctx context.Context, log *slog.Logger, inspector *asynq.Inspector, queues []string, id, status, reason string) error {
+	d, err := findDelivery(ctx, inspector, queues, id)
+	if err != nil {
+		return err
+	}
+	var later []string
+	for s, rank := range statusRanks {
+		if rank > statusRanks[status] {
+			later = append(later, s)
+		}
+	}
+	now := time.Now()
+	ok, err := db.UpdateDeliveryStatus(ctx, id, db.DeliveryStatus{Status: status, Reason: reason, At: now.UTC()}, d.Status, later...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Debug("delivery status ignored", slog.String("id", id), slog.String("status", status), slog.String("current", d.Status))
+		return nil
+	}
+	log.Info("delivery status", slog.String("id", id), slog.String("status", status), slog.String("reason", reason))
+	if status == tasks.StatusBounced && d.Channel != "" && d.Recipient != "" {
+		if reason == "" {
+			reason = "bounced"
+		}
+		if err := db.Suppress(ctx, d.Channel, d.Recipient, reason, now); err != nil {
+			log.Error("could not suppress recipient", slog.String("recipient", d.Recipient), tint.Err(err))
+		}
+	}
+	return nil
+}
+
+// twilioStatus maps the MessageStatus of a Twilio status callback to a
+// delivery status, "" while the message is not sent.
+func twilioStatus(messageStatus, errorCode string) (status, reason string) {
+	if errorCode != "" {
+		reason = "twilio " + errorCode
+	}
+	switch messageStatus {
+	case "sent":
+		return tasks.StatusSent, reason
+	case "delivered", "read":
+		return tasks.StatusDelivered, reason
+	case "undelivered", "failed":
+		if (&tasks.ProviderError{Provider: "twilio", Code: errorCode}).Bounced() {
+			return tasks.StatusBounced, reason
+		}
+		return tasks.StatusFailed, reason
+	}
+	return "", ""
+}
+
+// withToken rejects requests without token, and every request if it is
+// not set.
+func withToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			got = bearer
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeDeliveryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDeliveryNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestDeliveriesAPI(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	redisOpt := asynq.RedisClientOpt{Addr: s.Addr()}
+	ctx := context.Background()
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+
+	const (
+		delivered = "+15550000001"
+		bounced   = "+15550000002"
+		optedOut  = "+15550000003"
+		rejected  = "+15550000004"
+	)
+	if err := db.SetOptOut(ctx, tasks.ChannelSMS, optedOut, true); err != nil {
+		t.Fatalf("db.SetOptOut failed: %v", err)
+	}
+	log := tasks.Logger(io.Discard, "")
+	mux := asynq.NewServeMux()
+	mux.Use(checkPreferences(log, client))
+	sms := tasks.NewProcessNotificationSMS(log, tasks.LogSMSSender{Log: log})
+	mux.HandleFunc(tasks.TypeNotificationSMS, func(ctx context.Context, task *asynq.Task) error {
+		if strings.Contains(string(task.Payload()), rejected) {
+			return fmt.Errorf("could not send SMS: %w", &tasks.ProviderError{Provider: "twilio", StatusCode: 400, Code: "21211"})
+		}
+		return sms.ProcessTask(ctx, task)
+	})
+
+	// The low queue is not processed, its notifications stay queued.
+	srv := asynq.NewServer(redisOpt, asynq.Config{Queues: map[string]int{"default": 1}, LogLevel: asynq.FatalLevel})
+	if err := srv.Start(mux); err != nil {
+		t.Fatalf("srv.Start failed: %v", err)
+	}
+	defer srv.Shutdown()
+
+	ids := map[string]string{}
+	for _, recipient := range []string{delivered, bounced, optedOut, rejected, "queued"} {
+		queue := "default"
+		if recipient == "queued" {
+			recipient, queue = "+15550000005", "low"
+		}
+		task, err := tasks.BuildNotificationSMS(recipient, "Hello")
+		if err != nil {
+			t.Fatalf("tasks.BuildNotificationSMS failed: %v", err)
+		}
+		info, err := client.Enqueue(task, asynq.Queue(queue))
+		if err != nil {
+			t.Fatalf("client.Enqueue failed: %v", err)
+		}
+		ids[recipient] = info.ID
+	}
+	for _, recipient := range []string{delivered, bounced, optedOut} {
+		waitFor(t, func() bool {
+			info, err := inspector.GetTaskInfo("default", ids[recipient])
+			return err == nil && info.State == asynq.TaskStateCompleted
+		})
+	}
+	waitFor(t, func() bool {
+		info, err := inspector.GetTaskInfo("default", ids[rejected])
+		return err == nil && info.State == asynq.TaskStateArchived
+	})
+
+	srvAPI := httptest.NewServer(deliveriesAPI(log, inspector, []string{"critical", "default", "low"}, "t0k"))
+	defer srvAPI.Close()
+	do := func(method, path, contentType, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srvAPI.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("http.NewRequest failed: %v", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	twilio := func(id, status, errorCode string) int {
+		t.Helper()
+		form := url.Values{"MessageStatus": {status}, "ErrorCode": {errorCode}}
+		code, _ := do("POST", "/deliveries/twilio?token=t0k&id="+url.QueryEscape(id), "application/x-www-form-urlencoded", form.Encode())
+		return code
+	}
+	status := func(id string) deliveryResponse {
+		t.Helper()
+		code, body := do("GET", "/deliveries/"+url.PathEscape(id)+"?token=t0k", "", "")
+		var d deliveryResponse
+		if err := json.Unmarshal([]byte(body), &d); code != http.StatusOK || err != nil {
+			t.Fatalf("GET /deliveries/%s: got %d %s", id, code, body)
+		}
+		return d
+	}
+
+	if d := status(ids[delivered]); d.Status != tasks.StatusSent || d.Channel != tasks.ChannelSMS || d.Recipient != delivered || d.ID != ids[delivered] {
+		t.Errorf("got %+v, want the SMS to %s sent", d, delivered)
+	}
+	if code := twilio(ids[delivered], "delivered", ""); code != http.StatusNoContent {
+		t.Errorf("delivered callback: got %d", code)
+	}
+	// A late sent callback does not undo the delivery.
+	twilio(ids[delivered], "sent", "")
+	if d := status(ids[delivered]); d.Status != tasks.StatusDelivered {
+		t.Errorf("got %+v, want delivered", d)
+	}
+
+	if code := twilio(ids[bounced], "undelivered", "30005"); code != http.StatusNoContent {
+		t.Errorf("undelivered callback: got %d", code)
+	}
+	if d := status(ids[bounced]); d.Status != tasks.StatusBounced || d.Reason != "twilio 30005" {
+		t.Errorf("got %+v, want bounced", d)
+	}
+	if prefs, err := db.GetPreferences(ctx, tasks.ChannelSMS, bounced); err != nil || prefs.Suppressed != "twilio 30005" {
+		t.Errorf("got preferences %+v, %v, want %s suppressed", prefs, err, bounced)
+	}
+
+	for recipient, want := range map[string]string{
+		optedOut:       tasks.StatusSkipped,
+		rejected:       tasks.StatusBounced,
+		"+15550000005": tasks.StatusQueued,
+	} {
+		if d := status(ids[recipient]); d.Status != want || d.Recipient != recipient {
+			t.Errorf("got %+v, want the SMS to %s %s", d, recipient, want)
+		}
+	}
+
+	// A digested notification is followed to its digest.
+	if err := db.SetDigest(ctx, ids[delivered], []string{"digested"}); err != nil {
+		t.Fatalf("db.SetDigest failed: %v", err)
+	}
+	if d := status("digested"); d.ID != ids[delivered] || d.Status != tasks.StatusDelivered {
+		t.Errorf("got %+v, want the delivery of its digest %s", d, ids[delivered])
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/deliveries/unknown?token=t0k", "", 404},
+		{"GET", "/deliveries/" + ids[delivered], "", 401},
+		{"POST", "/deliveries/" + ids[delivered], `{"status": "failed"}`, 401},
+		{"POST", "/deliveries/" + ids[delivered] + "?token=t0k", `{"status": "queued"}`, 400},
+		{"POST", "/deliveries/unknown?token=t0k", `{"status": "delivered"}`, 404},
+		{"POST", "/deliveries/twilio?token=t0k", "MessageStatus=sent", 400},
+		{"POST", "/deliveries/twilio?token=t0k&id=" + ids[delivered], "MessageStatus=sending", 204},
+	} {
+		if code, body := do(tc.method, tc.path, "application/x-www-form-urlencoded", tc.body); code != tc.code {
+			t.Errorf("%s %s: got %d %s, want %d", tc.method, tc.path, code, body, tc.code)
+		}
+	}
+	req, _ := http.NewRequest("POST", srvAPI.URL+"/deliveries/"+ids[delivered], strings.NewReader(`{"status": "failed", "reason": "expired"}`))
+	req.Header.Set("Authorization", "Bearer t0k")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("callback with a bearer token failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("callback with a bearer token: got %d", resp.StatusCode)
+	}
+	if d := status(ids[delivered]); d.Status != tasks.StatusFailed || d.Reason != "expired" {
+		t.Errorf("got %+v, want failed", d)
+	}
+
+	// Without a token, statuses are served without their recipient, and
+	// callbacks are not.
+	noToken := httptest.NewServer(deliveriesAPI(log, inspector, []string{"default"}, ""))
+	defer noToken.Close()
+	for method, want := range map[string]int{"GET": http.StatusOK, "POST": http.StatusMethodNotAllowed} {
+		req, _ := http.NewRequest(method, noToken.URL+"/deliveries/"+ids[bounced], strings.NewReader(`{"status": "bounced"}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s without a token failed: %v", method, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s without a token: got %d, want %d", method, resp.StatusCode, want)
+		}
+		if method == "GET" && (strings.Contains(string(b), bounced) || !strings.Contains(string(b), tasks.StatusBounced)) {
+			t.Errorf("GET without a token: got %s, want the status without the recipient", b)
+		}
+	}
+}
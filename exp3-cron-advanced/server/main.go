@@ -1,45 +1,221 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 
+	"exp1/db"
+	"exp1/health"
 	"exp1/tasks"
 
 	"github.com/hibiken/asynq"
 	"github.com/lmittmann/tint"
+	"github.com/redis/go-redis/v9"
 )
 
-const redisAddr = "127.0.0.1:6379"
+const (
+	defaultRedisAddr  = "127.0.0.1:6379"
+	defaultHealthAddr = ":8082"
+)
+
+// Server states reported by the readiness check.
+const (
+	stateActive  = "active"  // processing tasks
+	stateQuiet   = "quiet"   // not processing new tasks after SIGTSTP
+	stateStopped = "stopped" // shutting down
+)
 
 func main() {
 	log := tasks.Logger(os.Stderr, os.Getenv("LOG_LEVEL"))
 
+	if err := run(log); err != nil {
+		log.Error("could not run server", tint.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run starts the server and blocks until SIGINT or SIGTERM is received.
+// SIGTSTP stops the server from processing new tasks, as asynq's Server.Run does.
+func run(log *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = defaultRedisAddr
+	}
+
+	healthCfg, err := health.ConfigFromEnv(defaultHealthAddr)
+	if err != nil {
+		return err
+	}
+	digestCfg, err := tasks.DigestConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	// Emails are sent through SMTP_ADDR, or only logged when it is not set.
+	var mailer tasks.Mailer = tasks.LogMailer{Log: log}
+	smtpCfg, ok, err := tasks.SMTPConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if ok {
+		if mailer, err = tasks.NewSMTPMailer(smtpCfg); err != nil {
+			return err
+		}
+	}
+
+	// Text messages and push notifications are sent through the providers
+	// configured in the environment, or only logged.
+	var smsSender tasks.SMSSender = tasks.LogSMSSender{Log: log}
+	smsCfg, ok, err := tasks.SMSConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if ok {
+		if smsSender, err = tasks.NewTwilioSender(smsCfg); err != nil {
+			return err
+		}
+	}
+	var pushSender tasks.PushSender = tasks.LogPushSender{Log: log}
+	pushCfg, ok, err := tasks.PushConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if ok {
+		if pushSender, err = tasks.NewPushSender(pushCfg); err != nil {
+			return err
+		}
+	}
+	// Email templates are read from EMAIL_TEMPLATES_DIR, or from Redis when it is not set.
+	templates := &tasks.EmailTemplates{DefaultLocale: os.Getenv("EMAIL_LOCALE")}
+	if dir := os.Getenv("EMAIL_TEMPLATES_DIR"); dir != "" {
+		templates.Store = tasks.DirTemplates{Dir: dir}
+	} else {
+		rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+		defer rdb.Close()
+		templates.Store = tasks.RedisTemplates{Client: rdb}
+	}
+
+	var redisStatus health.Status
+	var state atomic.Value
+	state.Store(stateStopped)
+
+	// Optionally specify multiple queues with different priority.
+	queues := map[string]int{
+		"critical": 6,
+		"default":  3,
+		"low":      1,
+	}
+	// The digests of the notifications are recorded for the deliveries API.
+	digester := tasks.NewDigester(log)
+	digester.Digested = func(digestID string, taskIDs []string) error {
+		return db.SetDigest(context.Background(), digestID, taskIDs)
+	}
 	srv := asynq.NewServer(
 		asynq.RedisClientOpt{Addr: redisAddr},
 		asynq.Config{
 			// Specify how many concurrent workers to use
 			Concurrency: 10,
-			// Optionally specify multiple queues with different priority.
-			Queues: map[string]int{
-				"critical": 6,
-				"default":  3,
-				"low":      1,
-			},
-			LogLevel: asynq.WarnLevel,
+			Queues:      queues,
+			LogLevel:    asynq.WarnLevel,
+			// asynq pings Redis on this interval and reports the result.
+			HealthCheckFunc:     redisStatus.Set,
+			HealthCheckInterval: healthCfg.RedisCheckInterval,
+			// Notifications enqueued with tasks.Digest are sent as digests.
+			GroupGracePeriod: digestCfg.GracePeriod,
+			GroupMaxDelay:    digestCfg.MaxDelay,
+			GroupMaxSize:     digestCfg.MaxSize,
+			GroupAggregator:  digester,
 		},
 	)
 
+	// Preferences are read from REDIS_ADDR by the db package.
+	defer db.Close()
+
+	// Notifications deferred by quiet hours are enqueued again with this client.
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+	defer client.Close()
+
 	// mux maps a type to a handler
 	mux := asynq.NewServeMux()
-	mux.Handle(tasks.TypeNotificationEmail, tasks.NewProcessNotificationEmail(log))
-	mux.HandleFunc(tasks.TypeNotificationSMS, tasks.HandleNotificationSMS)
-	mux.HandleFunc(tasks.TypeNotificationPush, tasks.HandleNotificationPush)
+	prefs := checkPreferences(log, client)
+	mux.Use(prefs)
+	handlers := map[string]asynq.Handler{
+		tasks.TypeNotificationEmail: tasks.NewProcessNotificationEmail(log, os.Getenv("EMAIL_SENDER"), mailer, templates),
+		tasks.TypeNotificationSMS:   tasks.NewProcessNotificationSMS(log, smsSender),
+		tasks.TypeNotificationPush:  tasks.NewProcessNotificationPush(log, pushSender),
+	}
+	multi := make(map[string]asynq.Handler, len(handlers))
+	for taskType, h := range handlers {
+		mux.Handle(taskType, h)
+		// The mux middleware only wraps the handlers it dispatches to.
+		multi[taskType] = prefs(h)
+	}
+	mux.Handle(tasks.TypeNotificationMulti, tasks.NewProcessNotificationMulti(log, multi))
+
+	checks := health.NewHandler(healthCfg.CheckTimeout)
+	checks.AddReadinessCheck("redis", redisStatus.Check)
+	checks.AddReadinessCheck("server", func(ctx context.Context) error {
+		if s := state.Load().(string); s != stateActive {
+			return fmt.Errorf("server is %s", s)
+		}
+		return nil
+	})
+	// The preferences API reads and changes the recipients' data, it is
+	// only served with a token.
+	if token := os.Getenv("PREFERENCES_API_TOKEN"); token != "" {
+		checks.Handle("/preferences/", preferencesAPI(token))
+	} else {
+		log.Warn("PREFERENCES_API_TOKEN is not set, not serving /preferences/")
+	}
+	// Delivery statuses are looked up in the queues of the server, and
+	// updated by the callbacks of the providers, only served with a token.
+	// Without it, the statuses are served without their recipient.
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr})
+	defer inspector.Close()
+	queueNames := make([]string, 0, len(queues))
+	for queue := range queues {
+		queueNames = append(queueNames, queue)
+	}
+	deliveryToken := os.Getenv("DELIVERY_WEBHOOK_TOKEN")
+	if deliveryToken == "" {
+		log.Warn("DELIVERY_WEBHOOK_TOKEN is not set, not serving the delivery status callbacks nor the recipients")
+	}
+	checks.Handle("/deliveries/", deliveriesAPI(log, inspector, queueNames, deliveryToken))
+	if err := checks.Start(ctx, healthCfg.Addr); err != nil {
+		return fmt.Errorf("could not start health endpoints: %v", err)
+	}
 
 	// Run server
-	log.Info("starting server", slog.String("addr", redisAddr))
-	if err := srv.Run(mux); err != nil {
-		log.Error("could not run server", tint.Err(err))
-		os.Exit(1)
+	log.Info("starting server", slog.String("addr", redisAddr), slog.String("health_addr", healthCfg.Addr))
+	if err := srv.Start(mux); err != nil {
+		return fmt.Errorf("srv.Start failed: %v", err)
 	}
+	state.Store(stateActive)
+
+	tstp := make(chan os.Signal, 1)
+	signal.Notify(tstp, syscall.SIGTSTP)
+	defer signal.Stop(tstp)
+
+	for ctx.Err() == nil {
+		select {
+		case <-tstp:
+			log.Info("stopping server from processing new tasks")
+			srv.Stop()
+			state.Store(stateQuiet)
+		case <-ctx.Done():
+		}
+	}
+
+	// Shutdown waits for in-flight handlers and cancels their context on timeout.
+	log.Info("shutting down server")
+	state.Store(stateStopped)
+	srv.Shutdown()
+	return nil
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRunStopsOnSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		t.Run(sig.String(), func(t *testing.T) {
+			s := miniredis.RunT(t)
+			t.Setenv("REDIS_ADDR", s.Addr())
+			t.Setenv("HEALTH_ADDR", "127.0.0.1:0")
+
+			done := make(chan error, 1)
+			go func() { done <- run(tasks.Logger(io.Discard, "")) }()
+
+			// The server heartbeat is written after the signal handler is installed.
+			waitFor(t, func() bool { return s.Exists("asynq:servers") })
+			if err := syscall.Kill(syscall.Getpid(), sig); err != nil {
+				t.Fatalf("syscall.Kill failed: %v", err)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("run failed: %v", err)
+				}
+			case <-time.After(15 * time.Second):
+				t.Fatal("run did not return after signal")
+			}
+
+			if s.Exists("asynq:servers") {
+				t.Error("server state was not cleared on shutdown")
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
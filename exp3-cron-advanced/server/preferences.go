@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+	"github.com/lmittmann/tint"
+)
+
+// checkPreferences returns a middleware that checks the preferences of the
+// recipient of notification tasks before they are sent. Sends to recipients
+// who opted out or are suppressed are skipped and recorded, sends during
+// their quiet hours are enqueued again to be processed when they end.
+// Recipients rejected by the provider are suppressed.
+//
+// The handlers dispatched to by notification:multi are wrapped too, skipped
+// sends fall back to the next channel, and deferred ones defer the whole
+// notification:multi task (see tasks.DeferredError).
+func checkPreferences(log *slog.Logger, client *asynq.Client) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			channel := tasks.Channel(task.Type())
+			if channel == "" {
+				err := next.ProcessTask(ctx, task)
+				var deferred *tasks.DeferredError
+				if !errors.As(err, &deferred) {
+					return err
+				}
+				taskID, _ := asynq.GetTaskID(ctx)
+				if err := deferTask(ctx, client, task, taskID, deferred.Until); err != nil {
+					return err
+				}
+				log.Info("notification deferred after quiet hours", slog.String("id", taskID), slog.String("task_type", task.Type()),
+					slog.Time("until", deferred.Until))
+				return nil
+			}
+			var n struct{ Recipient string }
+			if err := json.Unmarshal(task.Payload(), &n); err != nil || n.Recipient == "" {
+				return next.ProcessTask(ctx, task) // the handler reports it
+			}
+
+			prefs, err := db.GetPreferences(ctx, channel, n.Recipient)
+			if err != nil {
+				return fmt.Errorf("could not check preferences of %s: %v", n.Recipient, err)
+			}
+			taskID, _ := asynq.GetTaskID(ctx)
+			now := time.Now()
+			skip, until := prefs.Check(now)
+			if skip != "" {
+				log.Info("notification skipped", slog.String("id", taskID), slog.String("channel", channel),
+					slog.String("recipient", n.Recipient), slog.String("reason", skip))
+				s := db.Skip{Channel: channel, Recipient: n.Recipient, Reason: skip, TaskID: taskID, At: now.UTC()}
+				if err := db.RecordSkip(ctx, s); err != nil {
+					return fmt.Errorf("could not record skipped notification: %v", err)
+				}
+				tasks.ReportSkipped(ctx, skip)
+				// Notifications dispatched to by notification:multi have no
+				// ResultWriter, nor a delivery status of their own.
+				if task.ResultWriter() != nil {
+					status := db.DeliveryStatus{Status: tasks.StatusSkipped, Reason: skip, At: now.UTC()}
+					if err := db.SetDeliveryStatus(ctx, taskID, status); err != nil {
+						return fmt.Errorf("could not record skipped notification: %v", err)
+					}
+				}
+				return nil
+			}
+			if !until.IsZero() {
+				if tasks.ReportDeferred(ctx, until) {
+					return nil // deferred with its notification:multi task
+				}
+				if err := deferTask(ctx, client, task, taskID, until); err != nil {
+					return err
+				}
+				log.Info("notification deferred after quiet hours", slog.String("id", taskID), slog.String("channel", channel),
+					slog.String("recipient", n.Recipient), slog.Time("until", until))
+				return nil
+			}
+
+			err = next.ProcessTask(ctx, task)
+			if errors.Is(err, tasks.ErrBounced) {
+				// The handler may have failed because ctx is done, suppress anyway.
+				suppressCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+				defer cancel()
+				if suppressErr := db.Suppress(suppressCtx, channel, n.Recipient, err.Error(), now); suppressErr != nil {
+					log.Error("could not suppress recipient", slog.String("recipient", n.Recipient), tint.Err(suppressErr))
+				} else {
+					log.Warn("recipient suppressed", slog.String("channel", channel), slog.String("recipient", n.Recipient), tint.Err(err))
+				}
+				if task.ResultWriter() != nil {
+					status := db.DeliveryStatus{Status: tasks.StatusBounced, Reason: err.Error(), At: now.UTC()}
+					if statusErr := db.SetDeliveryStatus(suppressCtx, taskID, status); statusErr != nil {
+						log.Error("could not record bounce", slog.String("id", taskID), tint.Err(statusErr))
+					}
+				}
+			}
+			return err
+		})
+	}
+}
+
+// deferTask enqueues a copy of task, in the same queue and with the same
+// retries, to be processed at until. Its ID is derived from the ID of task,
+// so that deferring it again on retry is a no-op, and that the deliveries
+// API finds it.
+func deferTask(ctx context.Context, client *asynq.Client, task *asynq.Task, taskID string, until time.Time) error {
+	opts := []asynq.Option{asynq.ProcessAt(until), asynq.Retention(tasks.ResultRetention)}
+	if queue, ok := asynq.GetQueueName(ctx); ok {
+		opts = append(opts, asynq.Queue(queue))
+	}
+	if maxRetry, ok := asynq.GetMaxRetry(ctx); ok {
+		opts = append(opts, asynq.MaxRetry(maxRetry))
+	}
+	if taskID != "" {
+		opts = append(opts, asynq.TaskID("deferred:"+taskID))
+	}
+	_, err := client.EnqueueContext(ctx, asynq.NewTask(task.Type(), task.Payload()), opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("could not defer notification: %v", err)
+	}
+	return nil
+}
+
+// Endpoints of preferencesAPI, <channel> is email, sms or push:
+// GET    /preferences/skips?n=100                     -> last skipped sends
+// GET    /preferences/<channel>/<recipient>           -> preferences
+// PUT    /preferences/<channel>/<recipient>           -> set opt_out and quiet_hours
+// DELETE /preferences/<channel>/<recipient>           -> remove all preferences
+// PUT    /preferences/<channel>/<recipient>/suppressed -> suppress, with a reason
+// DELETE /preferences/<channel>/<recipient>/suppressed -> lift the suppression
+// Every endpoint requires the token (see withToken).
+
+const defaultSkips = 100
+
+func preferencesAPI(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /preferences/skips", func(w http.ResponseWriter, r *http.Request) {
+		n := defaultSkips
+		if value := r.URL.Query().Get("n"); value != "" {
+			var err error
+			if n, err = strconv.Atoi(value); err != nil || n < 1 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid n %q", value))
+				return
+			}
+		}
+		skips, err := db.GetSkips(r.Context(), n)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, skips)
+	})
+	mux.HandleFunc("GET /preferences/{channel}/{recipient}", withRecipient(func(w http.ResponseWriter, r *http.Request, channel, recipient string) {
+		prefs, err := db.GetPreferences(r.Context(), channel, recipient)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, prefs)
+	}))
+	mux.HandleFunc("PUT /preferences/{channel}/{recipient}", withRecipient(func(w http.ResponseWriter, r *http.Request, channel, recipient string) {
+		var body struct {
+			OptOut     bool           `json:"opt_out"`
+			QuietHours *db.QuietHours `json:"quiet_hours"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+			return
+		}
+		if body.QuietHours != nil {
+			if err := body.QuietHours.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err := db.SetPreferences(r.Context(), channel, recipient, body.OptOut, body.QuietHours); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /preferences/{channel}/{recipient}", withRecipient(func(w http.ResponseWriter, r *http.Request, channel, recipient string) {
+		if err := db.DeletePreferences(r.Context(), channel, recipient); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("PUT /preferences/{channel}/{recipient}/suppressed", withRecipient(func(w http.ResponseWriter, r *http.Request, channel, recipient string) {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Reason == "" {
+			writeError(w, http.StatusBadRequest, errors.New("invalid body, want a reason"))
+			return
+		}
+		if err := db.Suppress(r.Context(), channel, recipient, body.Reason, time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE /preferences/{channel}/{recipient}/suppressed", withRecipient(func(w http.ResponseWriter, r *http.Request, channel, recipient string) {
+		if err := db.Unsuppress(r.Context(), channel, recipient); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return withToken(token, mux.ServeHTTP)
+}
+
+// withRecipient checks the channel and recipient of the request path, and
+// normalizes the recipient like the task builders do.
+func withRecipient(h func(w http.ResponseWriter, r *http.Request, channel, recipient string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		channel, recipient := r.PathValue("channel"), r.PathValue("recipient")
+		var err error
+		switch channel {
+		case tasks.ChannelEmail:
+			recipient, err = tasks.NormalizeEmail(recipient)
+		case tasks.ChannelSMS:
+			recipient, err = tasks.NormalizePhone(recipient)
+		case tasks.ChannelPush:
+			recipient, err = tasks.NormalizePushToken(recipient)
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown channel %q", channel))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		h(w, r, channel, recipient)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestCheckPreferences(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	redisOpt := asynq.RedisClientOpt{Addr: s.Addr()}
+	ctx := context.Background()
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+
+	const (
+		optedOut = "+15550000001"
+		quiet    = "+15550000002"
+		bouncing = "+15550000003"
+		welcome  = "+15550000004"
+	)
+	if err := db.SetOptOut(ctx, tasks.ChannelSMS, optedOut, true); err != nil {
+		t.Fatalf("db.SetOptOut failed: %v", err)
+	}
+	// Quiet hours from an hour ago to an hour from now.
+	now := time.Now().UTC()
+	q := &db.QuietHours{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}
+	if err := db.SetQuietHours(ctx, tasks.ChannelSMS, quiet, q); err != nil {
+		t.Fatalf("db.SetQuietHours failed: %v", err)
+	}
+
+	var mu sync.Mutex
+	var sent []string
+	mux := asynq.NewServeMux()
+	mux.Use(checkPreferences(tasks.Logger(io.Discard, ""), client))
+	mux.HandleFunc(tasks.TypeNotificationSMS, func(ctx context.Context, task *asynq.Task) error {
+		if strings.Contains(string(task.Payload()), bouncing) {
+			return fmt.Errorf("could not send SMS: %w", &tasks.ProviderError{Provider: "twilio", StatusCode: 400, Code: "21211"})
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, string(task.Payload()))
+		return nil
+	})
+	srv := asynq.NewServer(redisOpt, asynq.Config{Queues: map[string]int{"default": 1}, LogLevel: asynq.FatalLevel})
+	if err := srv.Start(mux); err != nil {
+		t.Fatalf("srv.Start failed: %v", err)
+	}
+	defer srv.Shutdown()
+
+	for _, recipient := range []string{optedOut, quiet, bouncing, welcome} {
+		task, err := tasks.BuildNotificationSMS(recipient, "Hello")
+		if err != nil {
+			t.Fatalf("tasks.BuildNotificationSMS failed: %v", err)
+		}
+		if _, err := client.Enqueue(task, asynq.TaskID(recipient), asynq.MaxRetry(3)); err != nil {
+			t.Fatalf("client.Enqueue failed: %v", err)
+		}
+	}
+
+	waitFor(t, func() bool {
+		prefs, err := db.GetPreferences(ctx, tasks.ChannelSMS, bouncing)
+		return err == nil && prefs.Suppressed != ""
+	})
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 1
+	})
+	if !strings.Contains(sent[0], welcome) {
+		t.Errorf("got sent %q, want only the SMS to %s", sent, welcome)
+	}
+
+	var skips []db.Skip
+	waitFor(t, func() bool {
+		var err error
+		skips, err = db.GetSkips(ctx, 10)
+		return err == nil && len(skips) == 1
+	})
+	if skips[0].Recipient != optedOut || skips[0].Reason != db.SkipOptOut || skips[0].TaskID != optedOut {
+		t.Errorf("got skip %+v, want %s opted out", skips[0], optedOut)
+	}
+
+	// The quiet SMS waits for the end of the quiet hours, with its retries.
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+	var info *asynq.TaskInfo
+	waitFor(t, func() bool {
+		var err error
+		info, err = inspector.GetTaskInfo("default", "deferred:"+quiet)
+		return err == nil
+	})
+	if info.State != asynq.TaskStateScheduled || info.MaxRetry != 3 || info.NextProcessAt.Before(now.Add(59*time.Minute)) {
+		t.Errorf("got deferred task %+v, want scheduled in an hour", info)
+	}
+}
+
+func TestPreferencesAPI(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	srv := httptest.NewServer(preferencesAPI("secret"))
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("http.NewRequest failed: %v", err)
+		}
+		if !strings.Contains(path, "token=") {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+		want               string // response body, if any
+	}{
+		{"PUT", "/preferences/email/Bob%20%3Cbob@Example.com%3E", `{"opt_out": true, "quiet_hours": {"start": "22:00", "end": "07:00", "timezone": "Europe/Paris"}}`, 204, ""},
+		{"GET", "/preferences/email/bob@example.com", "", 200, `{"opt_out":true,"quiet_hours":{"start":"22:00","end":"07:00","timezone":"Europe/Paris"}}`},
+		{"PUT", "/preferences/email/bob@example.com/suppressed", `{"reason": "complaint"}`, 204, ""},
+		{"DELETE", "/preferences/email/bob@example.com/suppressed", "", 204, ""},
+		{"PUT", "/preferences/email/bob@example.com", `{"opt_out": false}`, 204, ""},
+		{"GET", "/preferences/email/bob@example.com", "", 200, `{"opt_out":false}`},
+		{"PUT", "/preferences/sms/+15552223333", `{"quiet_hours": {"start": "25:00", "end": "07:00"}}`, 400, ""},
+		{"PUT", "/preferences/sms/+15552223333/suppressed", `{}`, 400, ""},
+		{"GET", "/preferences/sms/0123456789", "", 400, ""},
+		{"GET", "/preferences/fax/+15552223333", "", 404, ""},
+		{"DELETE", "/preferences/email/bob@example.com", "", 204, ""},
+		{"GET", "/preferences/skips?n=5", "", 200, `[]`},
+		{"GET", "/preferences/skips?n=0", "", 400, ""},
+		{"GET", "/preferences/skips?token=wrong", "", 401, ""},
+		{"PUT", "/preferences/email/bob@example.com?token=", `{"opt_out": true}`, 401, ""},
+		{"GET", "/preferences/email/bob@example.com?token=secret", "", 200, `{"opt_out":false}`},
+	} {
+		code, body := do(tc.method, tc.path, tc.body)
+		if code != tc.code || (tc.want != "" && body != tc.want) {
+			t.Errorf("%s %s: got %d %s, want %d %s", tc.method, tc.path, code, body, tc.code, tc.want)
+		}
+	}
+}
+
+func TestNotificationMultiPreferences(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	redisOpt := asynq.RedisClientOpt{Addr: s.Addr()}
+	ctx := context.Background()
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+
+	// The push token opted out, the notification falls back to SMS.
+	const token = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	if err := db.SetOptOut(ctx, tasks.ChannelPush, token, true); err != nil {
+		t.Fatalf("db.SetOptOut failed: %v", err)
+	}
+	log := tasks.Logger(io.Discard, "")
+	prefs := checkPreferences(log, client)
+	mux := asynq.NewServeMux()
+	mux.Use(prefs)
+	mux.Handle(tasks.TypeNotificationMulti, tasks.NewProcessNotificationMulti(log, map[string]asynq.Handler{
+		tasks.TypeNotificationPush: prefs(tasks.NewProcessNotificationPush(log, tasks.LogPushSender{Log: log})),
+		tasks.TypeNotificationSMS:  prefs(tasks.NewProcessNotificationSMS(log, tasks.LogSMSSender{Log: log})),
+	}))
+	srv := asynq.NewServer(redisOpt, asynq.Config{Queues: map[string]int{"default": 1}, LogLevel: asynq.FatalLevel})
+	if err := srv.Start(mux); err != nil {
+		t.Fatalf("srv.Start failed: %v", err)
+	}
+	defer srv.Shutdown()
+
+	push, err := tasks.BuildNotificationPush(token, "Hello")
+	if err != nil {
+		t.Fatalf("tasks.BuildNotificationPush failed: %v", err)
+	}
+	sms, err := tasks.BuildNotificationSMS("+15552223333", "Hello")
+	if err != nil {
+		t.Fatalf("tasks.BuildNotificationSMS failed: %v", err)
+	}
+	task, err := tasks.BuildNotificationMulti(push, sms)
+	if err != nil {
+		t.Fatalf("tasks.BuildNotificationMulti failed: %v", err)
+	}
+	info, err := client.Enqueue(task)
+	if err != nil {
+		t.Fatalf("client.Enqueue failed: %v", err)
+	}
+
+	inspector := asynq.NewInspector(redisOpt)
+	defer inspector.Close()
+	waitFor(t, func() bool {
+		info, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		return err == nil && info.State == asynq.TaskStateCompleted
+	})
+	var result tasks.MultiResult
+	if err := json.Unmarshal(info.Result, &result); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if result.Channel != tasks.ChannelSMS || result.Recipient != "+15552223333" || len(result.Attempts) != 2 || result.Attempts[0].Skipped != db.SkipOptOut {
+		t.Errorf("got result %+v, want sent by SMS after the push was skipped", result)
+	}
+	if skips, err := db.GetSkips(ctx, 10); err != nil || len(skips) != 1 || skips[0].TaskID != info.ID {
+		t.Errorf("got skips %+v, %v, want the push of %s", skips, err, info.ID)
+	}
+
+	// During the quiet hours of the SMS, the whole notification is deferred
+	// rather than reported sent.
+	now := time.Now().UTC()
+	quiet := &db.QuietHours{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}
+	if err := db.SetQuietHours(ctx, tasks.ChannelSMS, "+15552223333", quiet); err != nil {
+		t.Fatalf("db.SetQuietHours failed: %v", err)
+	}
+	if info, err = client.Enqueue(task); err != nil {
+		t.Fatalf("client.Enqueue failed: %v", err)
+	}
+	waitFor(t, func() bool {
+		info, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		return err == nil && info.State == asynq.TaskStateCompleted
+	})
+	result = tasks.MultiResult{}
+	if err := json.Unmarshal(info.Result, &result); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if result.Status != tasks.StatusQueued || len(result.Attempts) != 2 || result.Attempts[1].DeferredUntil == nil {
+		t.Errorf("got result %+v, want queued after the SMS was deferred", result)
+	}
+	deferred, err := inspector.GetTaskInfo(info.Queue, "deferred:"+info.ID)
+	if err != nil {
+		t.Fatalf("inspector.GetTaskInfo of the deferred task failed: %v", err)
+	}
+	if deferred.Type != tasks.TypeNotificationMulti || deferred.State != asynq.TaskStateScheduled ||
+		!deferred.NextProcessAt.Equal(*result.Attempts[1].DeferredUntil) {
+		t.Errorf("got deferred task %s %s at %v, want the notification:multi task at the end of the quiet hours",
+			deferred.Type, deferred.State, deferred.NextProcessAt)
+	}
+}
@@ -0,0 +1,86 @@
+package tasks
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/lmittmann/tint"
+)
+
+// ResultRetention is how long notification tasks, and the Delivery written
+// as their result, are kept after they are processed.
+const ResultRetention = 24 * time.Hour
+
+// Delivery statuses of a notification.
+const (
+	StatusQueued    = "queued"    // waiting to be processed, or retried
+	StatusSent      = "sent"      // accepted by the provider
+	StatusDelivered = "delivered" // reported delivered by the provider
+	StatusBounced   = "bounced"   // the provider rejected the recipient
+	StatusFailed    = "failed"    // not sent, the task failed for good
+	StatusSkipped   = "skipped"   // not sent because of the preferences of the recipient
+)
+
+// Delivery is the delivery status of a notification. The handlers write it
+// as the result of the task when it is sent; later statuses come from the
+// callbacks of the providers.
+type Delivery struct {
+	Status    string    `json:"status"`
+	Channel   string    `json:"channel,omitempty"`
+	Recipient string    `json:"recipient,omitempty"`
+	Reason    string    `json:"reason,omitempty"` // error or skip reason
+	At        time.Time `json:"at"`               // when the status was set, or when a queued notification will be processed
+}
+
+// DeliveryOf returns the delivery status of a notification task as asynq
+// knows it: queued until it is processed, then the Delivery written by its
+// handler, or failed if it was archived. It returns false for tasks that
+// are not notifications.
+func DeliveryOf(info *asynq.TaskInfo) (Delivery, bool) {
+	var d Delivery
+	if channel := Channel(info.Type); channel != "" {
+		var n struct{ Recipient string }
+		json.Unmarshal(info.Payload, &n)
+		d.Channel, d.Recipient = channel, n.Recipient
+	} else if info.Type != TypeNotificationMulti {
+		return Delivery{}, false
+	}
+	switch info.State {
+	case asynq.TaskStateCompleted:
+		var result Delivery
+		if json.Unmarshal(info.Result, &result) == nil && result.Status != "" {
+			if result.Channel != "" {
+				d.Channel, d.Recipient = result.Channel, result.Recipient
+			}
+			d.Status, d.Reason, d.At = result.Status, result.Reason, result.At
+		} else {
+			// Skipped notifications have no result, their status is
+			// kept in Redis.
+			d.Status, d.At = StatusSent, info.CompletedAt
+		}
+	case asynq.TaskStateArchived:
+		d.Status, d.Reason, d.At = StatusFailed, info.LastErr, info.LastFailedAt
+	default:
+		d.Status, d.Reason, d.At = StatusQueued, info.LastErr, info.NextProcessAt
+	}
+	return d, true
+}
+
+// writeResult writes v as the result of t, if the task was enqueued: tasks
+// built in tests, or dispatched to by notification:multi, have no
+// ResultWriter. Failures are only logged, the notification was sent.
+func writeResult(log *slog.Logger, t *asynq.Task, v any) {
+	w := t.ResultWriter()
+	if w == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	if err != nil {
+		log.Error("could not write result", slog.String("id", w.TaskID()), tint.Err(err))
+	}
+}
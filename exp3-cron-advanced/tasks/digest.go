@@ -0,0 +1,276 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/lmittmann/tint"
+)
+
+// Notifications enqueued with Digest are grouped by channel and recipient:
+// asynq keeps them in Redis until no notification was added to the group
+// for the grace period, the group is as old as the max delay or has max
+// size notifications, and passes them to the Digester, which combines them
+// into one notification of the same type.
+
+// digestGroupPrefix starts the group names of digests, digest:<channel>:<recipient>.
+const digestGroupPrefix = "digest:"
+
+// digestIDField is the payload field of the task ID of a notification
+// enqueued with Digest: asynq passes only the type and payload of the
+// grouped tasks to the Digester, which records the digest they are sent in.
+const digestIDField = "DigestedID"
+
+// Digest returns the task of the notification of task collected with the
+// other notifications to the same recipient on the same channel, to be sent
+// as one digest. It has the options of the notifications built by this
+// package and a task ID of its own, that GET /deliveries/<id> follows to the
+// digest. Emails rendered from a template and notification:multi tasks
+// cannot be digested.
+//
+//	task, err = tasks.Digest(task)
+//	...
+//	info, err := client.Enqueue(task)
+func Digest(task *asynq.Task) (*asynq.Task, error) {
+	group, err := DigestGroup(task)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(task.Payload(), &fields); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+	id := uuid.NewString()
+	if fields[digestIDField], err = json.Marshal(id); err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	opts := append(notificationOptions(task.Type()), group, asynq.TaskID(id))
+	return asynq.NewTask(task.Type(), payload, opts...), nil
+}
+
+// DigestGroup returns the group option of the notification of task, like
+// Digest, but without a task ID: it is for tasks enqueued more than once,
+// such as periodic tasks, whose notifications are not followed to their
+// digest.
+func DigestGroup(task *asynq.Task) (asynq.Option, error) {
+	channel := Channel(task.Type())
+	if channel == "" {
+		return nil, fmt.Errorf("%s cannot be digested", task.Type())
+	}
+	var n struct {
+		Recipient string
+		Template  string
+	}
+	if err := json.Unmarshal(task.Payload(), &n); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+	if n.Template != "" {
+		return nil, fmt.Errorf("emails rendered from a template cannot be digested")
+	}
+	return asynq.Group(digestGroupPrefix + channel + ":" + n.Recipient), nil
+}
+
+// DigestConfig configures the aggregation of digests by the server.
+type DigestConfig struct {
+	GracePeriod time.Duration // at least a second, default 1m
+	MaxDelay    time.Duration // 0 for no limit
+	MaxSize     int           // 0 for no limit
+}
+
+const (
+	defaultDigestGracePeriod = time.Minute
+	defaultDigestMaxSize     = 50
+)
+
+// DigestConfigFromEnv reads the digest configuration: DIGEST_GRACE_PERIOD
+// (default 1m), DIGEST_MAX_DELAY (default none) and DIGEST_MAX_SIZE
+// (default 50, 0 for none).
+func DigestConfigFromEnv() (DigestConfig, error) {
+	cfg := DigestConfig{GracePeriod: defaultDigestGracePeriod, MaxSize: defaultDigestMaxSize}
+	for name, d := range map[string]*time.Duration{
+		"DIGEST_GRACE_PERIOD": &cfg.GracePeriod,
+		"DIGEST_MAX_DELAY":    &cfg.MaxDelay,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return DigestConfig{}, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		*d = v
+	}
+	if value := os.Getenv("DIGEST_MAX_SIZE"); value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return DigestConfig{}, fmt.Errorf("invalid DIGEST_MAX_SIZE %q", value)
+		}
+		cfg.MaxSize = v
+	}
+	if cfg.GracePeriod < time.Second {
+		return DigestConfig{}, fmt.Errorf("DIGEST_GRACE_PERIOD must be at least 1s, got %v", cfg.GracePeriod)
+	}
+	if cfg.MaxDelay < 0 {
+		return DigestConfig{}, fmt.Errorf("invalid DIGEST_MAX_DELAY %v", cfg.MaxDelay)
+	}
+	return cfg, nil
+}
+
+// Digester is the asynq.GroupAggregator of digests.
+type Digester struct {
+	Log *slog.Logger
+	// Digested, if set, records the task IDs of the notifications enqueued
+	// with Digest that are sent in the digest task digestID, before it is
+	// enqueued.
+	Digested func(digestID string, taskIDs []string) error
+}
+
+func NewDigester(log *slog.Logger) *Digester {
+	return &Digester{Log: log}
+}
+
+// Aggregate combines the notifications of a group into one of the same
+// type: the bodies are joined, in the order asynq passes them, which is the
+// order they were enqueued in to the second. Notifications that cannot be
+// decoded are dropped. The digest has the options of the notifications,
+// and a new task ID.
+func (d *Digester) Aggregate(group string, grouped []*asynq.Task) *asynq.Task {
+	taskType := grouped[0].Type()
+	var payloads [][]byte
+	var taskIDs []string
+	for _, t := range grouped {
+		if t.Type() != taskType {
+			d.Log.Error("dropped from digest", slog.String("group", group), slog.String("type", t.Type()),
+				slog.String("reason", "not a "+taskType))
+			continue
+		}
+		payloads = append(payloads, t.Payload())
+		var n map[string]any
+		if json.Unmarshal(t.Payload(), &n) == nil {
+			if id, ok := n[digestIDField].(string); ok && id != "" {
+				taskIDs = append(taskIDs, id)
+			}
+		}
+	}
+
+	id := uuid.NewString()
+	if d.Digested != nil && len(taskIDs) > 0 {
+		if err := d.Digested(id, taskIDs); err != nil {
+			d.Log.Error("could not record digest", slog.String("group", group), slog.String("id", id), tint.Err(err))
+		}
+	}
+	opts := append(notificationOptions(taskType), asynq.TaskID(id))
+	return asynq.NewTask(taskType, d.digest(group, taskType, payloads), opts...)
+}
+
+// digest returns the payload of the digest of payloads, nil if they cannot
+// be digested.
+func (d *Digester) digest(group, taskType string, payloads [][]byte) []byte {
+	if len(payloads) == 1 {
+		return payloads[0]
+	}
+	var v any
+	var err error
+	switch taskType {
+	case TypeNotificationEmail:
+		v, err = d.digestEmails(group, payloads)
+	case TypeNotificationSMS:
+		var ns []NotificationSMS
+		if ns, err = decodeAll[NotificationSMS](d, group, payloads); err == nil {
+			bodies := make([]string, len(ns))
+			for i, n := range ns {
+				bodies[i] = n.Body
+			}
+			v = NotificationSMS{Recipient: ns[0].Recipient, Body: strings.Join(bodies, "\n")}
+		}
+	case TypeNotificationPush:
+		var ns []NotificationPush
+		if ns, err = decodeAll[NotificationPush](d, group, payloads); err == nil {
+			bodies := make([]string, len(ns))
+			for i, n := range ns {
+				bodies[i] = n.Body
+			}
+			v = NotificationPush{Recipient: ns[0].Recipient, Body: strings.Join(bodies, "\n")}
+		}
+	default:
+		err = fmt.Errorf("%s cannot be digested", taskType)
+	}
+	if err != nil {
+		// The handler fails the task without retries.
+		d.Log.Error("could not digest notifications", slog.String("group", group), tint.Err(err))
+		return nil
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		d.Log.Error("could not digest notifications", slog.String("group", group), tint.Err(err))
+		return nil
+	}
+	d.Log.Debug("digested notifications", slog.String("group", group), slog.Int("count", len(payloads)))
+	return payload
+}
+
+// decodeAll decodes the payloads that can be, and fails if none can.
+func decodeAll[T any](d *Digester, group string, payloads [][]byte) ([]T, error) {
+	var ns []T
+	for _, p := range payloads {
+		var n T
+		if err := json.Unmarshal(p, &n); err != nil {
+			d.Log.Error("dropped from digest", slog.String("group", group), tint.Err(err))
+			continue
+		}
+		ns = append(ns, n)
+	}
+	if len(ns) == 0 {
+		return nil, fmt.Errorf("no notification could be decoded")
+	}
+	return ns, nil
+}
+
+// digestEmails combines emails: the subject is the common one, or the
+// number of emails, and each email is a section of the text and HTML
+// bodies, under its subject.
+func (d *Digester) digestEmails(group string, payloads [][]byte) (NotificationEmail, error) {
+	ns, err := decodeAll[NotificationEmail](d, group, payloads)
+	if err != nil {
+		return NotificationEmail{}, err
+	}
+	digest := NotificationEmail{Recipient: ns[0].Recipient, Subject: ns[0].Subject}
+	hasHTML := false
+	for _, n := range ns {
+		if n.Subject != digest.Subject {
+			digest.Subject = fmt.Sprintf("%d notifications", len(ns))
+		}
+		hasHTML = hasHTML || n.HTML != ""
+	}
+	var text, body strings.Builder
+	for i, n := range ns {
+		if i > 0 {
+			text.WriteString("\n\n")
+			body.WriteString("\n<hr>\n")
+		}
+		fmt.Fprintf(&text, "%s\n\n%s", n.Subject, n.Body)
+		section := n.HTML
+		if section == "" {
+			section = "<p>" + strings.ReplaceAll(html.EscapeString(n.Body), "\n", "<br>") + "</p>"
+		}
+		fmt.Fprintf(&body, "<h2>%s</h2>\n%s", html.EscapeString(n.Subject), section)
+	}
+	digest.Body = text.String()
+	if hasHTML {
+		digest.HTML = body.String()
+	}
+	return digest, nil
+}
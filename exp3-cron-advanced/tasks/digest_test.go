@@ -0,0 +1,235 @@
+package tasks_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestDigest(t *testing.T) {
+	push, err := tasks.BuildNotificationPush(fcmToken, "Hello")
+	if err != nil {
+		t.Fatalf("BuildNotificationPush failed: %v", err)
+	}
+	opt, err := tasks.DigestGroup(push)
+	if err != nil {
+		t.Fatalf("DigestGroup failed: %v", err)
+	}
+	if opt.Type() != asynq.GroupOpt || opt.Value() != "digest:push:"+fcmToken {
+		t.Errorf("got option %v, want the group of the push token", opt)
+	}
+
+	// The digested task keeps the options of the push, and its ID is in its payload.
+	digested, err := tasks.Digest(push)
+	if err != nil {
+		t.Fatalf("Digest failed: %v", err)
+	}
+	s := miniredis.RunT(t)
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: s.Addr()})
+	defer client.Close()
+	info, err := client.Enqueue(digested)
+	if err != nil {
+		t.Fatalf("client.Enqueue failed: %v", err)
+	}
+	if info.Group != "digest:push:"+fcmToken || info.MaxRetry != 5 || info.Timeout != 20*time.Minute || info.Retention != tasks.ResultRetention {
+		t.Errorf("got task %+v, want the group and options of the push", info)
+	}
+	var n struct {
+		Recipient, Body, DigestedID string
+	}
+	if err := json.Unmarshal(digested.Payload(), &n); err != nil || n.Recipient != fcmToken || n.Body != "Hello" || n.DigestedID != info.ID {
+		t.Errorf("got payload %s, want the push and the task ID %s", digested.Payload(), info.ID)
+	}
+
+	templated, err := tasks.BuildNotificationEmailTemplate("bob@example.com", "en", "welcome", nil)
+	if err != nil {
+		t.Fatalf("BuildNotificationEmailTemplate failed: %v", err)
+	}
+	multi, err := tasks.BuildNotificationMulti(push)
+	if err != nil {
+		t.Fatalf("BuildNotificationMulti failed: %v", err)
+	}
+	for _, task := range []*asynq.Task{templated, multi} {
+		if _, err := tasks.Digest(task); err == nil {
+			t.Errorf("Digest of %s: got no error", task.Payload())
+		}
+	}
+}
+
+func TestDigesterAggregate(t *testing.T) {
+	d := tasks.NewDigester(tasks.Logger(io.Discard, ""))
+	build := func(task *asynq.Task, err error) *asynq.Task {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("build failed: %v", err)
+		}
+		return task
+	}
+
+	// Pushes are joined, undecodable ones are dropped.
+	task := d.Aggregate("digest:push:"+fcmToken, []*asynq.Task{
+		build(tasks.BuildNotificationPush(fcmToken, "one")),
+		asynq.NewTask(tasks.TypeNotificationPush, []byte("{")),
+		build(tasks.BuildNotificationPush(fcmToken, "two")),
+	})
+	var push tasks.NotificationPush
+	if err := json.Unmarshal(task.Payload(), &push); err != nil || task.Type() != tasks.TypeNotificationPush {
+		t.Fatalf("got %s %s, want a push", task.Type(), task.Payload())
+	}
+	if push.Recipient != fcmToken || push.Body != "one\ntwo" {
+		t.Errorf("got push %+v", push)
+	}
+
+	// Emails are sections under their subject.
+	task = d.Aggregate("digest:email:bob@example.com", []*asynq.Task{
+		build(tasks.BuildNotificationEmail("bob@example.com", "Order <1>", "Shipped")),
+		build(tasks.BuildNotificationEmailHTML("bob@example.com", "Order 2", "Delivered", "<p><b>Delivered</b></p>")),
+	})
+	var email tasks.NotificationEmail
+	if err := json.Unmarshal(task.Payload(), &email); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	want := tasks.NotificationEmail{
+		Recipient: "bob@example.com",
+		Subject:   "2 notifications",
+		Body:      "Order <1>\n\nShipped\n\nOrder 2\n\nDelivered",
+		HTML:      "<h2>Order &lt;1&gt;</h2>\n<p>Shipped</p>\n<hr>\n<h2>Order 2</h2>\n<p><b>Delivered</b></p>",
+	}
+	if email.Recipient != want.Recipient || email.Subject != want.Subject || email.Body != want.Body || email.HTML != want.HTML {
+		t.Errorf("got email %+v, want %+v", email, want)
+	}
+
+	// Emails with the same subject keep it, and stay text only.
+	task = d.Aggregate("digest:email:bob@example.com", []*asynq.Task{
+		build(tasks.BuildNotificationEmail("bob@example.com", "News", "a")),
+		build(tasks.BuildNotificationEmail("bob@example.com", "News", "b")),
+	})
+	email = tasks.NotificationEmail{}
+	json.Unmarshal(task.Payload(), &email)
+	if email.Subject != "News" || email.HTML != "" {
+		t.Errorf("got email %+v, want subject News and no HTML", email)
+	}
+}
+
+func TestDigestConfigFromEnv(t *testing.T) {
+	cfg, err := tasks.DigestConfigFromEnv()
+	if err != nil {
+		t.Fatalf("DigestConfigFromEnv failed: %v", err)
+	}
+	if cfg != (tasks.DigestConfig{GracePeriod: time.Minute, MaxSize: 50}) {
+		t.Errorf("got default config %+v", cfg)
+	}
+	for name, value := range map[string]string{
+		"DIGEST_GRACE_PERIOD": "500ms",
+		"DIGEST_MAX_DELAY":    "soon",
+		"DIGEST_MAX_SIZE":     "-1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := tasks.DigestConfigFromEnv(); err == nil {
+				t.Errorf("%s=%s: got no error", name, value)
+			}
+		})
+	}
+}
+
+func TestDigestServer(t *testing.T) {
+	s := miniredis.RunT(t)
+	redisOpt := asynq.RedisClientOpt{Addr: s.Addr()}
+	log := tasks.Logger(io.Discard, "")
+
+	var mu sync.Mutex
+	var bodies []string
+	digests := make(map[string]string) // task ID -> digest ID
+	digester := tasks.NewDigester(log)
+	digester.Digested = func(digestID string, taskIDs []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, id := range taskIDs {
+			digests[id] = digestID
+		}
+		return nil
+	}
+	mux := asynq.NewServeMux()
+	mux.HandleFunc(tasks.TypeNotificationSMS, func(ctx context.Context, task *asynq.Task) error {
+		var n tasks.NotificationSMS
+		json.Unmarshal(task.Payload(), &n)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, n.Recipient+": "+n.Body)
+		return nil
+	})
+	srv := asynq.NewServer(redisOpt, asynq.Config{
+		Queues:           map[string]int{"default": 1},
+		LogLevel:         asynq.FatalLevel,
+		GroupGracePeriod: time.Second,
+		GroupAggregator:  digester,
+	})
+	if err := srv.Start(mux); err != nil {
+		t.Fatalf("srv.Start failed: %v", err)
+	}
+	defer srv.Shutdown()
+
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+	var ids []string
+	for _, n := range []struct{ recipient, body string }{
+		{"+15550000001", "a"}, {"+15550000002", "b"}, {"+15550000001", "a"},
+	} {
+		task, err := tasks.BuildNotificationSMS(n.recipient, n.body)
+		if err != nil {
+			t.Fatalf("BuildNotificationSMS failed: %v", err)
+		}
+		if task, err = tasks.Digest(task); err != nil {
+			t.Fatalf("Digest failed: %v", err)
+		}
+		info, err := client.Enqueue(task)
+		if err != nil {
+			t.Fatalf("client.Enqueue failed: %v", err)
+		}
+		ids = append(ids, info.ID)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		n := len(bodies)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got digests %q, want 2", bodies)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(bodies)
+	if want := []string{"+15550000001: a\na", "+15550000002: b"}; !slices.Equal(bodies, want) {
+		t.Errorf("got digests %q, want %q", bodies, want)
+	}
+
+	// The notifications of a recipient are sent by the same digest, which is
+	// kept with their options.
+	if len(digests) != 3 || digests[ids[0]] == "" || digests[ids[0]] != digests[ids[2]] || digests[ids[0]] == digests[ids[1]] {
+		t.Fatalf("got digests %v of tasks %v", digests, ids)
+	}
+	info, err := asynq.NewInspector(redisOpt).GetTaskInfo("default", digests[ids[0]])
+	if err != nil {
+		t.Fatalf("inspector.GetTaskInfo failed: %v", err)
+	}
+	if info.Retention != tasks.ResultRetention {
+		t.Errorf("got digest %+v, want the retention of notifications", info)
+	}
+}
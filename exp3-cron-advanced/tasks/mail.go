@@ -0,0 +1,304 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// DefaultSender is the sender of emails when EMAIL_SENDER is not set.
+const DefaultSender = "experiments@asynq"
+
+// Email is a message for a Mailer. HTML is optional: with it, the message
+// has both a text and an HTML alternative.
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+
+	// Optional: task ID of the notification, sent in the X-Notification-Id
+	// header for the delivery callbacks of the provider.
+	ID string
+}
+
+// Mailer sends emails. Errors wrapping asynq.SkipRetry will fail the same
+// way if retried; other errors are worth retrying.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// LogMailer logs emails instead of sending them, for running without an SMTP server.
+type LogMailer struct {
+	Log *slog.Logger
+}
+
+func (m LogMailer) Send(ctx context.Context, email Email) error {
+	m.Log.Info("📨 Sending Email", slog.String("sender", email.From), slog.String("recipient", email.To),
+		slog.String("subject", email.Subject), slog.String("body", email.Text))
+	return nil
+}
+
+// SMTPConfig configures an SMTPMailer.
+type SMTPConfig struct {
+	Addr string // host:port of the SMTP server
+
+	// Optional: PLAIN auth is used when Username is set. net/smtp only sends
+	// the credentials over TLS, or to localhost.
+	Username string
+	Password string
+
+	// Optional: the connection is upgraded with STARTTLS when the server
+	// supports it, and sending fails if it does not, unless NoStartTLS
+	// allows plain text (local relays only).
+	NoStartTLS bool
+	TLSConfig  *tls.Config // default verifies the server name of Addr
+
+	// Optional: timeout of the connection when the context has no deadline.
+	Timeout time.Duration
+}
+
+const defaultSMTPTimeout = 30 * time.Second
+
+// SMTPConfigFromEnv reads the SMTP configuration: SMTP_ADDR, SMTP_USERNAME,
+// SMTP_PASSWORD and SMTP_STARTTLS (default true). It returns ok false if
+// SMTP_ADDR is not set.
+func SMTPConfigFromEnv() (cfg SMTPConfig, ok bool, err error) {
+	cfg.Addr = os.Getenv("SMTP_ADDR")
+	if cfg.Addr == "" {
+		return cfg, false, nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		return cfg, false, fmt.Errorf("invalid SMTP_ADDR: %v", err)
+	}
+	cfg.Username = os.Getenv("SMTP_USERNAME")
+	cfg.Password = os.Getenv("SMTP_PASSWORD")
+	if value := os.Getenv("SMTP_STARTTLS"); value != "" {
+		startTLS, err := strconv.ParseBool(value)
+		if err != nil {
+			return cfg, false, fmt.Errorf("invalid SMTP_STARTTLS: %v", err)
+		}
+		cfg.NoStartTLS = !startTLS
+	}
+	return cfg, true, nil
+}
+
+// SMTPMailer sends emails through an SMTP server, one connection per email.
+type SMTPMailer struct {
+	cfg  SMTPConfig
+	host string
+}
+
+func NewSMTPMailer(cfg SMTPConfig) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address: %v", err)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultSMTPTimeout
+	}
+	return &SMTPMailer{cfg: cfg, host: host}, nil
+}
+
+// Send sends the email. Permanent SMTP failures (5xx replies) wrap
+// asynq.SkipRetry; transient ones (4xx) and network errors do not.
+// Recipients rejected as unknown wrap ErrBounced too.
+func (m *SMTPMailer) Send(ctx context.Context, email Email) error {
+	msg, err := buildMessage(email)
+	if err != nil {
+		return fmt.Errorf("could not build message: %v: %w", err, asynq.SkipRetry)
+	}
+	if err := m.send(ctx, email.From, email.To, msg); err != nil {
+		return classifySMTPError(err)
+	}
+	return nil
+}
+
+func (m *SMTPMailer) send(ctx context.Context, from, to string, msg []byte) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(m.cfg.Timeout)
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", m.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("dial failed: %v", err)
+	}
+	// net/smtp has no context: the deadline bounds the whole conversation,
+	// and cancelling the context closes the connection.
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return fmt.Errorf("conn.SetDeadline failed: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp.NewClient failed: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := m.cfg.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: m.host}
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("c.StartTLS failed: %w", err)
+		}
+	} else if !m.cfg.NoStartTLS {
+		return fmt.Errorf("server %s does not support STARTTLS", m.cfg.Addr)
+	}
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.host)); err != nil {
+			return fmt.Errorf("c.Auth failed: %w", err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("c.Mail failed: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		// 550, 551 and 553 reject the mailbox itself.
+		var reply *textproto.Error
+		if errors.As(err, &reply) && (reply.Code == 550 || reply.Code == 551 || reply.Code == 553) {
+			return fmt.Errorf("c.Rcpt failed: %w: %w", err, ErrBounced)
+		}
+		return fmt.Errorf("c.Rcpt failed: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("c.Data failed: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("message write failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message close failed: %w", err)
+	}
+	// The message was accepted: a failed QUIT must not have it sent again.
+	c.Quit()
+	return nil
+}
+
+// classifySMTPError marks permanent SMTP failures, the 5xx replies, as not
+// worth retrying.
+func classifySMTPError(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// buildMessage returns the MIME message of the email: text only, or a
+// multipart/alternative of text and HTML.
+func buildMessage(email Email) ([]byte, error) {
+	from, err := mail.ParseAddress(email.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender: %v", err)
+	}
+	to, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %v", err)
+	}
+
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	header.Set("To", to.String())
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", messageID(from.Address))
+	if email.ID != "" {
+		header.Set("X-Notification-Id", email.ID)
+	}
+	header.Set("MIME-Version", "1.0")
+
+	if email.HTML == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buf, header)
+		if err := writeQuotedPrintable(&buf, email.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	writeHeader(&buf, header)
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// headerOrder is the order headers are written in, for readable messages.
+var headerOrder = []string{"From", "To", "Subject", "Date", "Message-Id", "X-Notification-Id", "Mime-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range headerOrder {
+		for _, value := range header[key] {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// messageID returns a unique Message-ID in the domain of the sender.
+func messageID(sender string) string {
+	domain := "localhost"
+	if at := strings.LastIndexByte(sender, '@'); at >= 0 {
+		domain = sender[at+1:]
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return "<" + hex.EncodeToString(b[:]) + "@" + domain + ">"
+}
@@ -0,0 +1,292 @@
+package tasks_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+)
+
+// fakeSMTP is an SMTP server good enough for net/smtp, that keeps the
+// messages it accepts.
+type fakeSMTP struct {
+	ln        net.Listener
+	tlsConfig *tls.Config // offers STARTTLS when set
+	rcptReply string      // reply to RCPT TO, 250 when empty
+
+	mu       sync.Mutex
+	auth     string // username and password of the last AUTH PLAIN
+	tls      bool   // whether the last message was sent over TLS
+	messages []string
+}
+
+func newFakeSMTP(t *testing.T, tlsConfig *tls.Config, rcptReply string) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	s := &fakeSMTP{ln: ln, tlsConfig: tlsConfig, rcptReply: rcptReply}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	secure := false
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			if s.tlsConfig != nil && !secure {
+				tp.PrintfLine("250-fake\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250-fake\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, tp, secure = tlsConn, textproto.NewConn(tlsConn), true
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			s.mu.Lock()
+			s.auth = strings.TrimPrefix(string(creds), "\x00")
+			s.mu.Unlock()
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			if s.rcptReply != "" {
+				tp.PrintfLine("%s", s.rcptReply)
+			} else {
+				tp.PrintfLine("250 ok")
+			}
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.tls = secure
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// selfSigned returns a server TLS config for 127.0.0.1, and a client one trusting it.
+func selfSigned(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+func TestSMTPMailer(t *testing.T) {
+	serverTLS, clientTLS := selfSigned(t)
+	s := newFakeSMTP(t, serverTLS, "")
+	mailer, err := tasks.NewSMTPMailer(tasks.SMTPConfig{
+		Addr:      s.ln.Addr().String(),
+		Username:  "alice",
+		Password:  "secret",
+		TLSConfig: clientTLS,
+	})
+	if err != nil {
+		t.Fatalf("NewSMTPMailer failed: %v", err)
+	}
+
+	task, err := tasks.BuildNotificationEmailHTML("bob@example.com", "Héllo", "Hi Bob", "<p>Hi <b>Bob</b></p>")
+	if err != nil {
+		t.Fatalf("BuildNotificationEmailHTML failed: %v", err)
+	}
+	h := tasks.NewProcessNotificationEmail(tasks.Logger(io.Discard, ""), "Experiments <noreply@example.com>", mailer, nil)
+	if err := h.ProcessTask(context.Background(), task); err != nil {
+		t.Fatalf("ProcessTask failed: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.tls || s.auth != "alice\x00secret" {
+		t.Errorf("got tls %v and auth %q, want STARTTLS and alice's credentials", s.tls, s.auth)
+	}
+	if len(s.messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(s.messages))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(s.messages[0]))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage failed: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if from := msg.Header.Get("From"); from != `"Experiments" <noreply@example.com>` || subject != "Héllo" {
+		t.Errorf("got From %q and Subject %q", from, subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q, want multipart/alternative", msg.Header.Get("Content-Type"))
+	}
+	var parts []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart() // decodes quoted-printable
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart failed: %v", err)
+		}
+		body, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+": "+string(body))
+	}
+	want := []string{"text/plain; charset=utf-8: Hi Bob", "text/html; charset=utf-8: <p>Hi <b>Bob</b></p>"}
+	if strings.Join(parts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got parts %q, want %q", parts, want)
+	}
+}
+
+func TestSMTPMailerErrors(t *testing.T) {
+	email := tasks.Email{From: tasks.DefaultSender, To: "bob@example.com", Subject: "Hello", Text: "Hi"}
+	for _, tc := range []struct {
+		name      string
+		rcptReply string
+		noTLS     bool
+		skipRetry bool
+		bounced   bool
+	}{
+		{name: "mailbox busy", rcptReply: "450 mailbox busy", skipRetry: false},
+		{name: "no such user", rcptReply: "550 no such user", skipRetry: true, bounced: true},
+		{name: "relay denied", rcptReply: "554 relay access denied", skipRetry: true},
+		{name: "no STARTTLS", noTLS: true, skipRetry: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverTLS, clientTLS := selfSigned(t)
+			if tc.noTLS {
+				serverTLS = nil
+			}
+			s := newFakeSMTP(t, serverTLS, tc.rcptReply)
+			mailer, err := tasks.NewSMTPMailer(tasks.SMTPConfig{Addr: s.ln.Addr().String(), TLSConfig: clientTLS})
+			if err != nil {
+				t.Fatalf("NewSMTPMailer failed: %v", err)
+			}
+			err = mailer.Send(context.Background(), email)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if got := errors.Is(err, asynq.SkipRetry); got != tc.skipRetry {
+				t.Errorf("got error %v, skip retry %v, want %v", err, got, tc.skipRetry)
+			}
+			if got := errors.Is(err, tasks.ErrBounced); got != tc.bounced {
+				t.Errorf("got error %v, bounced %v, want %v", err, got, tc.bounced)
+			}
+		})
+	}
+
+	// An unreachable server is worth retrying.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	mailer, err := tasks.NewSMTPMailer(tasks.SMTPConfig{Addr: addr})
+	if err != nil {
+		t.Fatalf("NewSMTPMailer failed: %v", err)
+	}
+	if err := mailer.Send(context.Background(), email); err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("unreachable server: got error %v, want a retryable one", err)
+	}
+}
+
+func TestSMTPMailerPlainText(t *testing.T) {
+	s := newFakeSMTP(t, nil, "")
+	mailer, err := tasks.NewSMTPMailer(tasks.SMTPConfig{Addr: s.ln.Addr().String(), NoStartTLS: true})
+	if err != nil {
+		t.Fatalf("NewSMTPMailer failed: %v", err)
+	}
+	email := tasks.Email{From: tasks.DefaultSender, To: "bob@example.com", Subject: "Hello", Text: "Hi Bob", ID: "task-1"}
+	if err := mailer.Send(context.Background(), email); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(s.messages))
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(s.messages[0])))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage failed: %v", err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if ct := msg.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" || strings.TrimSpace(string(body)) != "Hi Bob" {
+		t.Errorf("got Content-Type %q and body %q", ct, body)
+	}
+	if id := msg.Header.Get("X-Notification-Id"); id != "task-1" {
+		t.Errorf("got X-Notification-Id %q, want task-1", id)
+	}
+}
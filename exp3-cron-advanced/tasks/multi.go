@@ -0,0 +1,198 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Channel returns the channel of a notification task type, or "" if the
+// task type is not a notification.
+func Channel(taskType string) string {
+	switch taskType {
+	case TypeNotificationEmail:
+		return ChannelEmail
+	case TypeNotificationSMS:
+		return ChannelSMS
+	case TypeNotificationPush:
+		return ChannelPush
+	}
+	return ""
+}
+
+// NotificationMulti is a notification sent on the first of its channels
+// that does not fail permanently, in order.
+type NotificationMulti struct {
+	Channels []MultiChannel
+}
+
+// MultiChannel is the task of a notification on one channel.
+type MultiChannel struct {
+	Type    string          // TypeNotificationEmail, TypeNotificationSMS or TypeNotificationPush
+	Payload json.RawMessage // payload of the task
+}
+
+// MultiResult is the result of a notification:multi task, written with its
+// ResultWriter: the Delivery on the channel that succeeded, if any.
+type MultiResult struct {
+	Delivery
+	Attempts []MultiAttempt `json:"attempts"` // channels tried before, and the one that succeeded
+}
+
+// MultiAttempt is a channel tried by a notification:multi task.
+type MultiAttempt struct {
+	Channel   string `json:"channel"`
+	Recipient string `json:"recipient"`
+	Skipped   string `json:"skipped,omitempty"` // why the send was skipped (see ReportSkipped)
+	Error     string `json:"error,omitempty"`
+
+	// DeferredUntil is set when the send was deferred (see ReportDeferred).
+	DeferredUntil *time.Time `json:"deferred_until,omitempty"`
+}
+
+// BuildNotificationMulti builds a notification sent on the channel of the
+// first task that does not fail permanently: BuildNotificationPush(...),
+// then BuildNotificationSMS(...), then BuildNotificationEmail(...).
+func BuildNotificationMulti(channels ...*asynq.Task) (*asynq.Task, error) {
+	if len(channels) == 0 {
+		return nil, errors.New("no channel to notify on")
+	}
+	var n NotificationMulti
+	for _, t := range channels {
+		if Channel(t.Type()) == "" {
+			return nil, fmt.Errorf("%s is not a notification channel", t.Type())
+		}
+		n.Channels = append(n.Channels, MultiChannel{Type: t.Type(), Payload: t.Payload()})
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	return asynq.NewTask(TypeNotificationMulti, payload, asynq.Retention(ResultRetention)), nil
+}
+
+// reportKey is the context key of the *report where ReportSkipped and
+// ReportDeferred write.
+type reportKey struct{}
+
+// report is what the handler of a channel reports to the notification:multi
+// handler dispatching to it, when it did not send on purpose.
+type report struct {
+	skipped string
+	until   time.Time
+}
+
+// ReportSkipped tells the notification:multi handler dispatching the
+// notification of ctx that it was not sent, on purpose, so that it falls
+// back to the next channel. It does nothing for notifications processed
+// on their own.
+func ReportSkipped(ctx context.Context, reason string) {
+	if r, ok := ctx.Value(reportKey{}).(*report); ok {
+		r.skipped = reason
+	}
+}
+
+// ReportDeferred tells the notification:multi handler dispatching the
+// notification of ctx that it is not to be sent before until, so that the
+// whole notification:multi task is deferred: its handler returns a
+// *DeferredError. It returns false for notifications processed on their
+// own, which the caller defers itself.
+func ReportDeferred(ctx context.Context, until time.Time) bool {
+	r, ok := ctx.Value(reportKey{}).(*report)
+	if ok {
+		r.until = until
+	}
+	return ok
+}
+
+// DeferredError is returned by the notification:multi handler when a channel
+// was deferred (see ReportDeferred). The task is to be enqueued again to be
+// processed at Until, from the first channel, rather than retried.
+type DeferredError struct {
+	Until time.Time
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("notification deferred until %s", e.Until.Format(time.RFC3339))
+}
+
+// ProcessNotificationMulti dispatches to the Handlers of the channels,
+// by task type, such as ProcessNotificationEmail.
+type ProcessNotificationMulti struct {
+	Handlers map[string]asynq.Handler
+	Log      *slog.Logger
+}
+
+func NewProcessNotificationMulti(log *slog.Logger, handlers map[string]asynq.Handler) *ProcessNotificationMulti {
+	return &ProcessNotificationMulti{
+		Handlers: handlers,
+		Log:      log.With(slog.String("task_type", TypeNotificationMulti)),
+	}
+}
+
+// ProcessTask tries the channels in order. A channel that fails
+// permanently, or is skipped, falls back to the next one; a deferred channel
+// defers the whole task with a *DeferredError; any other error is returned
+// so that the task is retried, from the first channel. The channel that
+// succeeded is written as a MultiResult.
+func (p *ProcessNotificationMulti) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	var n NotificationMulti
+	if err := json.Unmarshal(t.Payload(), &n); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if len(n.Channels) == 0 {
+		return fmt.Errorf("no channel to notify on: %w", asynq.SkipRetry)
+	}
+	var result MultiResult
+	var errs []error
+	for _, c := range n.Channels {
+		var r struct{ Recipient string }
+		json.Unmarshal(c.Payload, &r) // the handler reports invalid payloads
+		attempt := MultiAttempt{Channel: Channel(c.Type), Recipient: r.Recipient}
+
+		h, ok := p.Handlers[c.Type]
+		if !ok {
+			return fmt.Errorf("no handler for %s: %w", c.Type, asynq.SkipRetry)
+		}
+		var report report
+		err := h.ProcessTask(context.WithValue(ctx, reportKey{}, &report), asynq.NewTask(c.Type, c.Payload))
+		skipped := report.skipped
+		switch {
+		case err == nil && !report.until.IsZero():
+			attempt.DeferredUntil = &report.until
+			result.Attempts = append(result.Attempts, attempt)
+			result.Delivery = Delivery{Status: StatusQueued, Channel: attempt.Channel, Recipient: attempt.Recipient,
+				Reason: "deferred by the preferences of the recipient", At: report.until}
+			p.Log.Debug("notification deferred", slog.String("channel", attempt.Channel),
+				slog.String("recipient", attempt.Recipient), slog.Time("until", report.until))
+			writeResult(p.Log, t, result)
+			return &DeferredError{Until: report.until}
+		case err == nil && skipped == "":
+			result.Delivery = Delivery{Status: StatusSent, Channel: attempt.Channel, Recipient: attempt.Recipient, At: time.Now().UTC()}
+			result.Attempts = append(result.Attempts, attempt)
+			p.Log.Debug("notification sent", slog.String("channel", attempt.Channel), slog.String("recipient", attempt.Recipient))
+			writeResult(p.Log, t, result)
+			return nil
+		case err == nil:
+			attempt.Skipped = skipped
+			errs = append(errs, fmt.Errorf("%s to %s skipped: %s", attempt.Channel, attempt.Recipient, skipped))
+		case errors.Is(err, asynq.SkipRetry):
+			attempt.Error = err.Error()
+			errs = append(errs, err)
+		default:
+			return fmt.Errorf("%s failed, retrying from the first channel: %w", attempt.Channel, err)
+		}
+		p.Log.Info("falling back to the next channel", slog.String("channel", attempt.Channel),
+			slog.String("recipient", attempt.Recipient), slog.String("reason", errs[len(errs)-1].Error()))
+		result.Attempts = append(result.Attempts, attempt)
+	}
+	err := fmt.Errorf("every channel failed: %w: %w", errors.Join(errs...), asynq.SkipRetry)
+	result.Delivery = Delivery{Status: StatusFailed, Reason: err.Error(), At: time.Now().UTC()}
+	writeResult(p.Log, t, result)
+	return err
+}
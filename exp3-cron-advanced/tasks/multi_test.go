@@ -0,0 +1,88 @@
+package tasks_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+)
+
+// channelFunc is a handler of a channel that records its calls.
+func channelFunc(calls *[]string, err error, skip string) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		*calls = append(*calls, tasks.Channel(t.Type()))
+		if skip != "" {
+			tasks.ReportSkipped(ctx, skip)
+		}
+		return err
+	})
+}
+
+func TestProcessNotificationMulti(t *testing.T) {
+	push, err := tasks.BuildNotificationPush(fcmToken, "Hello")
+	if err != nil {
+		t.Fatalf("BuildNotificationPush failed: %v", err)
+	}
+	sms, err := tasks.BuildNotificationSMS("+15552223333", "Hello")
+	if err != nil {
+		t.Fatalf("BuildNotificationSMS failed: %v", err)
+	}
+	email, err := tasks.BuildNotificationEmail("bob@example.com", "Hello", "Hi")
+	if err != nil {
+		t.Fatalf("BuildNotificationEmail failed: %v", err)
+	}
+	task, err := tasks.BuildNotificationMulti(push, sms, email)
+	if err != nil {
+		t.Fatalf("BuildNotificationMulti failed: %v", err)
+	}
+
+	permanent := fmt.Errorf("could not send: %w", &tasks.ProviderError{Provider: tasks.PushFCM, StatusCode: 404, Code: "UNREGISTERED"})
+	transient := errors.New("connection reset")
+	for _, tc := range []struct {
+		name      string
+		push, sms error
+		pushSkip  string
+		wantCalls []string
+		wantErr   bool
+		skipRetry bool
+	}{
+		{name: "first channel", wantCalls: []string{"push"}},
+		{name: "fall back on permanent failure", push: permanent, wantCalls: []string{"push", "sms"}},
+		{name: "fall back on skip", pushSkip: "opt_out", wantCalls: []string{"push", "sms"}},
+		{name: "retry on transient failure", push: transient, wantCalls: []string{"push"}, wantErr: true},
+		{name: "retry from the first channel", push: permanent, sms: transient, wantCalls: []string{"push", "sms"}, wantErr: true},
+		{name: "every channel fails", push: permanent, sms: asynq.SkipRetry, wantCalls: []string{"push", "sms", "email"}, wantErr: true, skipRetry: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls []string
+			emailErr := error(nil)
+			if tc.skipRetry {
+				emailErr = fmt.Errorf("bad address: %w", asynq.SkipRetry)
+			}
+			h := tasks.NewProcessNotificationMulti(tasks.Logger(io.Discard, ""), map[string]asynq.Handler{
+				tasks.TypeNotificationPush:  channelFunc(&calls, tc.push, tc.pushSkip),
+				tasks.TypeNotificationSMS:   channelFunc(&calls, tc.sms, ""),
+				tasks.TypeNotificationEmail: channelFunc(&calls, emailErr, ""),
+			})
+			err := h.ProcessTask(context.Background(), task)
+			if (err != nil) != tc.wantErr || errors.Is(err, asynq.SkipRetry) != tc.skipRetry {
+				t.Errorf("got error %v, want error %v and skip retry %v", err, tc.wantErr, tc.skipRetry)
+			}
+			if fmt.Sprint(calls) != fmt.Sprint(tc.wantCalls) {
+				t.Errorf("got channels %v, want %v", calls, tc.wantCalls)
+			}
+		})
+	}
+
+	if _, err := tasks.BuildNotificationMulti(); err == nil {
+		t.Error("BuildNotificationMulti with no channel: got no error")
+	}
+	if _, err := tasks.BuildNotificationMulti(push, asynq.NewTask("event:start", nil)); err == nil {
+		t.Error("BuildNotificationMulti with a task that is not a notification: got no error")
+	}
+}
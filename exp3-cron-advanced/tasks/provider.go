@@ -0,0 +1,120 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// defaultProviderTimeout is the timeout of requests to SMS and push
+// providers when the context has no deadline.
+const defaultProviderTimeout = 30 * time.Second
+
+// maxErrorBody is the most of an error response that is read.
+const maxErrorBody = 64 << 10
+
+// ErrBounced is wrapped by the errors of sends that the provider rejected
+// because of the recipient: an unknown mailbox, phone number or device.
+// Sending to the recipient again is pointless.
+var ErrBounced = errors.New("recipient rejected")
+
+// bounceCodes are the error codes of ProviderErrors rejecting the recipient.
+var bounceCodes = map[string][]string{
+	// invalid number, unsubscribed, not a mobile number; in status callbacks,
+	// unknown destination and landline
+	"twilio": {"21211", "21610", "21614", "30005", "30006"},
+	PushFCM:  {"UNREGISTERED"},
+	PushAPNs: {"BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic"},
+}
+
+// ProviderError is an error response of an SMS or push provider.
+// Permanent errors wrap asynq.SkipRetry, bounces wrap ErrBounced too.
+type ProviderError struct {
+	Provider   string // eg: twilio, fcm, apns
+	StatusCode int
+	Code       string // error code of the provider, if any
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	msg := fmt.Sprintf("%s replied %d", e.Provider, e.StatusCode)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Permanent reports whether sending again would fail the same way: client
+// errors, except timeouts and rate limiting, are permanent, server errors
+// are not.
+func (e *ProviderError) Permanent() bool {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout, e.StatusCode == http.StatusTooManyRequests:
+		return false
+	default:
+		return e.StatusCode >= 400 && e.StatusCode < 500
+	}
+}
+
+// Bounced reports whether the provider rejected the recipient.
+func (e *ProviderError) Bounced() bool {
+	if e.Provider == PushAPNs && e.StatusCode == http.StatusGone {
+		return true
+	}
+	for _, code := range bounceCodes[e.Provider] {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ProviderError) Unwrap() []error {
+	var errs []error
+	if e.Permanent() {
+		errs = append(errs, asynq.SkipRetry)
+	}
+	if e.Bounced() {
+		errs = append(errs, ErrBounced)
+	}
+	return errs
+}
+
+// errorParser extracts the error code and message of an error response body.
+type errorParser func(body []byte) (code, message string)
+
+// doProviderRequest sends req and returns nil for a 2xx response, and a
+// *ProviderError for others. Network errors are returned as is, they are
+// worth retrying.
+func doProviderRequest(ctx context.Context, client *http.Client, provider string, req *http.Request, parse errorParser) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultProviderTimeout)
+		defer cancel()
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s request failed: %v", provider, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	perr := &ProviderError{Provider: provider, StatusCode: resp.StatusCode}
+	if parse != nil {
+		perr.Code, perr.Message = parse(body)
+	}
+	return perr
+}
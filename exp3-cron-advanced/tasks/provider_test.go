@@ -0,0 +1,229 @@
+package tasks_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+)
+
+// fakeProvider replies to every request with status and body, and keeps
+// the requests it receives.
+type fakeProvider struct {
+	*httptest.Server
+	status int
+	body   string
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func newFakeProvider(t *testing.T, status int, body string) *fakeProvider {
+	t.Helper()
+	f := &fakeProvider{status: status, body: body}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests = append(f.requests, r)
+		f.bodies = append(f.bodies, string(b))
+		f.mu.Unlock()
+		w.WriteHeader(f.status)
+		io.WriteString(w, f.body)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestTwilioSender(t *testing.T) {
+	f := newFakeProvider(t, http.StatusCreated, `{"sid": "SM1"}`)
+	sender, err := tasks.NewTwilioSender(tasks.SMSConfig{BaseURL: f.URL, AccountSID: "AC1", AuthToken: "secret", From: "+15550001111"})
+	if err != nil {
+		t.Fatalf("NewTwilioSender failed: %v", err)
+	}
+	task, err := tasks.BuildNotificationSMS("+15552223333", "Hello")
+	if err != nil {
+		t.Fatalf("BuildNotificationSMS failed: %v", err)
+	}
+	h := tasks.NewProcessNotificationSMS(tasks.Logger(io.Discard, ""), sender)
+	if err := h.ProcessTask(context.Background(), task); err != nil {
+		t.Fatalf("ProcessTask failed: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(f.requests))
+	}
+	r := f.requests[0]
+	user, password, _ := r.BasicAuth()
+	if r.Method != http.MethodPost || r.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" || user != "AC1" || password != "secret" {
+		t.Errorf("got %s %s with user %q and password %q", r.Method, r.URL.Path, user, password)
+	}
+	form, _ := url.ParseQuery(f.bodies[0])
+	if form.Get("To") != "+15552223333" || form.Get("From") != "+15550001111" || form.Get("Body") != "Hello" || form.Has("StatusCallback") {
+		t.Errorf("got form %v", form)
+	}
+}
+
+func TestTwilioSenderStatusCallback(t *testing.T) {
+	f := newFakeProvider(t, http.StatusCreated, `{"sid": "SM1"}`)
+	sender, err := tasks.NewTwilioSender(tasks.SMSConfig{BaseURL: f.URL, AccountSID: "AC1", AuthToken: "secret", From: "+15550001111",
+		StatusCallback: "https://example.com/deliveries/twilio?token=t0k"})
+	if err != nil {
+		t.Fatalf("NewTwilioSender failed: %v", err)
+	}
+	if err := sender.Send(context.Background(), tasks.SMS{To: "+15552223333", Body: "Hello", ID: "task 1"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	form, _ := url.ParseQuery(f.bodies[0])
+	if got, want := form.Get("StatusCallback"), "https://example.com/deliveries/twilio?id=task+1&token=t0k"; got != want {
+		t.Errorf("got StatusCallback %q, want %q", got, want)
+	}
+
+	if _, err := tasks.NewTwilioSender(tasks.SMSConfig{AccountSID: "AC1", From: "+15550001111", StatusCallback: "deliveries"}); err == nil {
+		t.Error("relative status callback: got no error")
+	}
+}
+
+// fcmToken is shaped like an FCM registration token.
+const fcmToken = "cV3xq9Rz0kE:APA91bHhY7w2X8mKpLq4N5s6T7u8V9w0X1y2Z3a4B5c6D7e8F9g0H1i2J3k4L5m6"
+
+func TestFCMSender(t *testing.T) {
+	f := newFakeProvider(t, http.StatusOK, `{"name": "projects/p1/messages/1"}`)
+	sender, err := tasks.NewPushSender(tasks.PushConfig{Provider: tasks.PushFCM, BaseURL: f.URL, AuthToken: "token", Project: "p1"})
+	if err != nil {
+		t.Fatalf("NewPushSender failed: %v", err)
+	}
+	task, err := tasks.BuildNotificationPush(fcmToken, "Hello")
+	if err != nil {
+		t.Fatalf("BuildNotificationPush failed: %v", err)
+	}
+	h := tasks.NewProcessNotificationPush(tasks.Logger(io.Discard, ""), sender)
+	if err := h.ProcessTask(context.Background(), task); err != nil {
+		t.Fatalf("ProcessTask failed: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(f.requests))
+	}
+	r := f.requests[0]
+	if r.URL.Path != "/v1/projects/p1/messages:send" || r.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("got %s with Authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+	}
+	var msg struct {
+		Message struct {
+			Token        string
+			Notification struct{ Body string }
+		}
+	}
+	if err := json.Unmarshal([]byte(f.bodies[0]), &msg); err != nil || msg.Message.Token != fcmToken || msg.Message.Notification.Body != "Hello" {
+		t.Errorf("got body %s", f.bodies[0])
+	}
+}
+
+func TestAPNsSender(t *testing.T) {
+	f := newFakeProvider(t, http.StatusOK, "")
+	sender, err := tasks.NewPushSender(tasks.PushConfig{Provider: tasks.PushAPNs, BaseURL: f.URL, AuthToken: "jwt", Topic: "com.example.app"})
+	if err != nil {
+		t.Fatalf("NewPushSender failed: %v", err)
+	}
+	if err := sender.Send(context.Background(), tasks.Push{Token: "abc123", Body: "Hello"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.requests[0]
+	if r.URL.Path != "/3/device/abc123" || r.Header.Get("apns-topic") != "com.example.app" || r.Header.Get("Authorization") != "bearer jwt" {
+		t.Errorf("got %s with headers %v", r.URL.Path, r.Header)
+	}
+	if f.bodies[0] != `{"aps":{"alert":{"body":"Hello"}}}` {
+		t.Errorf("got body %s", f.bodies[0])
+	}
+}
+
+func TestProviderErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		provider  string
+		status    int
+		body      string
+		code      string
+		skipRetry bool
+		bounced   bool
+	}{
+		{"twilio invalid number", "twilio", 400, `{"code": 21211, "message": "Invalid 'To' Phone Number"}`, "21211", true, true},
+		{"twilio bad credentials", "twilio", 401, `{"code": 20003, "message": "Authenticate"}`, "20003", true, false},
+		{"twilio rate limited", "twilio", 429, `{"code": 20429, "message": "Too Many Requests"}`, "20429", false, false},
+		{"twilio unavailable", "twilio", 503, "", "", false, false},
+		{"fcm unregistered", tasks.PushFCM, 404, `{"error": {"status": "NOT_FOUND", "message": "not found", "details": [{"errorCode": "UNREGISTERED"}]}}`, "UNREGISTERED", true, true},
+		{"fcm quota", tasks.PushFCM, 429, `{"error": {"status": "RESOURCE_EXHAUSTED"}}`, "RESOURCE_EXHAUSTED", false, false},
+		{"fcm internal", tasks.PushFCM, 500, `{"error": {"status": "INTERNAL"}}`, "INTERNAL", false, false},
+		{"apns unregistered", tasks.PushAPNs, 410, `{"reason": "Unregistered"}`, "Unregistered", true, true},
+		{"apns bad token", tasks.PushAPNs, 400, `{"reason": "BadDeviceToken"}`, "BadDeviceToken", true, true},
+		{"apns bad topic", tasks.PushAPNs, 400, `{"reason": "BadTopic"}`, "BadTopic", true, false},
+		{"apns shutdown", tasks.PushAPNs, 503, `{"reason": "Shutdown"}`, "Shutdown", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeProvider(t, tc.status, tc.body)
+			var err error
+			if tc.provider == "twilio" {
+				var sender *tasks.TwilioSender
+				sender, err = tasks.NewTwilioSender(tasks.SMSConfig{BaseURL: f.URL, AccountSID: "AC1", AuthToken: "secret", From: "+15550001111"})
+				if err != nil {
+					t.Fatalf("NewTwilioSender failed: %v", err)
+				}
+				err = sender.Send(context.Background(), tasks.SMS{To: "+15552223333", Body: "Hello"})
+			} else {
+				var sender tasks.PushSender
+				sender, err = tasks.NewPushSender(tasks.PushConfig{Provider: tc.provider, BaseURL: f.URL, AuthToken: "token", Project: "p1", Topic: "app"})
+				if err != nil {
+					t.Fatalf("NewPushSender failed: %v", err)
+				}
+				err = sender.Send(context.Background(), tasks.Push{Token: "device-1", Body: "Hello"})
+			}
+			var perr *tasks.ProviderError
+			if !errors.As(err, &perr) {
+				t.Fatalf("got error %v, want a ProviderError", err)
+			}
+			if perr.StatusCode != tc.status || perr.Code != tc.code {
+				t.Errorf("got status %d and code %q, want %d and %q", perr.StatusCode, perr.Code, tc.status, tc.code)
+			}
+			if got := errors.Is(err, asynq.SkipRetry); got != tc.skipRetry {
+				t.Errorf("got error %v, skip retry %v, want %v", err, got, tc.skipRetry)
+			}
+			if got := errors.Is(err, tasks.ErrBounced); got != tc.bounced {
+				t.Errorf("got error %v, bounced %v, want %v", err, got, tc.bounced)
+			}
+		})
+	}
+
+	// An unreachable provider is worth retrying.
+	f := newFakeProvider(t, http.StatusOK, "")
+	f.Close()
+	sender, err := tasks.NewTwilioSender(tasks.SMSConfig{BaseURL: f.URL, AccountSID: "AC1", AuthToken: "secret", From: "+15550001111"})
+	if err != nil {
+		t.Fatalf("NewTwilioSender failed: %v", err)
+	}
+	task, err := tasks.BuildNotificationSMS("+15552223333", "Hello")
+	if err != nil {
+		t.Fatalf("BuildNotificationSMS failed: %v", err)
+	}
+	h := tasks.NewProcessNotificationSMS(tasks.Logger(io.Discard, ""), sender)
+	if err := h.ProcessTask(context.Background(), task); err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("unreachable provider: got error %v, want a retryable one", err)
+	}
+}
@@ -0,0 +1,207 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Push is a push notification for a PushSender.
+type Push struct {
+	Token string // device token
+	Body  string
+}
+
+// PushSender sends push notifications. Errors wrapping asynq.SkipRetry will
+// fail the same way if retried; other errors are worth retrying.
+type PushSender interface {
+	Send(ctx context.Context, push Push) error
+}
+
+// LogPushSender logs push notifications instead of sending them, for
+// running without a push provider.
+type LogPushSender struct {
+	Log *slog.Logger
+}
+
+func (s LogPushSender) Send(ctx context.Context, push Push) error {
+	s.Log.Info("📱 Sending push notification", slog.String("recipient", push.Token), slog.String("body", push.Body))
+	return nil
+}
+
+// Push providers.
+const (
+	PushFCM  = "fcm"
+	PushAPNs = "apns"
+)
+
+// PushConfig configures the sender of NewPushSender.
+type PushConfig struct {
+	Provider  string // PushFCM or PushAPNs
+	BaseURL   string // default is the provider's API
+	AuthToken string // OAuth access token for FCM, provider token (JWT) for APNs
+	Project   string // FCM project id
+	Topic     string // APNs topic, the bundle id of the app
+
+	// Optional: client of the requests, default http.DefaultClient.
+	Client *http.Client
+}
+
+var defaultPushBaseURLs = map[string]string{
+	PushFCM:  "https://fcm.googleapis.com",
+	PushAPNs: "https://api.push.apple.com",
+}
+
+// PushConfigFromEnv reads the push configuration: PUSH_PROVIDER (default
+// fcm), PUSH_API_URL, PUSH_AUTH_TOKEN, PUSH_PROJECT and PUSH_TOPIC. It
+// returns ok false if PUSH_AUTH_TOKEN is not set.
+func PushConfigFromEnv() (cfg PushConfig, ok bool, err error) {
+	cfg.AuthToken = os.Getenv("PUSH_AUTH_TOKEN")
+	if cfg.AuthToken == "" {
+		return cfg, false, nil
+	}
+	cfg.Provider = os.Getenv("PUSH_PROVIDER")
+	if cfg.Provider == "" {
+		cfg.Provider = PushFCM
+	}
+	cfg.BaseURL = os.Getenv("PUSH_API_URL")
+	cfg.Project = os.Getenv("PUSH_PROJECT")
+	cfg.Topic = os.Getenv("PUSH_TOPIC")
+	return cfg, true, nil
+}
+
+// NewPushSender returns an FCMSender or an APNsSender, depending on the
+// provider of cfg.
+func NewPushSender(cfg PushConfig) (PushSender, error) {
+	defaultURL, ok := defaultPushBaseURLs[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown push provider %q", cfg.Provider)
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultURL
+	}
+	if _, err := url.ParseRequestURI(cfg.BaseURL); err != nil {
+		return nil, fmt.Errorf("invalid push API URL: %v", err)
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	switch cfg.Provider {
+	case PushFCM:
+		if cfg.Project == "" {
+			return nil, fmt.Errorf("FCM project is required")
+		}
+		return &FCMSender{cfg: cfg}, nil
+	default:
+		if cfg.Topic == "" {
+			return nil, fmt.Errorf("APNs topic is required")
+		}
+		return &APNsSender{cfg: cfg}, nil
+	}
+}
+
+// FCMSender sends push notifications with the HTTP v1 API of Firebase
+// Cloud Messaging.
+type FCMSender struct {
+	cfg PushConfig
+}
+
+// Send sends the push notification. 4xx replies, but 408 and 429, wrap
+// asynq.SkipRetry; other replies and network errors do not.
+func (s *FCMSender) Send(ctx context.Context, push Push) error {
+	var msg struct {
+		Message struct {
+			Token        string `json:"token"`
+			Notification struct {
+				Body string `json:"body"`
+			} `json:"notification"`
+		} `json:"message"`
+	}
+	msg.Message.Token = push.Token
+	msg.Message.Notification.Body = push.Body
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	endpoint := s.cfg.BaseURL + "/v1/projects/" + url.PathEscape(s.cfg.Project) + "/messages:send"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.cfg.AuthToken)
+	return doProviderRequest(ctx, s.cfg.Client, PushFCM, req, parseFCMError)
+}
+
+// parseFCMError reads {"error": {"status": "NOT_FOUND", "message": "...",
+// "details": [{"errorCode": "UNREGISTERED"}]}}, the code is the errorCode
+// of the details, or the status.
+func parseFCMError(body []byte) (code, message string) {
+	var e struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return "", ""
+	}
+	code = e.Error.Status
+	for _, d := range e.Error.Details {
+		if d.ErrorCode != "" {
+			code = d.ErrorCode
+			break
+		}
+	}
+	return code, e.Error.Message
+}
+
+// APNsSender sends push notifications with the HTTP API of the Apple Push
+// Notification service, authenticated with a provider token.
+type APNsSender struct {
+	cfg PushConfig
+}
+
+// Send sends the push notification. 4xx replies, but 408 and 429, wrap
+// asynq.SkipRetry; other replies and network errors do not.
+func (s *APNsSender) Send(ctx context.Context, push Push) error {
+	var msg struct {
+		APS struct {
+			Alert struct {
+				Body string `json:"body"`
+			} `json:"alert"`
+		} `json:"aps"`
+	}
+	msg.APS.Alert.Body = push.Body
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.cfg.BaseURL+"/3/device/"+url.PathEscape(push.Token), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+s.cfg.AuthToken)
+	req.Header.Set("apns-topic", s.cfg.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	return doProviderRequest(ctx, s.cfg.Client, PushAPNs, req, parseAPNsError)
+}
+
+// parseAPNsError reads {"reason": "BadDeviceToken"}.
+func parseAPNsError(body []byte) (code, message string) {
+	var e struct {
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return "", ""
+	}
+	return e.Reason, ""
+}
@@ -0,0 +1,96 @@
+package tasks
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Notification channels.
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// RecipientError is returned for a recipient that is not valid on its channel.
+type RecipientError struct {
+	Channel   string // ChannelEmail, ChannelSMS or ChannelPush
+	Recipient string
+	Reason    string
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("invalid %s recipient %q: %s", e.Channel, e.Recipient, e.Reason)
+}
+
+// maxEmailLength is the longest address that fits in SMTP's forward-path.
+const maxEmailLength = 254
+
+// NormalizeEmail checks an RFC 5322 address and returns it without its
+// display name, with its domain in lower case: "Bob <bob@Example.COM>"
+// is bob@example.com.
+func NormalizeEmail(recipient string) (string, error) {
+	addr, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return "", &RecipientError{Channel: ChannelEmail, Recipient: recipient, Reason: err.Error()}
+	}
+	at := strings.LastIndexByte(addr.Address, '@')
+	normalized := addr.Address[:at] + "@" + strings.ToLower(addr.Address[at+1:])
+	if len(normalized) > maxEmailLength {
+		return "", &RecipientError{Channel: ChannelEmail, Recipient: recipient, Reason: fmt.Sprintf("longer than %d characters", maxEmailLength)}
+	}
+	return normalized, nil
+}
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizePhone checks a phone number and returns it in E.164 format.
+// Spaces, dashes, dots and parentheses are removed, and an international
+// 00 prefix is read as +: "00 33 (1) 23-45-67-89" is +33123456789.
+func NormalizePhone(recipient string) (string, error) {
+	normalized := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, recipient)
+	if rest, ok := strings.CutPrefix(normalized, "00"); ok {
+		normalized = "+" + rest
+	}
+	if !strings.HasPrefix(normalized, "+") {
+		return "", &RecipientError{Channel: ChannelSMS, Recipient: recipient, Reason: "no country code, E.164 numbers start with +"}
+	}
+	if !e164Pattern.MatchString(normalized) {
+		return "", &RecipientError{Channel: ChannelSMS, Recipient: recipient, Reason: "not an E.164 number, + and 7 to 15 digits"}
+	}
+	return normalized, nil
+}
+
+var (
+	hexPattern       = regexp.MustCompile(`^[0-9A-Fa-f]+$`)
+	pushTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_:-]+$`)
+)
+
+// Lengths of push tokens: APNs tokens are 64 hex digits, FCM tokens are
+// around 160 characters.
+const (
+	minPushTokenLength = 32
+	maxPushTokenLength = 4096
+)
+
+// NormalizePushToken checks a device token: an FCM registration token, or
+// an APNs device token in hex. Hex tokens are returned in lower case,
+// without the spaces and angle brackets of "<a1b2c3d4 ...>".
+func NormalizePushToken(recipient string) (string, error) {
+	normalized := strings.TrimSpace(recipient)
+	if compact := strings.NewReplacer(" ", "", "<", "", ">", "").Replace(normalized); hexPattern.MatchString(compact) {
+		normalized = strings.ToLower(compact)
+	}
+	if len(normalized) < minPushTokenLength || len(normalized) > maxPushTokenLength || !pushTokenPattern.MatchString(normalized) {
+		return "", &RecipientError{Channel: ChannelPush, Recipient: recipient, Reason: "not a device token, 32 to 4096 letters, digits, '_', ':' or '-'"}
+	}
+	return normalized, nil
+}
@@ -0,0 +1,99 @@
+package tasks_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestNormalizeRecipients(t *testing.T) {
+	apnsToken := "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	for _, tc := range []struct {
+		channel   string
+		recipient string
+		want      string // empty if invalid
+	}{
+		{tasks.ChannelEmail, "5E8pR@example.com", "5E8pR@example.com"},
+		{tasks.ChannelEmail, "Bob <bob@Example.COM>", "bob@example.com"},
+		{tasks.ChannelEmail, `"Bob Smith" <bob.smith+news@example.com>`, "bob.smith+news@example.com"},
+		{tasks.ChannelEmail, "bob", ""},
+		{tasks.ChannelEmail, "bob@", ""},
+		{tasks.ChannelEmail, "bob@example.com, alice@example.com", ""},
+		{tasks.ChannelEmail, "", ""},
+		{tasks.ChannelSMS, "+15552223333", "+15552223333"},
+		{tasks.ChannelSMS, "+1 (555) 222-3333", "+15552223333"},
+		{tasks.ChannelSMS, "00 33 1.23.45.67.89", "+33123456789"},
+		{tasks.ChannelSMS, "0123456789", ""},
+		{tasks.ChannelSMS, "+0123456789", ""},
+		{tasks.ChannelSMS, "+1234567890123456", ""},
+		{tasks.ChannelSMS, "+1555CALLNOW", ""},
+		{tasks.ChannelPush, fcmToken, fcmToken},
+		{tasks.ChannelPush, apnsToken, apnsToken},
+		{tasks.ChannelPush, "<A1B2C3D4 E5F60718 293A4B5C 6D7E8F90 A1B2C3D4 E5F60718 293A4B5C 6D7E8F90>", apnsToken},
+		{tasks.ChannelPush, "device-1", ""},
+		{tasks.ChannelPush, fcmToken + "/../x", ""},
+	} {
+		var got string
+		var err error
+		switch tc.channel {
+		case tasks.ChannelEmail:
+			got, err = tasks.NormalizeEmail(tc.recipient)
+		case tasks.ChannelSMS:
+			got, err = tasks.NormalizePhone(tc.recipient)
+		case tasks.ChannelPush:
+			got, err = tasks.NormalizePushToken(tc.recipient)
+		}
+		if tc.want == "" {
+			var rerr *tasks.RecipientError
+			if !errors.As(err, &rerr) || rerr.Channel != tc.channel || rerr.Recipient != tc.recipient {
+				t.Errorf("%s %q: got %q and error %v, want a RecipientError", tc.channel, tc.recipient, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s %q: got %q and error %v, want %q", tc.channel, tc.recipient, got, err, tc.want)
+		}
+	}
+}
+
+func TestBuildersValidateRecipients(t *testing.T) {
+	var rerr *tasks.RecipientError
+	if _, err := tasks.BuildNotificationEmail("not an address", "Hello", "Hi"); !errors.As(err, &rerr) {
+		t.Errorf("BuildNotificationEmail: got error %v, want a RecipientError", err)
+	}
+	if _, err := tasks.BuildNotificationEmailTemplate("bob@", "en", "welcome", nil); !errors.As(err, &rerr) {
+		t.Errorf("BuildNotificationEmailTemplate: got error %v, want a RecipientError", err)
+	}
+	if _, err := tasks.BuildNotificationSMS("0123456789", "Hi"); !errors.As(err, &rerr) {
+		t.Errorf("BuildNotificationSMS: got error %v, want a RecipientError", err)
+	}
+	if _, err := tasks.BuildNotificationPush("device-1", "Hi"); !errors.As(err, &rerr) {
+		t.Errorf("BuildNotificationPush: got error %v, want a RecipientError", err)
+	}
+
+	task, err := tasks.BuildNotificationSMS("+1 555 222 3333", "Hi")
+	if err != nil {
+		t.Fatalf("BuildNotificationSMS failed: %v", err)
+	}
+	var n tasks.NotificationSMS
+	if err := json.Unmarshal(task.Payload(), &n); err != nil || n.Recipient != "+15552223333" {
+		t.Errorf("got recipient %q, want the normalized number", n.Recipient)
+	}
+
+	// Tasks not built with the builders are checked by the handlers.
+	mailer := &recordMailer{}
+	h := tasks.NewProcessNotificationEmail(tasks.Logger(io.Discard, ""), "", mailer, nil)
+	task = asynq.NewTask(tasks.TypeNotificationEmail, []byte(`{"Recipient": "bob", "Subject": "Hello", "Body": "Hi"}`))
+	if err := h.ProcessTask(context.Background(), task); !errors.Is(err, asynq.SkipRetry) || !errors.As(err, &rerr) {
+		t.Errorf("got error %v, want a RecipientError and SkipRetry", err)
+	}
+	if len(mailer.emails) != 0 {
+		t.Errorf("got %d emails sent, want none", len(mailer.emails))
+	}
+}
@@ -0,0 +1,136 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SMS is a text message for an SMSSender.
+type SMS struct {
+	To   string // phone number
+	Body string
+	ID   string // optional: task ID of the notification, for status callbacks
+}
+
+// SMSSender sends text messages. Errors wrapping asynq.SkipRetry will fail
+// the same way if retried; other errors are worth retrying.
+type SMSSender interface {
+	Send(ctx context.Context, sms SMS) error
+}
+
+// LogSMSSender logs text messages instead of sending them, for running
+// without an SMS provider.
+type LogSMSSender struct {
+	Log *slog.Logger
+}
+
+func (s LogSMSSender) Send(ctx context.Context, sms SMS) error {
+	s.Log.Info("📟 Sending SMS", slog.String("recipient", sms.To), slog.String("body", sms.Body))
+	return nil
+}
+
+// SMSConfig configures a TwilioSender.
+type SMSConfig struct {
+	BaseURL    string // default https://api.twilio.com
+	AccountSID string
+	AuthToken  string
+	From       string // phone number or messaging service of the sender
+
+	// Optional: URL the provider posts the status of the messages to, with
+	// the ID of the SMS in the id query parameter.
+	StatusCallback string
+
+	// Optional: client of the requests, default http.DefaultClient.
+	Client *http.Client
+}
+
+const defaultSMSBaseURL = "https://api.twilio.com"
+
+// SMSConfigFromEnv reads the SMS configuration: SMS_API_URL, SMS_ACCOUNT_SID,
+// SMS_AUTH_TOKEN, SMS_FROM and SMS_STATUS_CALLBACK. It returns ok false if
+// SMS_ACCOUNT_SID is not set.
+func SMSConfigFromEnv() (cfg SMSConfig, ok bool, err error) {
+	cfg.AccountSID = os.Getenv("SMS_ACCOUNT_SID")
+	if cfg.AccountSID == "" {
+		return cfg, false, nil
+	}
+	cfg.BaseURL = os.Getenv("SMS_API_URL")
+	cfg.AuthToken = os.Getenv("SMS_AUTH_TOKEN")
+	cfg.From = os.Getenv("SMS_FROM")
+	cfg.StatusCallback = os.Getenv("SMS_STATUS_CALLBACK")
+	if cfg.AuthToken == "" || cfg.From == "" {
+		return cfg, false, fmt.Errorf("SMS_AUTH_TOKEN and SMS_FROM are required with SMS_ACCOUNT_SID")
+	}
+	return cfg, true, nil
+}
+
+// TwilioSender sends text messages with the Messages API of Twilio, or of
+// a provider with the same API.
+type TwilioSender struct {
+	cfg      SMSConfig
+	endpoint string
+	callback *url.URL // nil without status callbacks
+}
+
+func NewTwilioSender(cfg SMSConfig) (*TwilioSender, error) {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultSMSBaseURL
+	}
+	if _, err := url.ParseRequestURI(cfg.BaseURL); err != nil {
+		return nil, fmt.Errorf("invalid SMS API URL: %v", err)
+	}
+	if cfg.AccountSID == "" || cfg.From == "" {
+		return nil, fmt.Errorf("SMS account SID and sender are required")
+	}
+	var callback *url.URL
+	if cfg.StatusCallback != "" {
+		var err error
+		if callback, err = url.ParseRequestURI(cfg.StatusCallback); err != nil {
+			return nil, fmt.Errorf("invalid SMS status callback: %v", err)
+		}
+	}
+	endpoint := strings.TrimSuffix(cfg.BaseURL, "/") + "/2010-04-01/Accounts/" + url.PathEscape(cfg.AccountSID) + "/Messages.json"
+	return &TwilioSender{cfg: cfg, endpoint: endpoint, callback: callback}, nil
+}
+
+// Send sends the text message. 4xx replies, but 408 and 429, wrap
+// asynq.SkipRetry; other replies and network errors do not.
+func (s *TwilioSender) Send(ctx context.Context, sms SMS) error {
+	form := url.Values{"To": {sms.To}, "From": {s.cfg.From}, "Body": {sms.Body}}
+	if s.callback != nil && sms.ID != "" {
+		callback := *s.callback
+		q := callback.Query()
+		q.Set("id", sms.ID)
+		callback.RawQuery = q.Encode()
+		form.Set("StatusCallback", callback.String())
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.cfg.AccountSID, s.cfg.AuthToken)
+	return doProviderRequest(ctx, s.cfg.Client, "twilio", req, parseTwilioError)
+}
+
+// parseTwilioError reads {"code": 21211, "message": "..."}.
+func parseTwilioError(body []byte) (code, message string) {
+	var e struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return "", ""
+	}
+	if e.Code != 0 {
+		code = strconv.Itoa(e.Code)
+	}
+	return code, e.Message
+}
@@ -44,12 +44,20 @@ const (
 	TypeNotificationEmail = "notification:email"
 	TypeNotificationSMS   = "notification:sms"
 	TypeNotificationPush  = "notification:push"
+	TypeNotificationMulti = "notification:multi"
 )
 
 type NotificationEmail struct {
 	Recipient string
 	Subject   string
-	Body      string
+	Body      string // text body
+	HTML      string `json:",omitempty"` // optional HTML alternative of Body
+
+	// Optional: the email is rendered from the named template with Data,
+	// in the Locale of the recipient, instead of Subject, Body and HTML.
+	Template string         `json:",omitempty"`
+	Data     map[string]any `json:",omitempty"`
+	Locale   string         `json:",omitempty"` // eg: fr-CA, DefaultLocale if empty
 }
 
 type NotificationSMS struct {
@@ -63,44 +71,104 @@ type NotificationPush struct {
 }
 
 // Task builders
+// Recipients are checked and normalized (see NormalizeEmail, NormalizePhone
+// and NormalizePushToken), an invalid one is a *RecipientError. The tasks
+// are kept for ResultRetention once processed, with their Delivery.
+
+// notificationOptions returns the options of the notification tasks of a type.
+func notificationOptions(taskType string) []asynq.Option {
+	if taskType == TypeNotificationPush {
+		return []asynq.Option{asynq.MaxRetry(5), asynq.Timeout(20 * time.Minute), asynq.Retention(ResultRetention)}
+	}
+	return []asynq.Option{asynq.Retention(ResultRetention)}
+}
 
 func BuildNotificationEmail(recipient, subject, body string) (*asynq.Task, error) {
+	recipient, err := NormalizeEmail(recipient)
+	if err != nil {
+		return nil, err
+	}
 	payload, err := json.Marshal(NotificationEmail{Recipient: recipient, Subject: subject, Body: body})
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %v", err)
 	}
-	return asynq.NewTask(TypeNotificationEmail, payload), nil
+	return asynq.NewTask(TypeNotificationEmail, payload, notificationOptions(TypeNotificationEmail)...), nil
+}
+
+// BuildNotificationEmailHTML builds an email with both a text and an HTML body.
+func BuildNotificationEmailHTML(recipient, subject, text, html string) (*asynq.Task, error) {
+	recipient, err := NormalizeEmail(recipient)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(NotificationEmail{Recipient: recipient, Subject: subject, Body: text, HTML: html})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	return asynq.NewTask(TypeNotificationEmail, payload, notificationOptions(TypeNotificationEmail)...), nil
+}
+
+// BuildNotificationEmailTemplate builds an email rendered from a template
+// with data in the locale of the recipient (see EmailTemplates).
+func BuildNotificationEmailTemplate(recipient, locale, template string, data map[string]any) (*asynq.Task, error) {
+	recipient, err := NormalizeEmail(recipient)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(NotificationEmail{Recipient: recipient, Template: template, Data: data, Locale: locale})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	return asynq.NewTask(TypeNotificationEmail, payload, notificationOptions(TypeNotificationEmail)...), nil
 }
 
 func BuildNotificationSMS(recipient, body string) (*asynq.Task, error) {
+	recipient, err := NormalizePhone(recipient)
+	if err != nil {
+		return nil, err
+	}
 	payload, err := json.Marshal(NotificationSMS{Recipient: recipient, Body: body})
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %v", err)
 	}
-	return asynq.NewTask(TypeNotificationSMS, payload), nil
+	return asynq.NewTask(TypeNotificationSMS, payload, notificationOptions(TypeNotificationSMS)...), nil
 }
 
 func BuildNotificationPush(recipient, body string) (*asynq.Task, error) {
+	recipient, err := NormalizePushToken(recipient)
+	if err != nil {
+		return nil, err
+	}
 	payload, err := json.Marshal(NotificationPush{Recipient: recipient, Body: body})
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %v", err)
 	}
-	return asynq.NewTask(TypeNotificationPush, payload, asynq.MaxRetry(5), asynq.Timeout(20*time.Minute)), nil
+	return asynq.NewTask(TypeNotificationPush, payload, notificationOptions(TypeNotificationPush)...), nil
 }
 
 // Handlers
 // Must implement asynq.Handler interface.
+// Sent notifications write their Delivery as the result of the task.
 // type HandlerFunc func(context.Context, *Task) error
 // func (fn HandlerFunc) ProcessTask(ctx context.Context, task *Task) error
 type ProcessNotificationEmail struct {
-	Sender string
-	Log    *slog.Logger
+	Sender    string
+	Mailer    Mailer
+	Templates *EmailTemplates // nil fails the emails built from a template
+	Log       *slog.Logger
 }
 
-func NewProcessNotificationEmail(log *slog.Logger) *ProcessNotificationEmail {
+// NewProcessNotificationEmail returns a handler sending emails from sender,
+// DefaultSender if empty, with mailer, rendering templates with templates.
+func NewProcessNotificationEmail(log *slog.Logger, sender string, mailer Mailer, templates *EmailTemplates) *ProcessNotificationEmail {
+	if sender == "" {
+		sender = DefaultSender
+	}
 	return &ProcessNotificationEmail{
-		Sender: "experiments@asynq",
-		Log:    log.With(slog.String("sender", "experiments@asynq")),
+		Sender:    sender,
+		Mailer:    mailer,
+		Templates: templates,
+		Log:       log.With(slog.String("task_type", TypeNotificationEmail), slog.String("sender", sender)),
 	}
 }
 
@@ -109,29 +177,88 @@ func (p *ProcessNotificationEmail) ProcessTask(ctx context.Context, t *asynq.Tas
 	if err := json.Unmarshal(t.Payload(), &n); err != nil {
 		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
+	// Tasks may come from other producers than the builders.
+	if _, err := NormalizeEmail(n.Recipient); err != nil {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
 	// Compose and send email
-	p.Log.Info("📨 Sending Email", slog.String("sender", p.Sender), slog.String("recipient", n.Recipient), slog.String("subject", n.Subject), slog.String("body", n.Body))
+	email := Email{Subject: n.Subject, Text: n.Body, HTML: n.HTML}
+	if n.Template != "" {
+		if p.Templates == nil {
+			return fmt.Errorf("no email templates to render %s: %w", n.Template, asynq.SkipRetry)
+		}
+		var err error
+		if email, err = p.Templates.Render(ctx, n.Template, n.Locale, n.Data); err != nil {
+			return fmt.Errorf("could not render email to %s: %w", n.Recipient, err)
+		}
+	}
+	email.From, email.To = p.Sender, n.Recipient
+	email.ID, _ = asynq.GetTaskID(ctx)
+	if err := p.Mailer.Send(ctx, email); err != nil {
+		return fmt.Errorf("could not send email to %s: %w", n.Recipient, err)
+	}
+	p.Log.Debug("email sent", slog.String("recipient", n.Recipient), slog.String("subject", email.Subject))
+	writeResult(p.Log, t, Delivery{Status: StatusSent, Channel: ChannelEmail, Recipient: n.Recipient, At: time.Now().UTC()})
 	return nil
 }
 
-func HandleNotificationSMS(ctx context.Context, t *asynq.Task) error {
+type ProcessNotificationSMS struct {
+	Sender SMSSender
+	Log    *slog.Logger
+}
+
+// NewProcessNotificationSMS returns a handler sending text messages with sender.
+func NewProcessNotificationSMS(log *slog.Logger, sender SMSSender) *ProcessNotificationSMS {
+	return &ProcessNotificationSMS{
+		Sender: sender,
+		Log:    log.With(slog.String("task_type", TypeNotificationSMS)),
+	}
+}
+
+func (p *ProcessNotificationSMS) ProcessTask(ctx context.Context, t *asynq.Task) error {
 	var n NotificationSMS
 	if err := json.Unmarshal(t.Payload(), &n); err != nil {
 		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
+	if _, err := NormalizePhone(n.Recipient); err != nil {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
 	// Send SMS
-	// TODO: implement
-	fmt.Println("📟 TODO: Send SMS to", n.Recipient, "🔧")
+	id, _ := asynq.GetTaskID(ctx)
+	if err := p.Sender.Send(ctx, SMS{To: n.Recipient, Body: n.Body, ID: id}); err != nil {
+		return fmt.Errorf("could not send SMS to %s: %w", n.Recipient, err)
+	}
+	p.Log.Debug("SMS sent", slog.String("recipient", n.Recipient))
+	writeResult(p.Log, t, Delivery{Status: StatusSent, Channel: ChannelSMS, Recipient: n.Recipient, At: time.Now().UTC()})
 	return nil
 }
 
-func HandleNotificationPush(ctx context.Context, t *asynq.Task) error {
+type ProcessNotificationPush struct {
+	Sender PushSender
+	Log    *slog.Logger
+}
+
+// NewProcessNotificationPush returns a handler sending push notifications with sender.
+func NewProcessNotificationPush(log *slog.Logger, sender PushSender) *ProcessNotificationPush {
+	return &ProcessNotificationPush{
+		Sender: sender,
+		Log:    log.With(slog.String("task_type", TypeNotificationPush)),
+	}
+}
+
+func (p *ProcessNotificationPush) ProcessTask(ctx context.Context, t *asynq.Task) error {
 	var n NotificationPush
 	if err := json.Unmarshal(t.Payload(), &n); err != nil {
 		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
+	if _, err := NormalizePushToken(n.Recipient); err != nil {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
 	// Send push notification
-	// TODO: implement
-	fmt.Println("📱 TODO: Send push notification to", n.Recipient, "🔧")
+	if err := p.Sender.Send(ctx, Push{Token: n.Recipient, Body: n.Body}); err != nil {
+		return fmt.Errorf("could not send push notification to %s: %w", n.Recipient, err)
+	}
+	p.Log.Debug("push notification sent", slog.String("recipient", n.Recipient))
+	writeResult(p.Log, t, Delivery{Status: StatusSent, Channel: ChannelPush, Recipient: n.Recipient, At: time.Now().UTC()})
 	return nil
 }
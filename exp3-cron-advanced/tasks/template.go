@@ -0,0 +1,230 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// An email template is one source defining the parts of the email:
+//
+//	{{define "subject"}}Welcome {{.Name}}{{end}}
+//	{{define "text"}}Hi {{.Name}}, ...{{end}}
+//	{{define "html"}}<p>Hi {{.Name}}, ...</p>{{end}}
+//
+// subject and text are required, html is optional. subject and text are
+// rendered with text/template, html with html/template so that the data is
+// escaped. Data missing a key used by the template is a rendering error.
+
+// Names of the templates defined by an email template.
+const (
+	partSubject = "subject"
+	partText    = "text"
+	partHTML    = "html"
+)
+
+// DefaultLocale is the locale of email templates when EMAIL_LOCALE is not set.
+const DefaultLocale = "en"
+
+// ErrTemplateNotFound is returned by a TemplateStore without the template
+// in the locale.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateStore returns the source of an email template in a locale.
+type TemplateStore interface {
+	Template(ctx context.Context, name, locale string) (string, error)
+}
+
+// DirTemplates reads email templates from files <Dir>/<name>.<locale>.tmpl,
+// eg: templates/welcome.fr-CA.tmpl.
+type DirTemplates struct {
+	Dir string
+}
+
+func (d DirTemplates) Template(ctx context.Context, name, locale string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(d.Dir, name+"."+locale+".tmpl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrTemplateNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("os.ReadFile failed: %v", err)
+	}
+	return string(b), nil
+}
+
+// RedisTemplates reads email templates from Redis, one hash per name:
+// email:template:<name> -> <locale> -> <source>
+type RedisTemplates struct {
+	Client redis.UniversalClient
+}
+
+func templateKey(name string) string {
+	return "email:template:" + name
+}
+
+func (r RedisTemplates) Template(ctx context.Context, name, locale string) (string, error) {
+	source, err := r.Client.HGet(ctx, templateKey(name), locale).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrTemplateNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("rdb.HGet failed: %v", err)
+	}
+	return source, nil
+}
+
+// Put stores the source of a template in a locale, after checking that it parses.
+func (r RedisTemplates) Put(ctx context.Context, name, locale, source string) error {
+	if err := checkTemplateName(name, locale); err != nil {
+		return err
+	}
+	if _, _, err := parseTemplate(name, source); err != nil {
+		return err
+	}
+	if err := r.Client.HSet(ctx, templateKey(name), locale, source).Err(); err != nil {
+		return fmt.Errorf("rdb.HSet failed: %v", err)
+	}
+	return nil
+}
+
+// EmailTemplates renders email templates from a store.
+type EmailTemplates struct {
+	Store TemplateStore
+	// Locale used when the template does not exist in the recipient's
+	// locale nor in its language, DefaultLocale if empty.
+	DefaultLocale string
+}
+
+// namePattern restricts template names and locales, which are part of file
+// names and Redis keys.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+func checkTemplateName(name, locale string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid template name %q", name)
+	}
+	if !namePattern.MatchString(locale) {
+		return fmt.Errorf("invalid locale %q", locale)
+	}
+	return nil
+}
+
+// locales returns the locales to look for a template in: the locale
+// itself, its language, and the default locale. pt_BR is read as pt-BR.
+func (e *EmailTemplates) locales(locale string) []string {
+	defaultLocale := e.DefaultLocale
+	if defaultLocale == "" {
+		defaultLocale = DefaultLocale
+	}
+	var locales []string
+	add := func(l string) {
+		for _, seen := range locales {
+			if strings.EqualFold(seen, l) {
+				return
+			}
+		}
+		locales = append(locales, l)
+	}
+	if locale = strings.ReplaceAll(locale, "_", "-"); locale != "" {
+		add(locale)
+		if lang, _, ok := strings.Cut(locale, "-"); ok {
+			add(lang)
+		}
+	}
+	add(defaultLocale)
+	return locales
+}
+
+// Render renders the subject, text and HTML of the template in the locale
+// of the recipient, or the closest one found. Errors that rendering again
+// would not fix, such as a missing template or data, wrap asynq.SkipRetry.
+func (e *EmailTemplates) Render(ctx context.Context, name, locale string, data map[string]any) (Email, error) {
+	var source string
+	found := false
+	for _, l := range e.locales(locale) {
+		if err := checkTemplateName(name, l); err != nil {
+			return Email{}, fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+		}
+		var err error
+		source, err = e.Store.Template(ctx, name, l)
+		if errors.Is(err, ErrTemplateNotFound) {
+			continue
+		}
+		if err != nil {
+			return Email{}, fmt.Errorf("could not read template %s.%s: %v", name, l, err)
+		}
+		found = true
+		break
+	}
+	if !found {
+		return Email{}, fmt.Errorf("template %s in locale %q: %w: %w", name, locale, ErrTemplateNotFound, asynq.SkipRetry)
+	}
+
+	email, err := renderTemplate(name, source, data)
+	if err != nil {
+		return Email{}, fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+	return email, nil
+}
+
+// parseTemplate parses the source of an email template for its text and
+// HTML parts, and checks that the required parts are defined.
+func parseTemplate(name, source string) (*texttemplate.Template, *htmltemplate.Template, error) {
+	text, err := texttemplate.New(name).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse template %s: %v", name, err)
+	}
+	for _, part := range []string{partSubject, partText} {
+		if text.Lookup(part) == nil {
+			return nil, nil, fmt.Errorf("template %s does not define %q", name, part)
+		}
+	}
+	html, err := htmltemplate.New(name).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse template %s: %v", name, err)
+	}
+	return text, html, nil
+}
+
+func renderTemplate(name, source string, data map[string]any) (Email, error) {
+	text, html, err := parseTemplate(name, source)
+	if err != nil {
+		return Email{}, err
+	}
+	var email Email
+	var buf bytes.Buffer
+	for _, part := range []struct {
+		name string
+		dst  *string
+	}{
+		{partSubject, &email.Subject},
+		{partText, &email.Text},
+	} {
+		buf.Reset()
+		if err := text.ExecuteTemplate(&buf, part.name, data); err != nil {
+			return Email{}, fmt.Errorf("could not render template %s: %v", name, err)
+		}
+		*part.dst = strings.TrimSpace(buf.String())
+	}
+	// A subject is a single line.
+	email.Subject = strings.Join(strings.Fields(email.Subject), " ")
+
+	if html.Lookup(partHTML) != nil {
+		buf.Reset()
+		if err := html.ExecuteTemplate(&buf, partHTML, data); err != nil {
+			return Email{}, fmt.Errorf("could not render template %s: %v", name, err)
+		}
+		email.HTML = strings.TrimSpace(buf.String())
+	}
+	return email, nil
+}
@@ -0,0 +1,141 @@
+package tasks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+const welcomeEN = `{{define "subject"}}Welcome
+  {{.Name}}{{end}}
+{{define "text"}}Hi {{.Name}}, welcome aboard.{{end}}
+{{define "html"}}<p>Hi <b>{{.Name}}</b>, welcome aboard.</p>{{end}}`
+
+const welcomeFR = `{{define "subject"}}Bienvenue {{.Name}}{{end}}
+{{define "text"}}Bonjour {{.Name}}, bienvenue.{{end}}`
+
+// recordMailer keeps the emails it is asked to send.
+type recordMailer struct {
+	emails []tasks.Email
+}
+
+func (m *recordMailer) Send(ctx context.Context, email tasks.Email) error {
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+func TestDirTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for name, source := range map[string]string{
+		"welcome.en.tmpl":  welcomeEN,
+		"welcome.fr.tmpl":  welcomeFR,
+		"broken.en.tmpl":   `{{define "subject"}}Hi{{end}}{{define "text"}}{{.Name{{end}}`,
+		"no-text.en.tmpl":  `{{define "subject"}}Hi{{end}}`,
+		"numbers.en.tmpl":  `{{define "subject"}}{{.Count}} new{{end}}{{define "text"}}{{.Count}} new messages{{end}}`,
+		"welcome.de.other": "not a template",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644); err != nil {
+			t.Fatalf("os.WriteFile failed: %v", err)
+		}
+	}
+	templates := &tasks.EmailTemplates{Store: tasks.DirTemplates{Dir: dir}}
+	data := map[string]any{"Name": "<Zoé>"}
+
+	for _, tc := range []struct {
+		locale string
+		want   tasks.Email
+	}{
+		{"", tasks.Email{Subject: "Welcome <Zoé>", Text: "Hi <Zoé>, welcome aboard.", HTML: "<p>Hi <b>&lt;Zoé&gt;</b>, welcome aboard.</p>"}},
+		{"fr", tasks.Email{Subject: "Bienvenue <Zoé>", Text: "Bonjour <Zoé>, bienvenue."}},
+		{"fr_CA", tasks.Email{Subject: "Bienvenue <Zoé>", Text: "Bonjour <Zoé>, bienvenue."}},
+		{"de-DE", tasks.Email{Subject: "Welcome <Zoé>", Text: "Hi <Zoé>, welcome aboard.", HTML: "<p>Hi <b>&lt;Zoé&gt;</b>, welcome aboard.</p>"}},
+	} {
+		got, err := templates.Render(context.Background(), "welcome", tc.locale, data)
+		if err != nil {
+			t.Fatalf("Render(%q) failed: %v", tc.locale, err)
+		}
+		if got != tc.want {
+			t.Errorf("Render(%q) = %+v, want %+v", tc.locale, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, template string
+		data           map[string]any
+	}{
+		{"missing template", "goodbye", data},
+		{"path in name", "../welcome", data},
+		{"parse error", "broken", data},
+		{"no text part", "no-text", data},
+		{"missing data", "numbers", data},
+	} {
+		_, err := templates.Render(context.Background(), tc.template, "en", tc.data)
+		if !errors.Is(err, asynq.SkipRetry) {
+			t.Errorf("%s: got error %v, want a SkipRetry", tc.name, err)
+		}
+	}
+}
+
+func TestRedisTemplates(t *testing.T) {
+	s := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	store := tasks.RedisTemplates{Client: rdb}
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "welcome", "fr", welcomeFR); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put(ctx, "welcome", "en", `{{define "subject"}}Hi{{end}}`); err == nil {
+		t.Error("Put of a template without a text part: got no error")
+	}
+	if err := store.Put(ctx, "welcome", "../en", welcomeEN); err == nil {
+		t.Error("Put with an invalid locale: got no error")
+	}
+	if got := s.HGet("email:template:welcome", "fr"); got != welcomeFR {
+		t.Errorf("got stored template %q", got)
+	}
+
+	task, err := tasks.BuildNotificationEmailTemplate("zoe@example.com", "fr-CA", "welcome", map[string]any{"Name": "Zoé"})
+	if err != nil {
+		t.Fatalf("BuildNotificationEmailTemplate failed: %v", err)
+	}
+	mailer := &recordMailer{}
+	templates := &tasks.EmailTemplates{Store: store, DefaultLocale: "fr"}
+	h := tasks.NewProcessNotificationEmail(tasks.Logger(io.Discard, ""), "", mailer, templates)
+	if err := h.ProcessTask(ctx, task); err != nil {
+		t.Fatalf("ProcessTask failed: %v", err)
+	}
+	want := tasks.Email{From: tasks.DefaultSender, To: "zoe@example.com", Subject: "Bienvenue Zoé", Text: "Bonjour Zoé, bienvenue."}
+	if len(mailer.emails) != 1 || mailer.emails[0] != want {
+		t.Errorf("got emails %+v, want %+v", mailer.emails, want)
+	}
+
+	// A template missing in every locale is not retried.
+	task, err = tasks.BuildNotificationEmailTemplate("zoe@example.com", "fr", "goodbye", nil)
+	if err != nil {
+		t.Fatalf("BuildNotificationEmailTemplate failed: %v", err)
+	}
+	if err := h.ProcessTask(ctx, task); !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("missing template: got error %v, want a SkipRetry", err)
+	}
+
+	// Redis being down is worth retrying.
+	s.Close()
+	task, err = tasks.BuildNotificationEmailTemplate("zoe@example.com", "fr", "welcome", map[string]any{"Name": "Zoé"})
+	if err != nil {
+		t.Fatalf("BuildNotificationEmailTemplate failed: %v", err)
+	}
+	if err := h.ProcessTask(ctx, task); err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("Redis down: got error %v, want a retryable one", err)
+	}
+}
@@ -2,68 +2,112 @@ package db
 
 import (
 	"context"
-	"fmt"
-	"strings"
+	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 // Redis will have keys and values
-// schedule:<task_type> -> <cronspec>
-// eg: schedule:notification:email -> "*/5 * * * *"
-// eg: schedule:notification:push -> "@every 30s"
+// schedule:<task_type>:<id> -> <cronspec> or a hash (see schedule.go)
+// eg: schedule:event:start:0 -> "*/5 * * * *"
+// eg: schedule:event:stop:0 -> "@every 30s"
 
 // Run populate first time
-// redis-cli < data.redis
+// go run ./schedulectl import -f schedules.yaml -apply
 
+// ScheduleConfig is the part of a schedule that ids can share: ids with the
+// same ScheduleConfig are enqueued together.
 type ScheduleConfig struct {
-	CronSpec string
-	TaskType string
+	CronSpec  string
+	TaskType  string
+	Queue     string        // empty for the default queue of the task type
+	Timezone  string        // IANA name, empty for the scheduler's location
+	MaxRetry  int           // NoMaxRetry when not set
+	Timeout   time.Duration // 0 when not set
+	UniqueTTL time.Duration // 0 when not set
+	Payload   string        // JSON passed along with the ids, empty when not set
+	StartAt   time.Time     // first time the schedule may fire, zero when not set
+	EndAt     time.Time     // the schedule fires only before this time, zero when not set
+	RunsLeft  int           // fires left before max_runs is reached, 0 when not set
+
+	Misfire      string // MisfireOnce or MisfireAll, empty to skip missed ticks
+	MisfireLimit int    // most missed ticks fired with MisfireAll, 0 for DefaultMisfireLimit
 }
 
-const redisAddr = "127.0.0.1:6379"
+const defaultRedisAddr = "127.0.0.1:6379"
 
 var (
-	rdb  *redis.Client
-	once sync.Once
+	mu  sync.Mutex
+	rdb *redis.Client
 )
 
-func GetScheduleConfigs(ctx context.Context) (map[ScheduleConfig][]string, error) {
-	once.Do(func() {
+// client returns the package Redis client, connecting on first use.
+// The address can be overridden with the REDIS_ADDR environment variable.
+func client() *redis.Client {
+	mu.Lock()
+	defer mu.Unlock()
+	if rdb == nil {
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = defaultRedisAddr
+		}
 		rdb = redis.NewClient(&redis.Options{
-			Addr:     redisAddr,
+			Addr:     addr,
 			Password: "", // no password set
 			DB:       0,  // use default DB
 		})
-	})
+	}
+	return rdb
+}
+
+// Close closes the package Redis client, if it was ever opened.
+// A later call to the package functions opens a new one.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if rdb == nil {
+		return nil
+	}
+	err := rdb.Close()
+	rdb = nil
+	return err
+}
 
-	keys, err := rdb.Keys(ctx, "schedule:*").Result()
+// Ping checks the connection to Redis.
+func Ping(ctx context.Context) error {
+	return client().Ping(ctx).Err()
+}
+
+// GetScheduleConfigs returns the ids of the enabled cron schedules that are
+// not paused and have not expired, grouped by config. Invalid schedules are
+// left out (see GetSchedules).
+func GetScheduleConfigs(ctx context.Context) (map[ScheduleConfig][]string, error) {
+	schedules, _, err := GetSchedules(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("rdb.Keys failed: %v", err)
+		return nil, err
 	}
+	return GroupSchedules(schedules, time.Now()), nil
+}
 
+// GroupSchedules returns the ids of the enabled cron schedules that are not
+// paused and have not expired at now, grouped by config. One-shot schedules
+// are left out.
+func GroupSchedules(schedules []Schedule, now time.Time) map[ScheduleConfig][]string {
 	// map indexed by a config to a list of ids
 	configs := make(map[ScheduleConfig][]string)
-	for _, key := range keys {
-		value, err := rdb.Get(ctx, key).Result()
-		if err != nil {
-			return nil, fmt.Errorf("rdb.Get failed: %v", err)
-		}
-		parts := strings.Split(key, ":")
-		if len(parts) < 3 {
-			return nil, fmt.Errorf("invalid key: %s", key)
-		}
-		taskType := strings.Join(parts[1:len(parts)-1], ":")
-		id := parts[len(parts)-1]
-		conf := ScheduleConfig{CronSpec: value, TaskType: taskType}
-		// if the config is not in the map, add it
-		if _, ok := configs[conf]; !ok {
-			configs[conf] = []string{id}
+	for _, s := range schedules {
+		if !s.Enabled || s.Paused || s.OneShot() || s.Expired(now) {
 			continue
 		}
-		// if the config is in the map, append the id
-		configs[conf] = append(configs[conf], id)
+		configs[s.ScheduleConfig] = append(configs[s.ScheduleConfig], s.ID)
+	}
+	// KEYS returns keys in no particular order, sort the ids so that the
+	// tasks built from them are the same from one call to the next
+	for _, ids := range configs {
+		sort.Strings(ids)
 	}
-	return configs, nil
+	return configs
 }
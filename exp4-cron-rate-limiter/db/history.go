@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The fires of a schedule are kept in a sorted set of task IDs scored by fire
+// time, and the records of those fires in a hash:
+//
+//	ZADD history:event:stop:7 1709283600 periodic:3f2a...:1709283600
+//	HSET history:event:stop:7:records periodic:3f2a...:1709283600 '{"fire_time":...,"enqueued":true}'
+//	HSET history:event:stop:7:records periodic:3f2a...:1709283600:outcome '{"status":"succeeded",...}'
+//
+// Only the last historyMaxLen fires of a schedule are kept, and the history
+// of a schedule that stops firing expires after historyTTL.
+const (
+	historyMaxLen = 1000
+	historyTTL    = 30 * 24 * time.Hour
+)
+
+// Outcome statuses of a fire.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// FireRecord is a fire of a schedule.
+type FireRecord struct {
+	TaskID   string    `json:"task_id"`
+	FireTime time.Time `json:"fire_time"`
+	Enqueued bool      `json:"enqueued"`        // false until the enqueue succeeded
+	Error    string    `json:"error,omitempty"` // enqueue error
+	Outcome  *Outcome  `json:"-"`               // nil until the task was processed
+}
+
+// Outcome is the result of the last attempt at processing a fire.
+type Outcome struct {
+	Status  string    `json:"status"` // OutcomeSucceeded or OutcomeFailed
+	Error   string    `json:"error,omitempty"`
+	Retried int       `json:"retried"`
+	At      time.Time `json:"at"`
+}
+
+func historyKey(taskType, id string) string {
+	return "history:" + taskType + ":" + id
+}
+
+func historyRecordsKey(taskType, id string) string {
+	return historyKey(taskType, id) + ":records"
+}
+
+// recordFireCmd adds the fire to the history and trims the oldest ones.
+var recordFireCmd = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+local excess = redis.call("ZCARD", KEYS[1]) - tonumber(ARGV[4])
+if excess > 0 then
+	for _, id in ipairs(redis.call("ZRANGE", KEYS[1], 0, excess - 1)) do
+		redis.call("HDEL", KEYS[2], id, id .. ":outcome")
+	end
+	redis.call("ZREMRANGEBYRANK", KEYS[1], 0, excess - 1)
+end
+redis.call("EXPIRE", KEYS[1], ARGV[5])
+redis.call("EXPIRE", KEYS[2], ARGV[5])
+return 1
+`)
+
+// recordOutcomeCmd sets the outcome of a fire in the history, if it is there.
+var recordOutcomeCmd = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1] .. ":outcome", ARGV[2])
+return 1
+`)
+
+// RecordFire adds a fire to the history of the schedule of a task type and
+// id, or replaces the record of the fire with the same task ID.
+func RecordFire(ctx context.Context, taskType, id string, fire FireRecord) error {
+	value, err := json.Marshal(fire)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	keys := []string{historyKey(taskType, id), historyRecordsKey(taskType, id)}
+	args := []any{fire.TaskID, fire.FireTime.Unix(), value, historyMaxLen, int(historyTTL.Seconds())}
+	if err := recordFireCmd.Run(ctx, client(), keys, args...).Err(); err != nil {
+		return fmt.Errorf("recordFireCmd failed: %v", err)
+	}
+	return nil
+}
+
+// RecordFires adds a fire to the history of the schedules of a task type and
+// ids, like RecordFire, in one round trip. If the fire was enqueued, it is
+// also recorded as their last fire (see SetLastFire) and, with run, counted
+// towards their max_runs (see RecordRun).
+//
+// It is meant for the scheduler, on the path of every fire.
+func RecordFires(ctx context.Context, taskType string, ids []string, fire FireRecord, run bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	value, err := json.Marshal(fire)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	// EVAL rather than EVALSHA: a NOSCRIPT error in a pipeline is only seen
+	// once every command ran, too late to retry the ones that failed.
+	_, err = client().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			keys := []string{historyKey(taskType, id), historyRecordsKey(taskType, id)}
+			recordFireCmd.Eval(ctx, pipe, keys, fire.TaskID, fire.FireTime.Unix(), value, historyMaxLen, int(historyTTL.Seconds()))
+			if !fire.Enqueued {
+				continue
+			}
+			key := ScheduleKey(taskType, id)
+			setLastFireCmd.Eval(ctx, pipe, []string{lastFireKey}, key, fire.FireTime.Unix())
+			if run {
+				recordRunCmd.Eval(ctx, pipe, []string{key}, FieldMaxRuns, FieldRuns)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not record fires of %s %v: %v", taskType, ids, err)
+	}
+	return nil
+}
+
+// RecordOutcome sets the outcome of the fire with the task ID in the history
+// of the schedule of a task type and id. It returns false, and records
+// nothing, if the task is not a fire in the history.
+func RecordOutcome(ctx context.Context, taskType, id, taskID string, outcome Outcome) (bool, error) {
+	value, err := json.Marshal(outcome)
+	if err != nil {
+		return false, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	keys := []string{historyRecordsKey(taskType, id)}
+	recorded, err := recordOutcomeCmd.Run(ctx, client(), keys, taskID, value).Int()
+	if err != nil {
+		return false, fmt.Errorf("recordOutcomeCmd failed: %v", err)
+	}
+	return recorded == 1, nil
+}
+
+// GetHistory returns the fires of the schedule of a task type and id between
+// from and to, both included, oldest first. A zero from or to leaves that
+// side of the range open.
+func GetHistory(ctx context.Context, taskType, id string, from, to time.Time) ([]FireRecord, error) {
+	rdb := client()
+
+	by := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		by.Min = strconv.FormatInt(from.Unix(), 10)
+	}
+	if !to.IsZero() {
+		by.Max = strconv.FormatInt(to.Unix(), 10)
+	}
+	taskIDs, err := rdb.ZRangeByScore(ctx, historyKey(taskType, id), by).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.ZRangeByScore failed: %v", err)
+	}
+	if len(taskIDs) == 0 {
+		return nil, nil
+	}
+
+	fields := make([]string, 0, 2*len(taskIDs))
+	for _, taskID := range taskIDs {
+		fields = append(fields, taskID, taskID+":outcome")
+	}
+	values, err := rdb.HMGet(ctx, historyRecordsKey(taskType, id), fields...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.HMGet failed: %v", err)
+	}
+
+	fires := make([]FireRecord, 0, len(taskIDs))
+	for i, taskID := range taskIDs {
+		record, _ := values[2*i].(string)
+		if record == "" {
+			continue // trimmed since the range was read
+		}
+		var fire FireRecord
+		if err := json.Unmarshal([]byte(record), &fire); err != nil {
+			return nil, fmt.Errorf("invalid fire record %s: %v", taskID, err)
+		}
+		if outcome, _ := values[2*i+1].(string); outcome != "" {
+			fire.Outcome = new(Outcome)
+			if err := json.Unmarshal([]byte(outcome), fire.Outcome); err != nil {
+				return nil, fmt.Errorf("invalid outcome of %s: %v", taskID, err)
+			}
+		}
+		fires = append(fires, fire)
+	}
+	return fires, nil
+}
@@ -0,0 +1,129 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"exp1/db"
+)
+
+func TestHistory(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		fire := db.FireRecord{TaskID: fmt.Sprintf("periodic:abc:%d", i), FireTime: base.Add(time.Duration(i) * time.Hour)}
+		if err := db.RecordFire(ctx, "event:stop", "7", fire); err != nil {
+			t.Fatalf("db.RecordFire failed: %v", err)
+		}
+	}
+	// The result of the enqueue replaces the first record.
+	failed := db.FireRecord{TaskID: "periodic:abc:2", FireTime: base.Add(2 * time.Hour), Error: "redis down"}
+	if err := db.RecordFire(ctx, "event:stop", "7", failed); err != nil {
+		t.Fatalf("db.RecordFire failed: %v", err)
+	}
+	enqueued := db.FireRecord{TaskID: "periodic:abc:1", FireTime: base.Add(time.Hour), Enqueued: true}
+	if err := db.RecordFire(ctx, "event:stop", "7", enqueued); err != nil {
+		t.Fatalf("db.RecordFire failed: %v", err)
+	}
+	outcome := db.Outcome{Status: db.OutcomeFailed, Error: "boom", Retried: 2, At: base.Add(time.Hour + time.Minute)}
+	if ok, err := db.RecordOutcome(ctx, "event:stop", "7", "periodic:abc:1", outcome); err != nil || !ok {
+		t.Fatalf("db.RecordOutcome: got %v, %v, want true", ok, err)
+	}
+	// Tasks that are not in the history are left out.
+	if ok, err := db.RecordOutcome(ctx, "event:stop", "7", "manual", outcome); err != nil || ok {
+		t.Errorf("db.RecordOutcome of an unknown task: got %v, %v, want false", ok, err)
+	}
+
+	fires, err := db.GetHistory(ctx, "event:stop", "7", base.Add(time.Hour), time.Time{})
+	if err != nil {
+		t.Fatalf("db.GetHistory failed: %v", err)
+	}
+	if len(fires) != 2 {
+		t.Fatalf("got %d fires from the second one, want 2: %+v", len(fires), fires)
+	}
+	if f := fires[0]; f.TaskID != "periodic:abc:1" || !f.Enqueued || f.Outcome == nil || *f.Outcome != outcome {
+		t.Errorf("got fire %+v, outcome %+v, want an enqueued fire with outcome %+v", f, f.Outcome, outcome)
+	}
+	if f := fires[1]; f.TaskID != "periodic:abc:2" || f.Enqueued || f.Error != "redis down" || f.Outcome != nil {
+		t.Errorf("got fire %+v, want a failed enqueue", f)
+	}
+
+	if fires, err := db.GetHistory(ctx, "event:stop", "7", time.Time{}, base); err != nil || len(fires) != 1 {
+		t.Errorf("got fires %+v, %v until the first one, want 1", fires, err)
+	}
+	if fires, err := db.GetHistory(ctx, "event:stop", "8", time.Time{}, time.Time{}); err != nil || len(fires) != 0 {
+		t.Errorf("got fires %+v, %v of another schedule, want none", fires, err)
+	}
+}
+
+func TestHistoryIsCapped(t *testing.T) {
+	s := useMiniredis(t)
+	ctx := context.Background()
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 1005; i++ {
+		fire := db.FireRecord{TaskID: fmt.Sprintf("periodic:abc:%d", i), FireTime: base.Add(time.Duration(i) * time.Minute)}
+		if err := db.RecordFire(ctx, "event:stop", "7", fire); err != nil {
+			t.Fatalf("db.RecordFire failed: %v", err)
+		}
+	}
+	fires, err := db.GetHistory(ctx, "event:stop", "7", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("db.GetHistory failed: %v", err)
+	}
+	if len(fires) != 1000 || fires[0].TaskID != "periodic:abc:5" {
+		t.Errorf("got %d fires from %s, want 1000 from periodic:abc:5", len(fires), fires[0].TaskID)
+	}
+	if got, _ := s.HKeys("history:event:stop:7:records"); len(got) != 1000 {
+		t.Errorf("got %d records, want 1000", len(got))
+	}
+	if ttl := s.TTL("history:event:stop:7"); ttl <= 0 {
+		t.Errorf("history has no TTL")
+	}
+}
+
+func TestRecordFires(t *testing.T) {
+	s := useMiniredis(t)
+	ctx := context.Background()
+	at := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	s.HSet("schedule:event:start:0", "cron_spec", "@every 5s", "max_runs", "3")
+	s.Set("schedule:event:start:1", "@every 5s")
+	ids := []string{"0", "1"}
+
+	// Before the enqueue: only the history.
+	fire := db.FireRecord{TaskID: "periodic:abc:1", FireTime: at}
+	if err := db.RecordFires(ctx, "event:start", ids, fire, true); err != nil {
+		t.Fatalf("db.RecordFires failed: %v", err)
+	}
+	if lastFires, err := db.GetLastFires(ctx); err != nil || len(lastFires) != 0 {
+		t.Errorf("got last fires %v, %v before the enqueue, want none", lastFires, err)
+	}
+
+	// Enqueued: the record is replaced, and the fire counted once.
+	fire.Enqueued = true
+	if err := db.RecordFires(ctx, "event:start", ids, fire, true); err != nil {
+		t.Fatalf("db.RecordFires failed: %v", err)
+	}
+	if err := db.RecordFires(ctx, "event:start", ids, fire, false); err != nil {
+		t.Fatalf("db.RecordFires failed: %v", err)
+	}
+	for _, id := range ids {
+		fires, err := db.GetHistory(ctx, "event:start", id, time.Time{}, time.Time{})
+		if err != nil || len(fires) != 1 || !fires[0].Enqueued {
+			t.Errorf("id %s: got fires %+v, %v, want one enqueued", id, fires, err)
+		}
+	}
+	lastFires, err := db.GetLastFires(ctx)
+	if err != nil {
+		t.Fatalf("db.GetLastFires failed: %v", err)
+	}
+	if len(lastFires) != 2 || !lastFires["schedule:event:start:0"].Equal(at) || !lastFires["schedule:event:start:1"].Equal(at) {
+		t.Errorf("got last fires %v, want both at %v", lastFires, at)
+	}
+	if runs := s.HGet("schedule:event:start:0", "runs"); runs != "1" {
+		t.Errorf("got runs %q, want 1", runs)
+	}
+}
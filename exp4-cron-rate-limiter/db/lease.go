@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Leases are stored as
+// lease:<name> -> <holder id>, expiring after the lease TTL
+// eg: lease:scheduler -> "host:1234:0b6f..."
+
+// acquireLeaseCmd sets the lease if it is free or renews it if it is
+// already held by the same holder.
+//
+// KEYS[1] -> lease:<name>
+// ARGV[1] -> holder id
+// ARGV[2] -> TTL in milliseconds
+//
+// Returns 1 if the holder owns the lease, 0 otherwise.
+var acquireLeaseCmd = redis.NewScript(`
+local holder = redis.call("GET", KEYS[1])
+if holder == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if holder == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseLeaseCmd deletes the lease if it is held by the holder.
+//
+// KEYS[1] -> lease:<name>
+// ARGV[1] -> holder id
+var releaseLeaseCmd = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func leaseKey(name string) string {
+	return "lease:" + name
+}
+
+// AcquireLease takes the named lease for holder, or renews it if holder
+// already owns it. It reports whether holder owns the lease afterwards.
+func AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	n, err := acquireLeaseCmd.Run(ctx, client(), []string{leaseKey(name)}, holder, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("acquire lease script failed: %v", err)
+	}
+	return n == 1, nil
+}
+
+// ReleaseLease gives up the named lease if it is held by holder.
+func ReleaseLease(ctx context.Context, name, holder string) error {
+	if err := releaseLeaseCmd.Run(ctx, client(), []string{leaseKey(name)}, holder).Err(); err != nil {
+		return fmt.Errorf("release lease script failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A manifest declares the schedules, so that they can be versioned in git
+// and reconciled to Redis:
+//
+//	schedules:
+//	  - type: event:start
+//	    id: "10"
+//	    cron_spec: 0 9 * * 1-5
+//	    timezone: America/New_York
+//	    labels: {team: aws}
+//	    payload: {source: cron}
+//
+// PlanManifest compares it with the stored schedules and ApplyChanges
+// writes the differences; ExportManifest does the reverse.
+type Manifest struct {
+	Schedules []ManifestSchedule `json:"schedules" yaml:"schedules"`
+}
+
+// ManifestSchedule is a schedule in a manifest. Its fields are the ones of
+// the schedule hash, with labels and payload as objects rather than JSON.
+// The runs counted for max_runs are not part of it: the scheduler owns them.
+type ManifestSchedule struct {
+	Type         string            `json:"type" yaml:"type"`
+	ID           string            `json:"id" yaml:"id"`
+	CronSpec     string            `json:"cron_spec,omitempty" yaml:"cron_spec,omitempty"`
+	RunOnceAt    string            `json:"run_once_at,omitempty" yaml:"run_once_at,omitempty"`
+	Timezone     string            `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	Queue        string            `json:"queue,omitempty" yaml:"queue,omitempty"`
+	MaxRetry     *int              `json:"max_retry,omitempty" yaml:"max_retry,omitempty"`
+	Timeout      string            `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	UniqueTTL    string            `json:"unique_ttl,omitempty" yaml:"unique_ttl,omitempty"`
+	Enabled      *bool             `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Payload      any               `json:"payload,omitempty" yaml:"payload,omitempty"`
+	StartAt      string            `json:"start_at,omitempty" yaml:"start_at,omitempty"`
+	EndAt        string            `json:"end_at,omitempty" yaml:"end_at,omitempty"`
+	MaxRuns      *int              `json:"max_runs,omitempty" yaml:"max_runs,omitempty"`
+	Misfire      string            `json:"misfire,omitempty" yaml:"misfire,omitempty"`
+	MisfireLimit *int              `json:"misfire_limit,omitempty" yaml:"misfire_limit,omitempty"`
+}
+
+// Key returns the Redis key of the schedule.
+func (m ManifestSchedule) Key() string {
+	return ScheduleKey(m.Type, m.ID)
+}
+
+// Fields returns the fields of the schedule hash.
+func (m ManifestSchedule) Fields() (map[string]string, error) {
+	fields := make(map[string]string)
+	for field, value := range map[string]string{
+		FieldCronSpec:  m.CronSpec,
+		FieldRunOnceAt: m.RunOnceAt,
+		FieldTimezone:  m.Timezone,
+		FieldQueue:     m.Queue,
+		FieldTimeout:   m.Timeout,
+		FieldUniqueTTL: m.UniqueTTL,
+		FieldStartAt:   m.StartAt,
+		FieldEndAt:     m.EndAt,
+		FieldMisfire:   m.Misfire,
+	} {
+		if value != "" {
+			fields[field] = value
+		}
+	}
+	for field, value := range map[string]*int{
+		FieldMaxRetry:     m.MaxRetry,
+		FieldMaxRuns:      m.MaxRuns,
+		FieldMisfireLimit: m.MisfireLimit,
+	} {
+		if value != nil {
+			fields[field] = strconv.Itoa(*value)
+		}
+	}
+	if m.Enabled != nil {
+		fields[FieldEnabled] = strconv.FormatBool(*m.Enabled)
+	}
+	if m.Labels != nil {
+		labels, err := json.Marshal(m.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", FieldLabels, err)
+		}
+		fields[FieldLabels] = string(labels)
+	}
+	if m.Payload != nil {
+		payload, err := json.Marshal(m.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", FieldPayload, err)
+		}
+		fields[FieldPayload] = string(payload)
+	}
+	return fields, nil
+}
+
+// manifestSchedule returns the manifest form of the schedule of a task type
+// and id with the given hash fields.
+func manifestSchedule(taskType, id string, fields map[string]string) (ManifestSchedule, error) {
+	m := ManifestSchedule{
+		Type:      taskType,
+		ID:        id,
+		CronSpec:  fields[FieldCronSpec],
+		RunOnceAt: fields[FieldRunOnceAt],
+		Timezone:  fields[FieldTimezone],
+		Queue:     fields[FieldQueue],
+		Timeout:   fields[FieldTimeout],
+		UniqueTTL: fields[FieldUniqueTTL],
+		StartAt:   fields[FieldStartAt],
+		EndAt:     fields[FieldEndAt],
+		Misfire:   fields[FieldMisfire],
+	}
+	for field, value := range map[string]**int{
+		FieldMaxRetry:     &m.MaxRetry,
+		FieldMaxRuns:      &m.MaxRuns,
+		FieldMisfireLimit: &m.MisfireLimit,
+	} {
+		if v, ok := fields[field]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return ManifestSchedule{}, fmt.Errorf("invalid %s: %q", field, v)
+			}
+			*value = &n
+		}
+	}
+	if v, ok := fields[FieldEnabled]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return ManifestSchedule{}, fmt.Errorf("invalid %s: %q", FieldEnabled, v)
+		}
+		m.Enabled = &enabled
+	}
+	if v, ok := fields[FieldLabels]; ok {
+		if err := json.Unmarshal([]byte(v), &m.Labels); err != nil {
+			return ManifestSchedule{}, fmt.Errorf("invalid %s: %v", FieldLabels, err)
+		}
+	}
+	if v, ok := fields[FieldPayload]; ok {
+		if err := json.Unmarshal([]byte(v), &m.Payload); err != nil {
+			return ManifestSchedule{}, fmt.Errorf("invalid %s: %v", FieldPayload, err)
+		}
+	}
+	return m, nil
+}
+
+// Kinds of changes to the stored schedules.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// Change is a difference between a manifest and the stored schedules.
+type Change struct {
+	Kind    string // ChangeCreate, ChangeUpdate or ChangeDelete
+	Key     string
+	Current map[string]string // stored fields, nil if there are none or they cannot be read
+	Desired map[string]string // fields in the manifest, nil for ChangeDelete
+}
+
+// PlanManifest compares the manifest with the stored schedules and returns
+// the changes that make Redis match it, sorted by key; it writes nothing.
+// Stored schedules that are not in the manifest are only deleted with prune.
+//
+// The manifest is checked like the scheduler reads schedules, and all its
+// invalid schedules are reported at once.
+func PlanManifest(ctx context.Context, m Manifest, prune bool) ([]Change, error) {
+	desired := make(map[string]map[string]string, len(m.Schedules))
+	var errs []error
+	for i, ms := range m.Schedules {
+		if ms.Type == "" || ms.ID == "" {
+			errs = append(errs, fmt.Errorf("schedule %d: type and id are required", i))
+			continue
+		}
+		// Keys are split on their last ":", task types may have some but ids not.
+		if strings.Contains(ms.ID, ":") {
+			errs = append(errs, fmt.Errorf("schedule %d: id %q cannot contain \":\"", i, ms.ID))
+			continue
+		}
+		key := ms.Key()
+		if _, ok := desired[key]; ok {
+			errs = append(errs, fmt.Errorf("schedule %d: duplicate %s", i, key))
+			continue
+		}
+		fields, err := ms.Fields()
+		if err == nil {
+			_, err = parseSchedule(key, fields)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schedule %d: %w", i, err))
+			continue
+		}
+		desired[key] = fields
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	rdb := client()
+	keys, err := rdb.Keys(ctx, "schedule:*").Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.Keys failed: %v", err)
+	}
+	stored := make(map[string]map[string]string, len(keys))
+	for _, key := range keys {
+		fields, err := readFields(ctx, rdb, key)
+		var invalidErr *ScheduleError
+		switch {
+		case errors.Is(err, errScheduleGone):
+			continue
+		case errors.As(err, &invalidErr):
+			stored[key] = nil // replaced or pruned all the same
+			continue
+		case err != nil:
+			return nil, err
+		}
+		delete(fields, FieldRuns)
+		stored[key] = fields
+	}
+
+	var changes []Change
+	for key, fields := range desired {
+		current, ok := stored[key]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: ChangeCreate, Key: key, Desired: fields})
+		case !sameFields(key, current, fields):
+			changes = append(changes, Change{Kind: ChangeUpdate, Key: key, Current: current, Desired: fields})
+		}
+	}
+	if prune {
+		for key, current := range stored {
+			if _, ok := desired[key]; !ok {
+				changes = append(changes, Change{Kind: ChangeDelete, Key: key, Current: current})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes, nil
+}
+
+// sameFields reports whether the stored fields of the schedule at key are
+// the desired ones, once written like a manifest writes them: the order of
+// JSON keys or "1" for "true" is no change.
+func sameFields(key string, current, desired map[string]string) bool {
+	if current == nil {
+		return false
+	}
+	if maps.Equal(current, desired) {
+		return true
+	}
+	taskType, id, err := parseKey(key)
+	if err != nil {
+		return false
+	}
+	m, err := manifestSchedule(taskType, id, current)
+	if err != nil {
+		return false
+	}
+	normalized, err := m.Fields()
+	return err == nil && maps.Equal(normalized, desired)
+}
+
+// replaceScheduleCmd replaces the schedule at KEYS[1] with a hash of the
+// field and value pairs in ARGV, keeping the runs counted by the scheduler.
+var replaceScheduleCmd = redis.NewScript(`
+local runs = false
+if redis.call("TYPE", KEYS[1]).ok == "hash" then
+	runs = redis.call("HGET", KEYS[1], "runs")
+end
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[1], unpack(ARGV))
+if runs then
+	redis.call("HSET", KEYS[1], "runs", runs)
+end
+return 1
+`)
+
+// ApplyChanges writes changes returned by PlanManifest, each schedule
+// atomically, then bumps the schedule version once.
+func ApplyChanges(ctx context.Context, changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	rdb := client()
+	for _, c := range changes {
+		switch c.Kind {
+		case ChangeCreate, ChangeUpdate:
+			args := make([]any, 0, 2*len(c.Desired))
+			for field, value := range c.Desired {
+				args = append(args, field, value)
+			}
+			if err := replaceScheduleCmd.Run(ctx, rdb, []string{c.Key}, args...).Err(); err != nil {
+				return fmt.Errorf("replaceScheduleCmd %s failed: %v", c.Key, err)
+			}
+		case ChangeDelete:
+			if err := rdb.Del(ctx, c.Key).Err(); err != nil {
+				return fmt.Errorf("rdb.Del %s failed: %v", c.Key, err)
+			}
+		default:
+			return fmt.Errorf("unknown change %q of %s", c.Kind, c.Key)
+		}
+	}
+	_, err := BumpScheduleVersion(ctx)
+	return err
+}
+
+// ExportManifest returns the stored schedules as a manifest, sorted by task
+// type and id, without the runs counted by the scheduler. Schedules that
+// cannot be parsed are left out and returned in invalid (see GetSchedules).
+func ExportManifest(ctx context.Context) (m Manifest, invalid []*ScheduleError, err error) {
+	rdb := client()
+	keys, err := rdb.Keys(ctx, "schedule:*").Result()
+	if err != nil {
+		return Manifest{}, nil, fmt.Errorf("rdb.Keys failed: %v", err)
+	}
+	for _, key := range keys {
+		fields, err := readFields(ctx, rdb, key)
+		if err == nil {
+			_, err = parseSchedule(key, fields)
+		}
+		var invalidErr *ScheduleError
+		switch {
+		case errors.Is(err, errScheduleGone):
+			continue
+		case errors.As(err, &invalidErr):
+			invalid = append(invalid, invalidErr)
+			continue
+		case err != nil:
+			return Manifest{}, nil, err
+		}
+		taskType, id, _ := parseKey(key)
+		delete(fields, FieldRuns)
+		ms, err := manifestSchedule(taskType, id, fields)
+		if err != nil {
+			invalid = append(invalid, &ScheduleError{Key: key, Err: err})
+			continue
+		}
+		m.Schedules = append(m.Schedules, ms)
+	}
+	sort.Slice(m.Schedules, func(i, j int) bool {
+		a, b := m.Schedules[i], m.Schedules[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return lessID(a.ID, b.ID)
+	})
+	return m, invalid, nil
+}
+
+// lessID orders numeric ids by value, before the other ids.
+func lessID(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return x < y
+	case errA == nil || errB == nil:
+		return errA == nil
+	default:
+		return a < b
+	}
+}
@@ -0,0 +1,111 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"exp1/db"
+)
+
+func TestManifest(t *testing.T) {
+	s := useMiniredis(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	s.Set("schedule:event:start:1", "@every 5s")
+	s.HSet("schedule:event:start:2", "cron_spec", "0 9 * * *", "labels", `{"b":"2", "a":"1"}`, "enabled", "1")
+	s.HSet("schedule:event:stop:0", "cron_spec", "@every 1m", "queue", "critical", "max_runs", "10", "runs", "4")
+	s.Set("schedule:event:stop:1", "@every 5s")
+
+	enabled, maxRuns := true, 20
+	m := db.Manifest{Schedules: []db.ManifestSchedule{
+		{Type: "event:start", ID: "0", CronSpec: "@every 5s"},
+		{Type: "event:start", ID: "1", CronSpec: "@every 10s"},
+		{Type: "event:start", ID: "2", CronSpec: "0 9 * * *", Labels: map[string]string{"a": "1", "b": "2"}, Enabled: &enabled},
+		{Type: "event:start", ID: "3", CronSpec: "0 9 * * *", Payload: map[string]any{"source": "cron"}},
+		{Type: "event:stop", ID: "0", CronSpec: "@every 1m", MaxRuns: &maxRuns},
+	}}
+	ctx := context.Background()
+	plan := func(prune bool) []string {
+		t.Helper()
+		changes, err := db.PlanManifest(ctx, m, prune)
+		if err != nil {
+			t.Fatalf("db.PlanManifest failed: %v", err)
+		}
+		var got []string
+		for _, c := range changes {
+			got = append(got, c.Kind+" "+c.Key)
+		}
+		return got
+	}
+
+	// Differences in JSON formatting or booleans are no change, and
+	// schedules missing from the manifest are only deleted with prune.
+	want := []string{"update schedule:event:start:1", "create schedule:event:start:3", "update schedule:event:stop:0"}
+	if got := plan(false); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("plan: got %v, want %v", got, want)
+	}
+	want = append(want, "delete schedule:event:stop:1")
+	if got := plan(true); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("plan with prune: got %v, want %v", got, want)
+	}
+
+	changes, err := db.PlanManifest(ctx, m, true)
+	if err != nil {
+		t.Fatalf("db.PlanManifest failed: %v", err)
+	}
+	if err := db.ApplyChanges(ctx, changes); err != nil {
+		t.Fatalf("db.ApplyChanges failed: %v", err)
+	}
+	if got := plan(true); len(got) != 0 {
+		t.Errorf("plan after apply: got %v, want no changes", got)
+	}
+	// The runs counted by the scheduler are kept, removed fields are gone.
+	if got := s.HGet("schedule:event:stop:0", "runs"); got != "4" {
+		t.Errorf("runs: got %q, want 4", got)
+	}
+	if got := s.HGet("schedule:event:stop:0", "queue"); got != "" {
+		t.Errorf("queue: got %q, want none", got)
+	}
+	if s.Exists("schedule:event:stop:1") {
+		t.Error("pruned schedule still exists")
+	}
+	if got, err := db.GetScheduleVersion(ctx); err != nil || got != 1 {
+		t.Errorf("version: got %d, %v, want 1", got, err)
+	}
+
+	// The export imports back without changes.
+	exported, invalid, err := db.ExportManifest(ctx)
+	if err != nil || len(invalid) != 0 {
+		t.Fatalf("db.ExportManifest failed: %v, invalid %v", err, invalid)
+	}
+	if len(exported.Schedules) != len(m.Schedules) {
+		t.Errorf("exported %d schedules, want %d", len(exported.Schedules), len(m.Schedules))
+	}
+	m = exported
+	if got := plan(true); len(got) != 0 {
+		t.Errorf("plan of the export: got %v, want no changes", got)
+	}
+}
+
+func TestManifestInvalid(t *testing.T) {
+	useMiniredis(t)
+	m := db.Manifest{Schedules: []db.ManifestSchedule{
+		{Type: "event:start", ID: "0", CronSpec: "0 9 * * mon-fry"},
+		{Type: "event:start", ID: "1"},
+		{Type: "event:start", ID: "2", CronSpec: "@every 5s"},
+		{Type: "event:start", ID: "2", CronSpec: "@every 5s"},
+		{Type: "event:start", CronSpec: "@every 5s"},
+		{Type: "event", ID: "start:5", CronSpec: "@every 5s"}, // would be read back as event:start 5
+	}}
+	_, err := db.PlanManifest(context.Background(), m, false)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	// All the invalid schedules are reported.
+	for _, want := range []string{"schedule 0:", "schedule 1: invalid schedule schedule:event:start:1: missing cron_spec", "schedule 3: duplicate", "schedule 4:", `schedule 5: id "start:5" cannot contain ":"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The time up to which the ticks of each schedule were handled, fired or
+// skipped on purpose, is kept in a hash by schedule key, in unix seconds:
+//
+//	HSET schedules:last_fire schedule:event:start:0 1709283600
+//
+// A scheduler taking over computes the ticks missed since then.
+const lastFireKey = "schedules:last_fire"
+
+// setLastFireCmd moves the last fire time of a schedule forward, never back.
+var setLastFireCmd = redis.NewScript(`
+local last = tonumber(redis.call("HGET", KEYS[1], ARGV[1]))
+if last and last >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// SetLastFire records that the ticks of the schedule stored at key were
+// handled up to at. It does nothing if they were handled up to a later time.
+func SetLastFire(ctx context.Context, key string, at time.Time) error {
+	if err := setLastFireCmd.Run(ctx, client(), []string{lastFireKey}, key, at.Unix()).Err(); err != nil {
+		return fmt.Errorf("setLastFireCmd failed: %v", err)
+	}
+	return nil
+}
+
+// GetLastFires returns the times up to which the ticks of the schedules were
+// handled, by schedule key.
+func GetLastFires(ctx context.Context) (map[string]time.Time, error) {
+	fields, err := client().HGetAll(ctx, lastFireKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.HGetAll failed: %v", err)
+	}
+	lastFires := make(map[string]time.Time, len(fields))
+	for key, value := range fields {
+		unix, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last fire of %s: %q", key, value)
+		}
+		lastFires[key] = time.Unix(unix, 0).UTC()
+	}
+	return lastFires, nil
+}
+
+// DeleteLastFires forgets the last fire times of the schedules stored at keys.
+func DeleteLastFires(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := client().HDel(ctx, lastFireKey, keys...).Err(); err != nil {
+		return fmt.Errorf("rdb.HDel failed: %v", err)
+	}
+	return nil
+}
+
+// InitLastFires records at as the last fire time of the schedules stored at
+// keys that have none yet, so that the ticks they miss from then on are
+// caught up.
+func InitLastFires(ctx context.Context, at time.Time, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := client().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.HSetNX(ctx, lastFireKey, key, at.Unix())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("rdb.HSetNX failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"exp1/db"
+)
+
+func TestLastFires(t *testing.T) {
+	useMiniredis(t)
+	ctx := context.Background()
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	if err := db.InitLastFires(ctx, base, "schedule:event:start:0", "schedule:event:start:1"); err != nil {
+		t.Fatalf("db.InitLastFires failed: %v", err)
+	}
+	// Last fires only move forward, and are only initialized once.
+	for _, at := range []time.Time{base.Add(2 * time.Hour), base.Add(time.Hour)} {
+		if err := db.SetLastFire(ctx, "schedule:event:start:0", at); err != nil {
+			t.Fatalf("db.SetLastFire failed: %v", err)
+		}
+	}
+	if err := db.InitLastFires(ctx, base.Add(3*time.Hour), "schedule:event:start:0"); err != nil {
+		t.Fatalf("db.InitLastFires failed: %v", err)
+	}
+	if err := db.DeleteLastFires(ctx, "schedule:event:start:1"); err != nil {
+		t.Fatalf("db.DeleteLastFires failed: %v", err)
+	}
+
+	lastFires, err := db.GetLastFires(ctx)
+	if err != nil {
+		t.Fatalf("db.GetLastFires failed: %v", err)
+	}
+	if len(lastFires) != 1 || !lastFires["schedule:event:start:0"].Equal(base.Add(2*time.Hour)) {
+		t.Errorf("got last fires %v, want schedule:event:start:0 at %v", lastFires, base.Add(2*time.Hour))
+	}
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Paused task types and schedules are fields of a hash, holding who paused
+// them, and every pause and resume is appended to a capped stream:
+//
+//	HSET paused type:event:start '{"by":"alice","reason":"maintenance","at":"..."}'
+//	HSET paused schedule:event:start:0 '{...}'
+//	XADD audit:schedules * action pause target type:event:start by alice reason maintenance
+const (
+	pausedKey = "paused"
+	auditKey  = "audit:schedules"
+	// auditMaxLen is the approximate number of audit records kept.
+	auditMaxLen = 10000
+)
+
+var (
+	// ErrNotPaused is returned when resuming something that is not paused.
+	ErrNotPaused = errors.New("not paused")
+	// ErrNoSchedule is returned when pausing a task type without schedules
+	// or a schedule that does not exist, most likely a typo.
+	ErrNoSchedule = errors.New("no such schedule")
+)
+
+// Target is what a pause applies to: every schedule of a task type, or the
+// single schedule of the task type and id when ID is set.
+type Target struct {
+	TaskType string
+	ID       string
+}
+
+// String returns the field of the target in the paused hash.
+func (t Target) String() string {
+	if t.ID == "" {
+		return "type:" + t.TaskType
+	}
+	return ScheduleKey(t.TaskType, t.ID)
+}
+
+// ParseTarget parses the String form of a target.
+func ParseTarget(s string) (Target, error) {
+	if taskType, ok := strings.CutPrefix(s, "type:"); ok && taskType != "" {
+		return Target{TaskType: taskType}, nil
+	}
+	taskType, id, err := parseKey(s)
+	if err != nil || !strings.HasPrefix(s, "schedule:") {
+		return Target{}, fmt.Errorf("invalid target: %s", s)
+	}
+	return Target{TaskType: taskType, ID: id}, nil
+}
+
+// Pause records who paused a target, and why.
+type Pause struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// AuditRecord is a pause or resume action.
+type AuditRecord struct {
+	ID     string // stream entry ID
+	Action string // "pause" or "resume"
+	Target Target
+	By     string
+	Reason string
+	At     time.Time
+}
+
+// pauseCmd records the pause and appends it to the audit stream.
+var pauseCmd = redis.NewScript(`
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[3], "*",
+	"action", "pause", "target", ARGV[1], "by", ARGV[4], "reason", ARGV[5], "at", ARGV[6])
+return 1
+`)
+
+// resumeCmd removes the pause, if there is one, and appends the resume to the audit stream.
+var resumeCmd = redis.NewScript(`
+if redis.call("HDEL", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("XADD", KEYS[2], "MAXLEN", "~", ARGV[2], "*",
+	"action", "resume", "target", ARGV[1], "by", ARGV[3], "reason", "", "at", ARGV[4])
+return 1
+`)
+
+// PauseTarget pauses a task type or a schedule: the scheduler skips paused
+// schedules until they are resumed. Pausing again replaces the record.
+// It returns ErrNoSchedule if the target has no schedule.
+// Both PauseTarget and ResumeTarget bump the schedule version.
+//
+// by is recorded as given, it is informational only and not authenticated.
+func PauseTarget(ctx context.Context, target Target, by, reason string) error {
+	if target.TaskType == "" || by == "" {
+		return fmt.Errorf("task type and by are required")
+	}
+	exists, err := targetExists(ctx, target)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("could not pause %s: %w", target, ErrNoSchedule)
+	}
+	at := time.Now().UTC()
+	value, err := json.Marshal(Pause{By: by, Reason: reason, At: at})
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	keys := []string{pausedKey, auditKey}
+	args := []any{target.String(), value, auditMaxLen, by, reason, at.Format(time.RFC3339)}
+	if err := pauseCmd.Run(ctx, client(), keys, args...).Err(); err != nil {
+		return fmt.Errorf("pauseCmd failed: %v", err)
+	}
+	_, err = BumpScheduleVersion(ctx)
+	return err
+}
+
+// ResumeTarget resumes a paused task type or schedule, even one whose
+// schedules were deleted since. It returns ErrNotPaused if the target is not
+// paused, or ErrNoSchedule if it is not paused and has no schedule either.
+func ResumeTarget(ctx context.Context, target Target, by string) error {
+	if target.TaskType == "" || by == "" {
+		return fmt.Errorf("task type and by are required")
+	}
+	keys := []string{pausedKey, auditKey}
+	args := []any{target.String(), auditMaxLen, by, time.Now().UTC().Format(time.RFC3339)}
+	resumed, err := resumeCmd.Run(ctx, client(), keys, args...).Int()
+	if err != nil {
+		return fmt.Errorf("resumeCmd failed: %v", err)
+	}
+	if resumed == 0 {
+		if exists, err := targetExists(ctx, target); err == nil && !exists {
+			return fmt.Errorf("could not resume %s: %w", target, ErrNoSchedule)
+		}
+		return fmt.Errorf("could not resume %s: %w", target, ErrNotPaused)
+	}
+	_, err = BumpScheduleVersion(ctx)
+	return err
+}
+
+// targetExists reports whether the schedule of target, or a schedule of its
+// task type, is stored.
+func targetExists(ctx context.Context, target Target) (bool, error) {
+	rdb := client()
+	if target.ID != "" {
+		n, err := rdb.Exists(ctx, target.String()).Result()
+		if err != nil {
+			return false, fmt.Errorf("rdb.Exists failed: %v", err)
+		}
+		return n > 0, nil
+	}
+	keys, err := rdb.Keys(ctx, ScheduleKey(target.TaskType, "*")).Result()
+	if err != nil {
+		return false, fmt.Errorf("rdb.Keys failed: %v", err)
+	}
+	for _, key := range keys {
+		// schedule:event:start:* also matches the keys of event:start:<sub>.
+		if taskType, _, err := parseKey(key); err == nil && taskType == target.TaskType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetPauses returns the paused task types and schedules.
+func GetPauses(ctx context.Context) (map[Target]Pause, error) {
+	fields, err := client().HGetAll(ctx, pausedKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.HGetAll failed: %v", err)
+	}
+	pauses := make(map[Target]Pause, len(fields))
+	for field, value := range fields {
+		target, err := ParseTarget(field)
+		if err != nil {
+			return nil, err
+		}
+		var p Pause
+		if err := json.Unmarshal([]byte(value), &p); err != nil {
+			return nil, fmt.Errorf("invalid pause of %s: %v", field, err)
+		}
+		pauses[target] = p
+	}
+	return pauses, nil
+}
+
+// GetAudit returns the last count pause and resume actions, newest first.
+func GetAudit(ctx context.Context, count int64) ([]AuditRecord, error) {
+	entries, err := client().XRevRangeN(ctx, auditKey, "+", "-", count).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.XRevRangeN failed: %v", err)
+	}
+	records := make([]AuditRecord, 0, len(entries))
+	for _, e := range entries {
+		r := AuditRecord{ID: e.ID}
+		r.Action, _ = e.Values["action"].(string)
+		r.By, _ = e.Values["by"].(string)
+		r.Reason, _ = e.Values["reason"].(string)
+		target, _ := e.Values["target"].(string)
+		if r.Target, err = ParseTarget(target); err != nil {
+			return nil, fmt.Errorf("invalid audit record %s: %v", e.ID, err)
+		}
+		at, _ := e.Values["at"].(string)
+		if r.At, err = time.Parse(time.RFC3339, at); err != nil {
+			return nil, fmt.Errorf("invalid audit record %s: %v", e.ID, err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
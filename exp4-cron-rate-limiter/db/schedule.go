@@ -0,0 +1,394 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"exp1/periodic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A schedule is stored at schedule:<task_type>:<id>, either as a plain string
+// holding the cron spec (legacy form):
+//
+//	SET schedule:event:start:0 "@every 5s"
+//
+// or as a hash:
+//
+//	HSET schedule:event:start:0 cron_spec "@every 5s" queue cron timezone Europe/Paris \
+//	     max_retry 3 timeout 30s unique_ttl 5s enabled true \
+//	     labels '{"team":"aws"}' payload '{"source":"cron"}'
+//
+// Only cron_spec is required in the hash form. In both forms the cron spec
+// may start with CRON_TZ=<IANA name>, which is the same as setting timezone.
+//
+// A hash schedule can be limited to a window and a number of fires:
+//
+//	HSET schedule:event:start:0 cron_spec "0 9 * * *" \
+//	     start_at 2024-03-01T00:00:00Z end_at 2024-04-01T00:00:00Z max_runs 10
+//
+// or fire once, at a given time, instead of following a cron spec:
+//
+//	HSET schedule:event:start:0 run_once_at 2024-03-01T09:00:00Z
+//
+// After the scheduler was down, the ticks a hash schedule missed are handled
+// according to its misfire policy (see MisfireSkip):
+//
+//	HSET schedule:event:start:0 cron_spec "0 * * * *" misfire all misfire_limit 5
+//
+// The scheduler counts the fires of schedules with max_runs in runs, and
+// deletes schedules once they have expired (see Schedule.Expired) or, for
+// one-shot schedules, once they have been enqueued.
+
+// Hash fields of a schedule.
+const (
+	FieldCronSpec  = "cron_spec"
+	FieldQueue     = "queue"
+	FieldTimezone  = "timezone"
+	FieldMaxRetry  = "max_retry"
+	FieldTimeout   = "timeout"
+	FieldUniqueTTL = "unique_ttl"
+	FieldEnabled   = "enabled"
+	FieldLabels    = "labels"
+	FieldPayload   = "payload"
+	FieldStartAt   = "start_at"
+	FieldEndAt     = "end_at"
+	FieldMaxRuns   = "max_runs"
+	FieldRuns      = "runs"
+	FieldRunOnceAt = "run_once_at"
+
+	FieldMisfire      = "misfire"
+	FieldMisfireLimit = "misfire_limit"
+)
+
+// Misfire policies, for the ticks a schedule missed while no scheduler was running.
+const (
+	MisfireSkip = "skip" // drop them, the default
+	MisfireOnce = "once" // fire once for all of them
+	MisfireAll  = "all"  // fire each of them, the most recent misfire_limit at most
+)
+
+// DefaultMisfireLimit is the misfire_limit of a schedule that does not set it.
+const DefaultMisfireLimit = 10
+
+// NoMaxRetry is the MaxRetry of a schedule that does not set max_retry.
+const NoMaxRetry = -1
+
+type Schedule struct {
+	ScheduleConfig
+	Key     string // Redis key of the schedule
+	ID      string
+	Enabled bool
+	Paused  bool // the schedule or its task type is paused (see PauseTarget)
+	Labels  map[string]string
+
+	MaxRuns   int       // 0 when not set
+	Runs      int       // fires counted so far when MaxRuns is set
+	RunOnceAt time.Time // zero for cron schedules
+}
+
+// ScheduleKey returns the Redis key of the schedule of a task type and id.
+func ScheduleKey(taskType, id string) string {
+	return "schedule:" + taskType + ":" + id
+}
+
+// OneShot reports whether the schedule fires once at RunOnceAt rather than
+// following a cron spec.
+func (s Schedule) OneShot() bool {
+	return !s.RunOnceAt.IsZero()
+}
+
+// Expired reports whether the cron schedule will not fire anymore after now:
+// its end_at has passed or it has fired max_runs times.
+func (s Schedule) Expired(now time.Time) bool {
+	if !s.EndAt.IsZero() && !now.Before(s.EndAt) {
+		return true
+	}
+	return s.MaxRuns > 0 && s.Runs >= s.MaxRuns
+}
+
+// ScheduleError reports a stored schedule that could not be parsed.
+type ScheduleError struct {
+	Key string
+	Err error
+}
+
+func (e *ScheduleError) Error() string { return fmt.Sprintf("invalid schedule %s: %v", e.Key, e.Err) }
+func (e *ScheduleError) Unwrap() error { return e.Err }
+
+// GetSchedules returns all stored schedules, in both the legacy and the hash
+// form. Schedules that cannot be parsed are skipped and returned in invalid,
+// so that one bad key does not hide the others; err is only set when Redis
+// cannot be read.
+func GetSchedules(ctx context.Context) (schedules []Schedule, invalid []*ScheduleError, err error) {
+	rdb := client()
+
+	keys, err := rdb.Keys(ctx, "schedule:*").Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("rdb.Keys failed: %v", err)
+	}
+	paused, err := rdb.HGetAll(ctx, pausedKey).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("rdb.HGetAll failed: %v", err)
+	}
+
+	for _, key := range keys {
+		s, err := getSchedule(ctx, rdb, key)
+		var invalidErr *ScheduleError
+		switch {
+		case errors.Is(err, errScheduleGone):
+			continue
+		case errors.As(err, &invalidErr):
+			invalid = append(invalid, invalidErr)
+			continue
+		case err != nil:
+			return nil, nil, err
+		}
+		_, typePaused := paused[Target{TaskType: s.TaskType}.String()]
+		_, idPaused := paused[key]
+		s.Paused = typePaused || idPaused
+		schedules = append(schedules, s)
+	}
+	return schedules, invalid, nil
+}
+
+// errScheduleGone is returned by getSchedule for a key deleted since it was listed.
+var errScheduleGone = errors.New("schedule deleted")
+
+// getSchedule reads the schedule stored at key. It returns a *ScheduleError
+// if the schedule is invalid, and other errors if Redis cannot be read.
+func getSchedule(ctx context.Context, rdb *redis.Client, key string) (Schedule, error) {
+	fields, err := readFields(ctx, rdb, key)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return parseSchedule(key, fields)
+}
+
+// readFields reads the fields of the schedule stored at key. The legacy form
+// is read as a hash with only the cron_spec field.
+func readFields(ctx context.Context, rdb *redis.Client, key string) (map[string]string, error) {
+	kind, err := rdb.Type(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("rdb.Type failed: %v", err)
+	}
+	switch kind {
+	case "string":
+		value, err := rdb.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil, errScheduleGone
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rdb.Get failed: %v", err)
+		}
+		return map[string]string{FieldCronSpec: value}, nil
+	case "hash":
+		fields, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("rdb.HGetAll failed: %v", err)
+		}
+		if len(fields) == 0 {
+			return nil, errScheduleGone
+		}
+		return fields, nil
+	case "none":
+		return nil, errScheduleGone
+	default:
+		return nil, &ScheduleError{Key: key, Err: fmt.Errorf("unexpected type %s", kind)}
+	}
+}
+
+// parseSchedule parses the fields of the schedule stored at key. It returns
+// a *ScheduleError if they are invalid.
+func parseSchedule(key string, fields map[string]string) (Schedule, error) {
+	taskType, id, err := parseKey(key)
+	if err != nil {
+		return Schedule{}, &ScheduleError{Key: key, Err: err}
+	}
+	s := Schedule{
+		ScheduleConfig: ScheduleConfig{TaskType: taskType, MaxRetry: NoMaxRetry},
+		Key:            key,
+		ID:             id,
+		Enabled:        true,
+	}
+	if err := s.parseFields(fields); err != nil {
+		return Schedule{}, &ScheduleError{Key: key, Err: err}
+	}
+	if err := s.splitTimezone(); err != nil {
+		return Schedule{}, &ScheduleError{Key: key, Err: err}
+	}
+	return s, nil
+}
+
+// parseKey splits schedule:<task_type>:<id> into the task type and the id.
+func parseKey(key string) (taskType, id string, err error) {
+	parts := strings.Split(key, ":")
+	if len(parts) < 3 {
+		return "", "", fmt.Errorf("invalid key: %s", key)
+	}
+	return strings.Join(parts[1:len(parts)-1], ":"), parts[len(parts)-1], nil
+}
+
+func (s *Schedule) parseFields(fields map[string]string) error {
+	var err error
+	s.CronSpec = fields[FieldCronSpec]
+	if v, ok := fields[FieldRunOnceAt]; ok {
+		if s.RunOnceAt, err = parseTime(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldRunOnceAt, err)
+		}
+		if s.CronSpec != "" {
+			return fmt.Errorf("%s and %s are mutually exclusive", FieldCronSpec, FieldRunOnceAt)
+		}
+	} else if s.CronSpec == "" {
+		return fmt.Errorf("missing %s", FieldCronSpec)
+	}
+	s.Queue = fields[FieldQueue]
+	s.Timezone = fields[FieldTimezone]
+	if v, ok := fields[FieldMaxRetry]; ok {
+		if s.MaxRetry, err = strconv.Atoi(v); err != nil || s.MaxRetry < 0 {
+			return fmt.Errorf("invalid %s: %q", FieldMaxRetry, v)
+		}
+	}
+	if v, ok := fields[FieldTimeout]; ok {
+		if s.Timeout, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldTimeout, err)
+		}
+	}
+	if v, ok := fields[FieldUniqueTTL]; ok {
+		if s.UniqueTTL, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldUniqueTTL, err)
+		}
+	}
+	if v, ok := fields[FieldEnabled]; ok {
+		if s.Enabled, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid %s: %q", FieldEnabled, v)
+		}
+	}
+	if v, ok := fields[FieldLabels]; ok {
+		if err := json.Unmarshal([]byte(v), &s.Labels); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldLabels, err)
+		}
+	}
+	if v, ok := fields[FieldPayload]; ok {
+		if !json.Valid([]byte(v)) {
+			return fmt.Errorf("invalid %s: not JSON", FieldPayload)
+		}
+		s.Payload = v
+	}
+	if v, ok := fields[FieldStartAt]; ok {
+		if s.StartAt, err = parseTime(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldStartAt, err)
+		}
+	}
+	if v, ok := fields[FieldEndAt]; ok {
+		if s.EndAt, err = parseTime(v); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldEndAt, err)
+		}
+		if !s.EndAt.After(s.StartAt) {
+			return fmt.Errorf("%s must be after %s", FieldEndAt, FieldStartAt)
+		}
+	}
+	if v, ok := fields[FieldMaxRuns]; ok {
+		if s.MaxRuns, err = strconv.Atoi(v); err != nil || s.MaxRuns < 1 {
+			return fmt.Errorf("invalid %s: %q", FieldMaxRuns, v)
+		}
+	}
+	if v, ok := fields[FieldRuns]; ok {
+		if s.Runs, err = strconv.Atoi(v); err != nil || s.Runs < 0 {
+			return fmt.Errorf("invalid %s: %q", FieldRuns, v)
+		}
+	}
+	if s.MaxRuns > s.Runs {
+		s.RunsLeft = s.MaxRuns - s.Runs
+	}
+	if v, ok := fields[FieldMisfire]; ok {
+		switch v {
+		case MisfireSkip: // the default, left empty so that it groups with schedules without a policy
+		case MisfireOnce, MisfireAll:
+			s.Misfire = v
+		default:
+			return fmt.Errorf("invalid %s: %q", FieldMisfire, v)
+		}
+	}
+	if v, ok := fields[FieldMisfireLimit]; ok {
+		if s.MisfireLimit, err = strconv.Atoi(v); err != nil || s.MisfireLimit < 1 {
+			return fmt.Errorf("invalid %s: %q", FieldMisfireLimit, v)
+		}
+	}
+	return nil
+}
+
+// parseTime parses an RFC 3339 time, in UTC so that equal times compare equal.
+func parseTime(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// DeleteSchedule deletes the schedule stored at key and bumps the schedule version.
+func DeleteSchedule(ctx context.Context, key string) error {
+	if err := client().Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("rdb.Del failed: %v", err)
+	}
+	_, err := BumpScheduleVersion(ctx)
+	return err
+}
+
+// recordRunCmd increments the runs of a hash schedule with max_runs, and
+// leaves other schedules, and deleted ones, alone.
+var recordRunCmd = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok == "hash" and redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	return redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
+end
+return 0
+`)
+
+// RecordRun counts a fire of the schedule stored at key towards its max_runs.
+// It does nothing for schedules without max_runs.
+func RecordRun(ctx context.Context, key string) error {
+	if err := recordRunCmd.Run(ctx, client(), []string{key}, FieldMaxRuns, FieldRuns).Err(); err != nil {
+		return fmt.Errorf("recordRunCmd failed: %v", err)
+	}
+	return nil
+}
+
+// splitTimezone moves a CRON_TZ= (or TZ=) prefix of the cron spec to
+// Timezone, so that schedules in the same zone are grouped together however
+// the zone was given, and checks that the zone exists and that the spec
+// parses like the scheduler parses it.
+func (s *Schedule) splitTimezone() error {
+	for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+		rest, ok := strings.CutPrefix(s.CronSpec, prefix)
+		if !ok {
+			continue
+		}
+		tz, spec, ok := strings.Cut(rest, " ")
+		if !ok {
+			return fmt.Errorf("invalid %s: %q", FieldCronSpec, s.CronSpec)
+		}
+		if s.Timezone != "" && s.Timezone != tz {
+			return fmt.Errorf("%s %s conflicts with %s%s", FieldTimezone, s.Timezone, prefix, tz)
+		}
+		s.Timezone = tz
+		s.CronSpec = strings.TrimSpace(spec)
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("invalid %s: %v", FieldTimezone, err)
+		}
+	}
+	if s.CronSpec != "" {
+		if _, err := periodic.Parse(s.CronSpec); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", FieldCronSpec, s.CronSpec, err)
+		}
+	}
+	return nil
+}
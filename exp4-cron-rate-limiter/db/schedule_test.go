@@ -0,0 +1,215 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"exp1/db"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// useMiniredis points the db package at an in-memory Redis for the test.
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	return s
+}
+
+func TestGetSchedulesLegacyAndHash(t *testing.T) {
+	s := useMiniredis(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	s.HSet("schedule:event:start:1",
+		"cron_spec", "0 9 * * *",
+		"queue", "critical",
+		"timezone", "Europe/Paris",
+		"max_retry", "3",
+		"timeout", "30s",
+		"unique_ttl", "1m",
+		"enabled", "false",
+		"labels", `{"team":"aws"}`,
+		"payload", `{"source":"cron"}`,
+	)
+
+	schedules, invalid, err := db.GetSchedules(context.Background())
+	if err != nil || len(invalid) > 0 {
+		t.Fatalf("db.GetSchedules failed: %v, %v", err, invalid)
+	}
+	byID := make(map[string]db.Schedule)
+	for _, s := range schedules {
+		byID[s.ID] = s
+	}
+
+	legacy := byID["0"]
+	if legacy.CronSpec != "@every 5s" || legacy.TaskType != "event:start" || !legacy.Enabled || legacy.MaxRetry != db.NoMaxRetry {
+		t.Errorf("legacy schedule: got %+v", legacy)
+	}
+
+	hash := byID["1"]
+	want := db.ScheduleConfig{
+		CronSpec:  "0 9 * * *",
+		TaskType:  "event:start",
+		Queue:     "critical",
+		Timezone:  "Europe/Paris",
+		MaxRetry:  3,
+		Timeout:   30 * time.Second,
+		UniqueTTL: time.Minute,
+		Payload:   `{"source":"cron"}`,
+	}
+	if hash.ScheduleConfig != want || hash.Enabled || hash.Labels["team"] != "aws" {
+		t.Errorf("hash schedule: got %+v, want %+v", hash, want)
+	}
+
+	// Disabled schedules are not returned as configs.
+	configs, err := db.GetScheduleConfigs(context.Background())
+	if err != nil {
+		t.Fatalf("db.GetScheduleConfigs failed: %v", err)
+	}
+	if len(configs) != 1 {
+		t.Errorf("got %d configs, want 1: %v", len(configs), configs)
+	}
+}
+
+func TestGetSchedulesInvalid(t *testing.T) {
+	for name, fields := range map[string][]string{
+		"missing cron spec":  {"queue", "cron"},
+		"bad max retry":      {"cron_spec", "@every 5s", "max_retry", "many"},
+		"bad timeout":        {"cron_spec", "@every 5s", "timeout", "soon"},
+		"bad labels":         {"cron_spec", "@every 5s", "labels", "team=aws"},
+		"bad payload":        {"cron_spec", "@every 5s", "payload", "{"},
+		"unknown timezone":   {"cron_spec", "@every 5s", "timezone", "Mars/Olympus_Mons"},
+		"timezone conflict":  {"cron_spec", "CRON_TZ=Asia/Tokyo 0 9 * * *", "timezone", "Europe/Paris"},
+		"bad cron spec":      {"cron_spec", "0 9 * * mon-fry"},
+		"bad start":          {"cron_spec", "@every 5s", "start_at", "tomorrow"},
+		"end before start":   {"cron_spec", "@every 5s", "start_at", "2024-03-02T00:00:00Z", "end_at", "2024-03-01T00:00:00Z"},
+		"zero max runs":      {"cron_spec", "@every 5s", "max_runs", "0"},
+		"once and cron":      {"cron_spec", "@every 5s", "run_once_at", "2024-03-01T09:00:00Z"},
+		"unknown misfire":    {"cron_spec", "@every 5s", "misfire", "later"},
+		"zero misfire limit": {"cron_spec", "@every 5s", "misfire", "all", "misfire_limit", "0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := useMiniredis(t)
+			s.HSet("schedule:event:start:0", fields...)
+			s.Set("schedule:event:start:1", "@every 5s")
+			// The invalid schedule is reported, and does not hide the valid one.
+			schedules, invalid, err := db.GetSchedules(context.Background())
+			if err != nil {
+				t.Fatalf("db.GetSchedules failed: %v", err)
+			}
+			if len(invalid) != 1 || invalid[0].Key != "schedule:event:start:0" {
+				t.Errorf("got invalid schedules %v, want schedule:event:start:0", invalid)
+			}
+			if len(schedules) != 1 || schedules[0].ID != "1" {
+				t.Errorf("got schedules %+v, want schedule:event:start:1", schedules)
+			}
+		})
+	}
+}
+
+func TestGetSchedulesInvalidKey(t *testing.T) {
+	s := useMiniredis(t)
+	s.Set("schedule:0", "@every 5s")
+	s.Lpush("schedule:event:start:0", "@every 5s")
+	_, invalid, err := db.GetSchedules(context.Background())
+	if err != nil {
+		t.Fatalf("db.GetSchedules failed: %v", err)
+	}
+	if len(invalid) != 2 {
+		t.Errorf("got invalid schedules %v, want 2", invalid)
+	}
+}
+
+func TestGetSchedulesTimezonePrefix(t *testing.T) {
+	s := useMiniredis(t)
+	s.Set("schedule:event:start:0", "CRON_TZ=Asia/Tokyo 0 9 * * *")
+	s.HSet("schedule:event:start:1", "cron_spec", "0 9 * * *", "timezone", "Asia/Tokyo")
+	s.HSet("schedule:event:start:2", "cron_spec", "TZ=Asia/Tokyo 0 9 * * *", "timezone", "Asia/Tokyo")
+
+	// The zone is taken out of the spec, so all three fire as one task.
+	configs, err := db.GetScheduleConfigs(context.Background())
+	if err != nil {
+		t.Fatalf("db.GetScheduleConfigs failed: %v", err)
+	}
+	want := db.ScheduleConfig{CronSpec: "0 9 * * *", TaskType: "event:start", Timezone: "Asia/Tokyo", MaxRetry: db.NoMaxRetry}
+	if ids := configs[want]; len(configs) != 1 || len(ids) != 3 {
+		t.Errorf("got configs %v, want %v -> [0 1 2]", configs, want)
+	}
+}
+
+func TestGetSchedulesWindow(t *testing.T) {
+	s := useMiniredis(t)
+	s.HSet("schedule:event:start:0",
+		"cron_spec", "0 9 * * *",
+		"start_at", "2024-03-01T10:00:00+01:00",
+		"end_at", "2024-04-01T00:00:00Z",
+		"max_runs", "10",
+		"runs", "4",
+	)
+	s.HSet("schedule:event:start:1", "run_once_at", "2024-03-01T09:00:00Z")
+
+	schedules, _, err := db.GetSchedules(context.Background())
+	if err != nil {
+		t.Fatalf("db.GetSchedules failed: %v", err)
+	}
+	byID := make(map[string]db.Schedule)
+	for _, s := range schedules {
+		byID[s.ID] = s
+	}
+
+	window := byID["0"]
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	if window.StartAt != start || window.EndAt != end || window.MaxRuns != 10 || window.Runs != 4 || window.RunsLeft != 6 {
+		t.Errorf("window schedule: got %+v", window)
+	}
+	if window.OneShot() || window.Expired(start) || !window.Expired(end) {
+		t.Errorf("window schedule: one-shot %v, expired at start %v, expired at end %v",
+			window.OneShot(), window.Expired(start), window.Expired(end))
+	}
+	window.Runs = 10
+	if !window.Expired(start) {
+		t.Error("window schedule: not expired after max_runs")
+	}
+
+	once := byID["1"]
+	if !once.OneShot() || once.RunOnceAt != start {
+		t.Errorf("one-shot schedule: got %+v", once)
+	}
+
+	// One-shot schedules are not cron configs.
+	configs := db.GroupSchedules(schedules, start)
+	if len(configs) != 1 {
+		t.Errorf("got %d configs, want 1: %v", len(configs), configs)
+	}
+	if configs := db.GroupSchedules(schedules, end); len(configs) != 0 {
+		t.Errorf("got configs %v after the end, want none", configs)
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	s := useMiniredis(t)
+	ctx := context.Background()
+	s.HSet("schedule:event:start:0", "cron_spec", "@every 5s", "max_runs", "3")
+	s.HSet("schedule:event:start:1", "cron_spec", "@every 5s")
+	s.Set("schedule:event:start:2", "@every 5s")
+
+	for _, id := range []string{"0", "1", "2", "3"} {
+		if err := db.RecordRun(ctx, db.ScheduleKey("event:start", id)); err != nil {
+			t.Fatalf("db.RecordRun(%s) failed: %v", id, err)
+		}
+	}
+	if got := s.HGet("schedule:event:start:0", "runs"); got != "1" {
+		t.Errorf("runs with max_runs: got %q, want 1", got)
+	}
+	if got := s.HGet("schedule:event:start:1", "runs"); got != "" {
+		t.Errorf("runs without max_runs: got %q, want none", got)
+	}
+	// A deleted schedule is not brought back.
+	if s.Exists("schedule:event:start:3") {
+		t.Error("RecordRun created a deleted schedule")
+	}
+}
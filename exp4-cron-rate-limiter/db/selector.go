@@ -0,0 +1,53 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Selector selects schedules by their labels: a schedule matches when it
+// has every label of the selector, with the same value. The empty selector
+// matches every schedule.
+type Selector map[string]string
+
+// ParseSelector parses a selector written as comma-separated key=value
+// pairs, such as "team=aws,env=prod". The empty string is the empty selector.
+func ParseSelector(s string) (Selector, error) {
+	sel := make(Selector)
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label selector %q, want key=value pairs", s)
+		}
+		if v, ok := sel[key]; ok && v != value {
+			return nil, fmt.Errorf("invalid label selector %q: %s is selected twice", s, key)
+		}
+		sel[key] = value
+	}
+	return sel, nil
+}
+
+// Matches reports whether a schedule with labels is selected.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for key, value := range sel {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector in the form read by ParseSelector, with the
+// labels sorted.
+func (sel Selector) String() string {
+	pairs := make([]string, 0, len(sel))
+	for key, value := range sel {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
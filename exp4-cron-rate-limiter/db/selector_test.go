@@ -0,0 +1,36 @@
+package db
+
+import "testing"
+
+func TestSelector(t *testing.T) {
+	sel, err := ParseSelector(" team=aws, env=prod")
+	if err != nil {
+		t.Fatalf("ParseSelector failed: %v", err)
+	}
+	if got := sel.String(); got != "env=prod,team=aws" {
+		t.Errorf("got %q, want env=prod,team=aws", got)
+	}
+	for _, tc := range []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{labels: map[string]string{"team": "aws", "env": "prod", "tier": "1"}, want: true},
+		{labels: map[string]string{"team": "aws", "env": "staging"}},
+		{labels: map[string]string{"team": "aws"}},
+		{labels: nil},
+	} {
+		if got := sel.Matches(tc.labels); got != tc.want {
+			t.Errorf("Matches(%v): got %v, want %v", tc.labels, got, tc.want)
+		}
+	}
+
+	empty, err := ParseSelector("")
+	if err != nil || !empty.Matches(nil) || empty.String() != "" {
+		t.Errorf("empty selector: got %v, %v, want a selector matching everything", empty, err)
+	}
+	for _, s := range []string{"team", "=aws", "team=aws,team=gcp"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("ParseSelector(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"exp1/periodic"
+
+	"github.com/robfig/cron/v3"
+)
+
+// SpecCheck is the result of validating a stored schedule.
+type SpecCheck struct {
+	Key      string
+	Schedule *Schedule   // nil if the schedule is invalid
+	Err      error       // why the schedule is invalid
+	Next     []time.Time // next fire times, in the schedule's time zone
+	Warnings []string
+}
+
+// ValidateOpts configures schedule validation.
+type ValidateOpts struct {
+	// Time zone of cron specs without one of their own, default is UTC.
+	Location *time.Location
+
+	// Next fire times are previewed from Now, default is time.Now, and at
+	// most Count of them, default is 5.
+	Now   time.Time
+	Count int
+
+	// Task types the scheduler can build, others are invalid.
+	// Every task type is valid when empty.
+	TaskTypes []string
+
+	// Schedules firing more often than the minimum interval of their task
+	// type, or of "" for any task type, are warned about.
+	MinInterval map[string]time.Duration
+
+	// Only the schedules matching Selector are checked. Invalid schedules
+	// are always reported, as their labels cannot be read.
+	Selector Selector
+}
+
+const defaultPreviewCount = 5
+
+// ValidateSchedules checks the schedules stored in Redis like the scheduler
+// reads them, and previews their next fire times. The checks are sorted by key.
+func ValidateSchedules(ctx context.Context, opts ValidateOpts) ([]SpecCheck, error) {
+	schedules, invalid, err := GetSchedules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]SpecCheck, 0, len(schedules)+len(invalid))
+	for _, s := range schedules {
+		if opts.Selector.Matches(s.Labels) {
+			checks = append(checks, ValidateSchedule(s, opts))
+		}
+	}
+	for _, e := range invalid {
+		checks = append(checks, SpecCheck{Key: e.Key, Err: e.Err})
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Key < checks[j].Key })
+	return checks, nil
+}
+
+// ValidateSchedule checks a schedule that was read successfully: its task
+// type, and the fire times of its cron spec within its window.
+func ValidateSchedule(s Schedule, opts ValidateOpts) SpecCheck {
+	check := SpecCheck{Key: s.Key, Schedule: &s}
+	if len(opts.TaskTypes) > 0 && !slices.Contains(opts.TaskTypes, s.TaskType) {
+		check.Err = fmt.Errorf("unknown task type %s", s.TaskType)
+		return check
+	}
+
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			check.Err = fmt.Errorf("invalid %s: %v", FieldTimezone, err)
+			return check
+		}
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = defaultPreviewCount
+	}
+
+	if s.OneShot() {
+		if s.RunOnceAt.Before(now) {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("%s is in the past, fires right away", FieldRunOnceAt))
+		}
+		check.Next = []time.Time{s.RunOnceAt.In(loc)}
+		return check
+	}
+
+	schedule, err := periodic.Parse(s.CronSpec)
+	if err != nil {
+		check.Err = fmt.Errorf("invalid %s %q: %v", FieldCronSpec, s.CronSpec, err)
+		return check
+	}
+	if !s.EndAt.IsZero() && !s.EndAt.After(now) {
+		check.Warnings = append(check.Warnings, fmt.Sprintf("%s is in the past, the schedule is expired", FieldEndAt))
+		return check
+	}
+	if s.RunsLeft > 0 && s.RunsLeft < count {
+		count = s.RunsLeft
+	}
+
+	// Ticks are computed from just before the start, so that a tick at the
+	// start is included, like the scheduler does.
+	t := now
+	if t.Before(s.StartAt) {
+		t = s.StartAt.Add(-time.Nanosecond)
+	}
+	for t = schedule.Next(t.In(loc)); !t.IsZero() && len(check.Next) < count; t = schedule.Next(t) {
+		if !s.EndAt.IsZero() && !t.Before(s.EndAt) {
+			break
+		}
+		check.Next = append(check.Next, t)
+	}
+
+	switch {
+	case len(check.Next) > 0:
+	case t.IsZero():
+		check.Warnings = append(check.Warnings, "never fires")
+	default:
+		check.Warnings = append(check.Warnings, fmt.Sprintf("no fire before %s", FieldEndAt))
+	}
+	if interval, ok := minInterval(schedule, now.In(loc)); ok {
+		limit, ok := opts.MinInterval[s.TaskType]
+		if !ok {
+			limit = opts.MinInterval[""]
+		}
+		if interval < limit {
+			check.Warnings = append(check.Warnings,
+				fmt.Sprintf("fires every %v, more often than every %v for %s", interval, limit, s.TaskType))
+		}
+	}
+	return check
+}
+
+// intervalTicks is the number of ticks minInterval looks at.
+const intervalTicks = 10
+
+// minInterval returns the shortest time between the next ticks of schedule
+// after now, and false if it fires less than twice.
+func minInterval(schedule cron.Schedule, now time.Time) (time.Duration, bool) {
+	prev := schedule.Next(now)
+	var shortest time.Duration
+	found := false
+	for i := 0; i < intervalTicks && !prev.IsZero(); i++ {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		if d := next.Sub(prev); !found || d < shortest {
+			shortest, found = d, true
+		}
+		prev = next
+	}
+	return shortest, found
+}
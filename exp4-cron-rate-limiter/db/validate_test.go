@@ -0,0 +1,61 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"exp1/db"
+)
+
+func TestValidateSchedules(t *testing.T) {
+	s := useMiniredis(t)
+	s.Set("schedule:event:start:0", "CRON_TZ=Asia/Tokyo 0 9 * * *")
+	s.Set("schedule:event:start:1", "@every 1s")
+	s.Set("schedule:event:start:2", "0 9 * * mon-fry")
+	s.Set("schedule:event:strat:0", "0 9 * * *")
+	s.Set("schedule:event:stop:0", "0 0 30 2 *")
+	s.HSet("schedule:event:stop:1", "cron_spec", "0 9 * * *", "start_at", "2024-03-05T00:00:00Z", "max_runs", "2")
+	s.HSet("schedule:event:stop:2", "cron_spec", "0 9 1 1 *", "end_at", "2024-06-01T00:00:00Z")
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	checks, err := db.ValidateSchedules(context.Background(), db.ValidateOpts{
+		Location:    time.UTC,
+		Now:         now,
+		Count:       3,
+		TaskTypes:   []string{"event:start", "event:stop"},
+		MinInterval: map[string]time.Duration{"event:start": 5 * time.Second},
+	})
+	if err != nil {
+		t.Fatalf("db.ValidateSchedules failed: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, c := range checks {
+		var next []string
+		for _, t := range c.Next {
+			next = append(next, t.Format(time.RFC3339))
+		}
+		got[c.Key] = fmt.Sprintf("err=%v next=%v warnings=%q", c.Err != nil, next, c.Warnings)
+	}
+	want := map[string]string{
+		// In the schedule's time zone.
+		"schedule:event:start:0": `err=false next=[2024-03-02T09:00:00+09:00 2024-03-03T09:00:00+09:00 2024-03-04T09:00:00+09:00] warnings=[]`,
+		"schedule:event:start:1": `err=false next=[2024-03-01T12:00:01Z 2024-03-01T12:00:02Z 2024-03-01T12:00:03Z] warnings=["fires every 1s, more often than every 5s for event:start"]`,
+		"schedule:event:start:2": `err=true next=[] warnings=[]`,
+		"schedule:event:strat:0": `err=true next=[] warnings=[]`,
+		"schedule:event:stop:0":  `err=false next=[] warnings=["never fires"]`,
+		// From start_at, and only the runs left.
+		"schedule:event:stop:1": `err=false next=[2024-03-05T09:00:00Z 2024-03-06T09:00:00Z] warnings=[]`,
+		"schedule:event:stop:2": `err=false next=[] warnings=["no fire before end_at"]`,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d checks, want %d", len(got), len(want))
+	}
+	for key, w := range want {
+		if got[key] != w {
+			t.Errorf("%s:\n got %s\nwant %s", key, got[key], w)
+		}
+	}
+}
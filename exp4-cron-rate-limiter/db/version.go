@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Writes to the schedules bump a version counter and publish the new version,
+// so that the scheduler reloads them right away, and only when they changed:
+//
+//	INCR schedules:version
+//	PUBLISH schedules:changed <version>
+//
+// Schedules written directly with redis-cli should be followed by
+// `schedulectl notify`, or are picked up by the scheduler's periodic reload.
+const (
+	versionKey     = "schedules:version"
+	changesChannel = "schedules:changed"
+)
+
+var bumpVersionCmd = redis.NewScript(`
+local version = redis.call("INCR", KEYS[1])
+redis.call("PUBLISH", ARGV[1], version)
+return version
+`)
+
+// BumpScheduleVersion marks the schedules as changed and notifies the
+// scheduler. It returns the new version.
+func BumpScheduleVersion(ctx context.Context) (int64, error) {
+	version, err := bumpVersionCmd.Run(ctx, client(), []string{versionKey}, changesChannel).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("bumpVersionCmd failed: %v", err)
+	}
+	return version, nil
+}
+
+// GetScheduleVersion returns the version of the schedules, 0 if they were
+// never bumped.
+func GetScheduleVersion(ctx context.Context) (int64, error) {
+	version, err := client().Get(ctx, versionKey).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("rdb.Get failed: %v", err)
+	}
+	return version, nil
+}
+
+// WatchScheduleChanges calls changed with the new version every time the
+// schedules are bumped, until ctx is done. Changes published while the
+// connection is down are lost: callers should also compare versions now and
+// then (see GetScheduleVersion).
+func WatchScheduleChanges(ctx context.Context, changed func(version int64)) error {
+	pubsub := client().Subscribe(ctx, changesChannel)
+	defer pubsub.Close()
+
+	// Wait for the subscription, so that no change after this point is missed.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("pubsub.Receive failed: %v", err)
+	}
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			version, _ := strconv.ParseInt(msg.Payload, 10, 64)
+			changed(version)
+		}
+	}
+}
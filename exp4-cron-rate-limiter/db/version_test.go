@@ -0,0 +1,65 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"exp1/db"
+)
+
+func TestScheduleVersion(t *testing.T) {
+	s := useMiniredis(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if version, err := db.GetScheduleVersion(ctx); err != nil || version != 0 {
+		t.Fatalf("initial version: got %d, %v, want 0", version, err)
+	}
+
+	changes := make(chan int64, 10)
+	watched := make(chan error, 1)
+	go func() {
+		watched <- db.WatchScheduleChanges(ctx, func(version int64) { changes <- version })
+	}()
+	// Wait for the subscription, or the first change could be missed.
+	waitFor(t, func() bool { return len(s.PubSubChannels("")) > 0 })
+
+	// Writes through the db package bump the version.
+	if err := db.PauseTarget(ctx, db.Target{TaskType: "event:start"}, "alice", ""); err != nil {
+		t.Fatalf("db.PauseTarget failed: %v", err)
+	}
+	if err := db.DeleteSchedule(ctx, "schedule:event:start:0"); err != nil {
+		t.Fatalf("db.DeleteSchedule failed: %v", err)
+	}
+	for _, want := range []int64{1, 2} {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Errorf("got change to version %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change to version %d", want)
+		}
+	}
+	if version, err := db.GetScheduleVersion(ctx); err != nil || version != 2 {
+		t.Errorf("version: got %d, %v, want 2", version, err)
+	}
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("WatchScheduleChanges failed: %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,72 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"exp1/health"
+)
+
+func TestReadyz(t *testing.T) {
+	h := health.NewHandler(time.Second)
+	var redis health.Status
+	h.AddReadinessCheck("redis", redis.Check)
+	h.AddReadinessCheck("sync", func(ctx context.Context) error { return nil })
+
+	get := func(path string) (int, map[string]any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("json.Unmarshal failed: %v", err)
+		}
+		return rec.Code, body
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: got %d, want %d", code, http.StatusOK)
+	}
+
+	// No probe result yet.
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before probe: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	redis.Set(nil)
+	if code, body := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz: got %d (%v), want %d", code, body, http.StatusOK)
+	}
+
+	redis.Set(errors.New("connection refused"))
+	code, body := get("/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after failed probe: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	checks, _ := body["checks"].(map[string]any)
+	if checks["redis"] != "connection refused" || checks["sync"] != "ok" {
+		t.Errorf("/readyz checks: got %v", checks)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("HEALTH_ADDR", ":9000")
+	t.Setenv("HEALTH_MAX_SYNC_AGE", "1m")
+	cfg, err := health.ConfigFromEnv(":8081")
+	if err != nil {
+		t.Fatalf("ConfigFromEnv failed: %v", err)
+	}
+	if cfg.Addr != ":9000" || cfg.MaxSyncAge != time.Minute || cfg.CheckTimeout != 2*time.Second {
+		t.Errorf("ConfigFromEnv: got %+v", cfg)
+	}
+
+	t.Setenv("HEALTH_CHECK_TIMEOUT", "soon")
+	if _, err := health.ConfigFromEnv(":8081"); err == nil {
+		t.Error("ConfigFromEnv accepted an invalid duration")
+	}
+}
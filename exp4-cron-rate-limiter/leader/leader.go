@@ -0,0 +1,151 @@
+package leader
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"exp1/db"
+
+	"github.com/google/uuid"
+	"github.com/lmittmann/tint"
+)
+
+// Metrics, served by expvar under /debug/vars.
+var (
+	isLeader         = expvar.NewInt("leader_is_leader")
+	leaderChanges    = expvar.NewInt("leader_changes_total")
+	leaderLastChange = expvar.NewString("leader_last_change")
+)
+
+// Elector runs a function only while it holds a Redis lease, so that a
+// single instance among several replicas is active at a time.
+//
+// The lease is renewed every TTL/3. A follower takes over at most TTL plus
+// TTL/3 after the leader stops renewing, e.g. because it died.
+type Elector struct {
+	name   string
+	id     string
+	ttl    time.Duration
+	log    *slog.Logger
+	leader atomic.Bool
+}
+
+// NewElector returns an Elector competing for the lease called name.
+func NewElector(log *slog.Logger, name string, ttl time.Duration) *Elector {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
+	}
+	id := fmt.Sprintf("%s:%d:%v", host, os.Getpid(), uuid.New())
+	return &Elector{
+		name: name,
+		id:   id,
+		ttl:  ttl,
+		log:  log.With(slog.String("name", "leader"), slog.String("lease", name), slog.String("holder", id)),
+	}
+}
+
+// IsLeader reports whether the elector currently holds the lease.
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run competes for the lease until ctx is cancelled. Every time the lease is
+// won, lead is started with a context that is cancelled when the lease is
+// lost or ctx is done; Run waits for lead to return before competing again.
+// If lead returns on its own, the lease is released so another instance can
+// take over.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context) error) error {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	var t *term
+	for {
+		ok, err := db.AcquireLease(ctx, e.name, e.id, e.ttl)
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			// Without a renewal we cannot tell whether another instance took over.
+			e.log.Error("could not renew lease", tint.Err(err))
+			t = e.stepDown(t, "lease renewal failed")
+		case !ok:
+			t = e.stepDown(t, "lease held by another instance")
+		case t == nil:
+			t = e.startTerm(ctx, lead)
+		}
+
+		var done <-chan struct{}
+		if t != nil {
+			done = t.done
+		}
+		select {
+		case <-ctx.Done():
+			e.stepDown(t, "shutting down")
+			e.release()
+			return nil
+		case <-done:
+			t = e.stepDown(t, "leader function returned")
+			e.release()
+		case <-ticker.C:
+		}
+	}
+}
+
+// term is a period during which the elector holds the lease.
+type term struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (e *Elector) startTerm(ctx context.Context, lead func(ctx context.Context) error) *term {
+	e.leader.Store(true)
+	e.setMetrics(true)
+	e.log.Info("acquired leadership")
+
+	ctx, cancel := context.WithCancel(ctx)
+	t := &term{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		if err := lead(ctx); err != nil {
+			e.log.Error("leader function failed", tint.Err(err))
+		}
+	}()
+	return t
+}
+
+// stepDown ends the term, if any, and waits for the leader function to return.
+func (e *Elector) stepDown(t *term, reason string) *term {
+	if t == nil {
+		return nil
+	}
+	t.cancel()
+	<-t.done
+	e.leader.Store(false)
+	e.setMetrics(false)
+	e.log.Warn("lost leadership", slog.String("reason", reason))
+	return nil
+}
+
+func (e *Elector) release() {
+	// The caller's context may already be cancelled, use a fresh one.
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+	if err := db.ReleaseLease(ctx, e.name, e.id); err != nil {
+		e.log.Error("could not release lease", tint.Err(err))
+	}
+}
+
+func (e *Elector) setMetrics(leader bool) {
+	if leader {
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
+	leaderChanges.Add(1)
+	leaderLastChange.Set(time.Now().Format(time.RFC3339))
+}
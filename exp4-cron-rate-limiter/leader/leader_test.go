@@ -0,0 +1,115 @@
+package leader_test
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"exp1/db"
+	"exp1/leader"
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const ttl = 300 * time.Millisecond
+
+func setup(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	return s
+}
+
+// start runs an elector whose leader function counts how many instances lead at once.
+func start(ctx context.Context, leaders *atomic.Int32) (*leader.Elector, <-chan error) {
+	e := leader.NewElector(tasks.Logger(io.Discard, ""), "test", ttl)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Run(ctx, func(ctx context.Context) error {
+			leaders.Add(1)
+			defer leaders.Add(-1)
+			<-ctx.Done()
+			return nil
+		})
+	}()
+	return e, done
+}
+
+func TestSingleLeaderAndTakeover(t *testing.T) {
+	setup(t)
+	var leaders atomic.Int32
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	defer stopA()
+	a, doneA := start(ctxA, &leaders)
+	waitFor(t, a.IsLeader)
+
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	b, doneB := start(ctxB, &leaders)
+	time.Sleep(2 * ttl)
+	if b.IsLeader() || leaders.Load() != 1 {
+		t.Fatalf("got %d leaders, want 1", leaders.Load())
+	}
+
+	// The leader shuts down and releases the lease.
+	stopA()
+	<-doneA
+	waitFor(t, b.IsLeader)
+	if leaders.Load() != 1 {
+		t.Fatalf("got %d leaders, want 1", leaders.Load())
+	}
+
+	stopB()
+	<-doneB
+	if leaders.Load() != 0 {
+		t.Fatalf("got %d leaders after shutdown, want 0", leaders.Load())
+	}
+}
+
+func TestTakeoverAfterLeaderDies(t *testing.T) {
+	s := setup(t)
+	var leaders atomic.Int32
+
+	// A leader that died without releasing its lease.
+	if ok, err := db.AcquireLease(context.Background(), "test", "dead", ttl); err != nil || !ok {
+		t.Fatalf("db.AcquireLease: got %v, %v", ok, err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	e, done := start(ctx, &leaders)
+	time.Sleep(2 * ttl)
+	if e.IsLeader() {
+		t.Fatal("took over a lease that has not expired")
+	}
+
+	s.FastForward(ttl)
+	waitFor(t, e.IsLeader)
+
+	// The lease is taken away, e.g. after a network partition.
+	s.Set("lease:test", "other")
+	waitFor(t, func() bool { return !e.IsLeader() })
+	if leaders.Load() != 0 {
+		t.Fatalf("got %d leaders after losing the lease, want 0", leaders.Load())
+	}
+
+	stop()
+	<-done
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
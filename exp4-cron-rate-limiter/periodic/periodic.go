@@ -0,0 +1,544 @@
+// Package periodic enqueues the tasks of an asynq.PeriodicTaskConfigProvider
+// like asynq.PeriodicTaskManager, but at most once per tick.
+//
+// asynq's scheduler cannot do that: the options of an entry, including its
+// task ID, are fixed when the entry is registered, its enqueue hooks are not
+// given the fire time, and its "@every" ticks depend on when the entry was
+// registered, so replicas and restarted schedulers fire at different times.
+// asynq.Unique does not close the gap either, as its lock is released as soon
+// as the task completes. Manager derives the task ID of every fire from the
+// config and the tick instead, and aligns the ticks (see Parse).
+//
+// The entries asynq.Inspector lists for asynq's scheduler are listed by
+// Manager.Entries.
+package periodic
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/lmittmann/tint"
+	"github.com/robfig/cron/v3"
+)
+
+// Manager keeps periodic tasks in sync with the configs returned by a
+// provider, like asynq.PeriodicTaskManager, but every fire is enqueued with a
+// task ID derived from the config and the scheduled fire time:
+//
+//	periodic:<config hash>:<fire time in unix seconds>
+//
+// The enqueued task is retained after it completes, so when the same tick is
+// fired twice (by two replicas, or around a restart) the second enqueue
+// conflicts with the first and is dropped.
+type Manager struct {
+	client       *asynq.Client
+	provider     asynq.PeriodicTaskConfigProvider
+	location     *time.Location
+	syncInterval time.Duration
+	retention    time.Duration
+	preEnqueue   func(f Fire)
+	postEnqueue  func(f Fire)
+	log          *slog.Logger
+
+	done    chan struct{}
+	trigger chan struct{} // see Sync
+	wg      sync.WaitGroup
+
+	// guards entries
+	mu      sync.Mutex
+	entries map[string]*entry // by config hash
+}
+
+type ManagerOpts struct {
+	// Required: must be non nil
+	RedisConnOpt asynq.RedisConnOpt
+
+	// Required: must be non nil
+	PeriodicTaskConfigProvider asynq.PeriodicTaskConfigProvider
+
+	// Optional: default is 3m. Call Sync to sync sooner.
+	SyncInterval time.Duration
+
+	// Optional: time zone of cron specs without a CRON_TZ= prefix, default is UTC
+	Location *time.Location
+
+	// Optional: how long an enqueued task is kept after completion so that a
+	// duplicate fire of the same tick is rejected, default is 1h
+	Retention time.Duration
+
+	// Optional: called before every enqueue attempt, like the PreEnqueueFunc
+	// of asynq.SchedulerOpts but with the fire time and task ID.
+	PreEnqueueFunc func(f Fire)
+
+	// Optional: called after every enqueue attempt, like the PostEnqueueFunc
+	// of asynq.SchedulerOpts but with the fire time and task ID.
+	PostEnqueueFunc func(f Fire)
+
+	// Optional: default discards logs
+	Logger *slog.Logger
+}
+
+const (
+	defaultSyncInterval = 3 * time.Minute
+	defaultRetention    = time.Hour
+)
+
+// NewManager returns a new Manager.
+// The given opts should specify the RedisConnOpt and PeriodicTaskConfigProvider at minimum.
+func NewManager(opts ManagerOpts) (*Manager, error) {
+	if opts.PeriodicTaskConfigProvider == nil {
+		return nil, fmt.Errorf("PeriodicTaskConfigProvider cannot be nil")
+	}
+	if opts.RedisConnOpt == nil {
+		return nil, fmt.Errorf("RedisConnOpt cannot be nil")
+	}
+	m := &Manager{
+		client:       asynq.NewClient(opts.RedisConnOpt),
+		provider:     opts.PeriodicTaskConfigProvider,
+		location:     opts.Location,
+		syncInterval: opts.SyncInterval,
+		retention:    opts.Retention,
+		preEnqueue:   opts.PreEnqueueFunc,
+		postEnqueue:  opts.PostEnqueueFunc,
+		log:          opts.Logger,
+		done:         make(chan struct{}),
+		trigger:      make(chan struct{}, 1),
+		entries:      make(map[string]*entry),
+	}
+	if m.location == nil {
+		m.location = time.UTC
+	}
+	if m.syncInterval == 0 {
+		m.syncInterval = defaultSyncInterval
+	}
+	if m.retention == 0 {
+		m.retention = defaultRetention
+	}
+	if m.log == nil {
+		m.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	m.log = m.log.With(slog.String("name", "periodic_manager"))
+	return m, nil
+}
+
+// Start registers the configs returned by the provider and starts a
+// background goroutine that syncs them every SyncInterval.
+//
+// Start returns any error encountered at start up time.
+func (m *Manager) Start() error {
+	configs, err := m.provider.GetConfigs()
+	if err != nil {
+		return fmt.Errorf("initial call to GetConfigs failed: %v", err)
+	}
+	m.apply(configs)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+				m.sync()
+			case <-m.trigger:
+				m.sync()
+			}
+		}
+	}()
+	return nil
+}
+
+// Sync asks the manager to sync with the provider now rather than at the next
+// SyncInterval tick, and returns without waiting for it. Calls made while a
+// sync is pending are merged into it.
+func (m *Manager) Sync() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Shutdown stops the sync goroutine and all entries, and closes the client.
+func (m *Manager) Shutdown() {
+	close(m.done)
+	m.wg.Wait()
+	m.client.Close()
+}
+
+func (m *Manager) sync() {
+	configs, err := m.provider.GetConfigs()
+	if err != nil {
+		m.log.Error("could not get periodic task configs", tint.Err(err))
+		return
+	}
+	m.apply(configs)
+}
+
+// apply starts entries for new configs and stops entries whose config is gone.
+func (m *Manager) apply(configs []*asynq.PeriodicTaskConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, c := range configs {
+		key := hash(c)
+		seen[key] = true
+		if _, ok := m.entries[key]; ok {
+			continue
+		}
+		schedule, err := Parse(c.Cronspec)
+		if err != nil {
+			m.log.Error("could not register periodic task", slog.String("cron_spec", c.Cronspec), tint.Err(err))
+			continue
+		}
+		e := &entry{key: key, config: c, schedule: schedule, stop: make(chan struct{})}
+		for _, opt := range c.Opts {
+			if w, ok := opt.(windowOption); ok {
+				e.window = w
+			}
+		}
+		m.entries[key] = e
+		m.wg.Add(1)
+		go m.run(e)
+		m.log.Debug("registered periodic task", slog.String("key", key), slog.String("cron_spec", c.Cronspec),
+			slog.String("task_type", c.Task.Type()))
+	}
+	for key, e := range m.entries {
+		if seen[key] {
+			continue
+		}
+		close(e.stop)
+		delete(m.entries, key)
+		m.log.Debug("unregistered periodic task", slog.String("key", key), slog.String("cron_spec", e.config.Cronspec),
+			slog.String("task_type", e.config.Task.Type()))
+	}
+}
+
+type entry struct {
+	key      string
+	config   *asynq.PeriodicTaskConfig
+	schedule cron.Schedule
+	window   windowOption
+	stop     chan struct{}
+	prev     atomic.Int64 // unix nanoseconds of the last tick fired, 0 if none
+}
+
+// Entry is a registered periodic task, like the asynq.SchedulerEntry of
+// asynq's scheduler.
+type Entry struct {
+	ID       string // prefix of the task IDs of its fires, see Fire
+	Spec     string // cron spec
+	TaskType string
+	Opts     []string  // task options
+	Next     time.Time // next tick, zero once its window ended
+	Prev     time.Time // last tick fired, zero if none yet
+}
+
+// Entries returns the registered periodic tasks, sorted by ID.
+func (m *Manager) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	entries := make([]Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entry := Entry{ID: entryID(e.key), Spec: e.config.Cronspec, TaskType: e.config.Task.Type()}
+		for _, opt := range e.config.Opts {
+			entry.Opts = append(entry.Opts, opt.String())
+		}
+		if next, ok := e.next(now, m.location); ok {
+			entry.Next = next
+		}
+		if prev := e.prev.Load(); prev != 0 {
+			entry.Prev = time.Unix(0, prev)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// next returns the first tick of the entry after now, and false if there is
+// none left in its window.
+func (e *entry) next(now time.Time, loc *time.Location) (time.Time, bool) {
+	if now.Before(e.window.start) {
+		// ticks are strictly after the given time, and start is included
+		now = e.window.start.Add(-time.Nanosecond)
+	}
+	next := e.schedule.Next(now.In(loc))
+	if !e.window.end.IsZero() && !next.Before(e.window.end) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// run fires the entry at every tick of its schedule until it is stopped or
+// its window ends.
+func (m *Manager) run(e *entry) {
+	defer m.wg.Done()
+	for {
+		next, ok := e.next(time.Now(), m.location)
+		if !ok {
+			m.log.Debug("periodic task window ended", slog.String("key", e.key), slog.Time("end", e.window.end))
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-m.done:
+			timer.Stop()
+			return
+		case <-e.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			m.fire(e, next)
+			e.prev.Store(next.UnixNano())
+		}
+	}
+}
+
+// fire enqueues the task of the entry for the tick scheduled at at.
+func (m *Manager) fire(e *entry, at time.Time) {
+	id := taskID(e.key, at)
+	// Options from the config come after the retention so that they can override it.
+	opts := []asynq.Option{asynq.Retention(m.retention)}
+	for _, opt := range e.config.Opts {
+		if _, ok := opt.(windowOption); !ok {
+			opts = append(opts, opt)
+		}
+	}
+	opts = append(opts, asynq.TaskID(id))
+
+	if m.preEnqueue != nil {
+		m.preEnqueue(Fire{At: at, TaskID: id, Task: e.config.Task})
+	}
+	info, err := m.client.Enqueue(e.config.Task, opts...)
+	if m.postEnqueue != nil {
+		m.postEnqueue(Fire{At: at, TaskID: id, Task: e.config.Task, Info: info, Err: err})
+	}
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		m.log.Debug("tick already enqueued", slog.String("id", id), slog.Time("fire_time", at))
+		return
+	}
+	if err != nil {
+		m.log.Error("could not enqueue periodic task", slog.String("id", id), slog.Time("fire_time", at), tint.Err(err))
+		return
+	}
+	m.log.Debug("enqueued periodic task", slog.String("id", info.ID), slog.String("queue", info.Queue),
+		slog.String("task_type", info.Type), slog.Time("fire_time", at))
+}
+
+// Fire is an enqueue attempt of a periodic task, passed to the enqueue hooks.
+type Fire struct {
+	At     time.Time // scheduled fire time
+	TaskID string
+	Task   *asynq.Task
+
+	// Set after the attempt only: Info is nil if the task was not enqueued,
+	// and Err is asynq.ErrTaskIDConflict for a tick that already was.
+	Info *asynq.TaskInfo
+	Err  error
+}
+
+// windowOpt is the type of the Window option. asynq ignores option types it
+// does not know, but the Manager strips the option before enqueueing anyway.
+const windowOpt asynq.OptionType = -1
+
+type windowOption struct{ start, end time.Time }
+
+// Window limits the ticks of a periodic task to the ones at or after start
+// and before end. A zero start or end leaves that side of the window open.
+func Window(start, end time.Time) asynq.Option {
+	return windowOption{start: start, end: end}
+}
+
+func (o windowOption) String() string {
+	return fmt.Sprintf("Window(%s, %s)", o.start.Format(time.RFC3339Nano), o.end.Format(time.RFC3339Nano))
+}
+func (o windowOption) Type() asynq.OptionType { return windowOpt }
+func (o windowOption) Value() interface{}     { return o }
+
+// TaskID returns the task ID that a manager enqueues the tick at at of
+// config with, so that other enqueues of the same tick conflict with it.
+func TaskID(config *asynq.PeriodicTaskConfig, at time.Time) string {
+	return taskID(hash(config), at)
+}
+
+func taskID(key string, at time.Time) string {
+	return fmt.Sprintf("%s:%d", entryID(key), at.Unix())
+}
+
+func entryID(key string) string {
+	return "periodic:" + key[:16]
+}
+
+// hash identifies a config by its cron spec, task and options.
+func hash(c *asynq.PeriodicTaskConfig) string {
+	h := sha256.New()
+	io.WriteString(h, c.Cronspec)
+	io.WriteString(h, c.Task.Type())
+	h.Write(c.Task.Payload())
+	opts := make([]string, 0, len(c.Opts))
+	for _, opt := range c.Opts {
+		opts = append(opts, opt.String())
+	}
+	sort.Strings(opts)
+	for _, opt := range opts {
+		io.WriteString(h, opt)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Parse parses a cron spec with the parser asynq uses, including the
+// CRON_TZ=<IANA name> prefix, with two differences:
+//
+// "@every <duration>" ticks are aligned to multiples of the duration rather
+// than to the time the entry was registered. This way every scheduler
+// instance, before and after a restart, computes the same fire times. The
+// time zone of such a spec is checked but does not change its ticks.
+//
+// Specs with fixed hours follow the time zone's wall clock across DST
+// transitions like cron does (see dstSchedule).
+func Parse(spec string) (cron.Schedule, error) {
+	every, err := trimTimezone(spec)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := strings.CutPrefix(every, "@every "); ok {
+		every, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration %s: %v", spec, err)
+		}
+		if every < time.Second {
+			return nil, fmt.Errorf("@every duration must be at least 1s: %s", spec)
+		}
+		return alignedEvery(every.Truncate(time.Second)), nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := schedule.(*cron.SpecSchedule); ok && s.Hour&everyHour != everyHour {
+		return dstSchedule{s}, nil
+	}
+	return schedule, nil
+}
+
+// trimTimezone returns spec without its CRON_TZ= or TZ= prefix, after
+// checking that the time zone exists.
+func trimTimezone(spec string) (string, error) {
+	for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+		rest, ok := strings.CutPrefix(spec, prefix)
+		if !ok {
+			continue
+		}
+		name, rest, ok := strings.Cut(rest, " ")
+		if !ok {
+			return "", fmt.Errorf("missing spec after time zone: %s", spec)
+		}
+		if _, err := time.LoadLocation(name); err != nil {
+			return "", fmt.Errorf("provided bad location %s: %v", name, err)
+		}
+		return strings.TrimSpace(rest), nil
+	}
+	return spec, nil
+}
+
+// alignedEvery fires at every multiple of the duration since the zero time.
+type alignedEvery time.Duration
+
+func (d alignedEvery) Next(t time.Time) time.Time {
+	return t.Truncate(time.Duration(d)).Add(time.Duration(d))
+}
+
+// everyHour is the hour bits of a spec matching every hour of the day.
+const everyHour = 1<<24 - 1
+
+// dstSchedule defines what a spec with fixed hours does when the clocks
+// change in its time zone:
+//
+//   - wall times skipped when the clocks go forward fire once, at the
+//     transition: "30 2 * * *" in America/New_York fires at 03:00 EDT on the
+//     day the clocks go from 02:00 to 03:00;
+//   - wall times repeated when the clocks go back fire once, at their first
+//     occurrence: "30 1 * * *" fires at 01:30 EDT but not at 01:30 EST.
+//
+// Specs matching every hour are not wrapped: they fire by elapsed time, in
+// every hour that exists.
+type dstSchedule struct {
+	*cron.SpecSchedule
+}
+
+func (s dstSchedule) Next(t time.Time) time.Time {
+	loc := s.Location
+	if loc == time.Local {
+		loc = t.Location()
+	}
+	t = t.In(loc)
+	n := s.SpecSchedule.Next(t)
+	if n.IsZero() {
+		return n
+	}
+	if tr, gap, ok := transition(t, n); ok && gap > 0 && tr.After(t) && s.matchesWall(tr.Add(-time.Nanosecond), gap) {
+		return tr
+	}
+	if repeated(n) {
+		return s.Next(n)
+	}
+	return n
+}
+
+// matchesWall reports whether the spec matches a wall time in the gap that
+// starts right after before.
+func (s dstSchedule) matchesWall(before time.Time, gap time.Duration) bool {
+	wall := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	}
+	utc := *s.SpecSchedule
+	utc.Location = time.UTC
+	start := wall(before).Truncate(time.Second).Add(time.Second)
+	return utc.Next(start.Add(-time.Second)).Before(start.Add(gap))
+}
+
+// transition finds the instant the UTC offset changes between from and to,
+// and by how much it changes. It only looks at the offsets at both ends.
+func transition(from, to time.Time) (time.Time, time.Duration, bool) {
+	_, before := from.Zone()
+	_, after := to.Zone()
+	if before == after {
+		return time.Time{}, 0, false
+	}
+	lo, hi := from, to
+	for hi.Sub(lo) > time.Second {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		if _, offset := mid.Zone(); offset == before {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi.Truncate(time.Second), time.Duration(after-before) * time.Second, true
+}
+
+// repeated reports whether the wall time of t already occurred before the
+// clocks went back.
+func repeated(t time.Time) bool {
+	_, now := t.Zone()
+	_, earlier := t.Add(-3 * time.Hour).Zone()
+	if earlier <= now {
+		return false
+	}
+	first := t.Add(-time.Duration(earlier-now) * time.Second)
+	return first.Format(time.DateTime) == t.Format(time.DateTime)
+}
@@ -0,0 +1,403 @@
+package periodic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestParseAlignsEvery(t *testing.T) {
+	s, err := Parse("@every 5s")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// Instances started at different times agree on the ticks.
+	for _, start := range []time.Duration{0, 1 * time.Second, 4*time.Second + 999*time.Millisecond} {
+		if got, want := s.Next(base.Add(start)), base.Add(5*time.Second); !got.Equal(want) {
+			t.Errorf("Next(%v): got %v, want %v", base.Add(start), got, want)
+		}
+	}
+
+	// A time zone does not change the ticks of @every.
+	for _, spec := range []string{"CRON_TZ=Europe/Paris @every 5s", "TZ=America/New_York @every 5s"} {
+		s, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", spec, err)
+		}
+		if got, want := s.Next(base.Add(time.Second)), base.Add(5*time.Second); !got.Equal(want) {
+			t.Errorf("Next with %s: got %v, want %v", spec, got, want)
+		}
+	}
+
+	for _, spec := range []string{"@every 500ms", "@every soon", "* * *", "CRON_TZ=Mars/Olympus_Mons @every 5s", "CRON_TZ=Europe/Paris"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestEntryWindow(t *testing.T) {
+	schedule, err := Parse("@every 10s")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	e := &entry{schedule: schedule, window: windowOption{start: base.Add(time.Minute), end: base.Add(2 * time.Minute)}}
+
+	for _, tc := range []struct {
+		now  time.Time
+		want time.Time // zero when the window has ended
+	}{
+		{now: base, want: base.Add(time.Minute)}, // start is included
+		{now: base.Add(time.Minute), want: base.Add(time.Minute + 10*time.Second)},
+		{now: base.Add(time.Minute + 45*time.Second), want: base.Add(time.Minute + 50*time.Second)},
+		{now: base.Add(time.Minute + 50*time.Second)}, // end is excluded
+		{now: base.Add(time.Hour)},
+	} {
+		got, ok := e.next(tc.now, time.UTC)
+		if ok != !tc.want.IsZero() || !got.Equal(tc.want) {
+			t.Errorf("next(%v): got %v, %v, want %v", tc.now, got, ok, tc.want)
+		}
+	}
+}
+
+type staticProvider []*asynq.PeriodicTaskConfig
+
+func (p staticProvider) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) { return p, nil }
+
+type countingProvider chan struct{}
+
+func (p countingProvider) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
+	p <- struct{}{}
+	return nil, nil
+}
+
+func TestSyncTriggersSync(t *testing.T) {
+	s := miniredis.RunT(t)
+	calls := make(countingProvider, 10)
+	m, err := NewManager(ManagerOpts{
+		RedisConnOpt:               asynq.RedisClientOpt{Addr: s.Addr()},
+		PeriodicTaskConfigProvider: calls,
+		SyncInterval:               time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Shutdown()
+	<-calls
+
+	m.Sync()
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not call GetConfigs")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	s := miniredis.RunT(t)
+	config := &asynq.PeriodicTaskConfig{
+		Cronspec: "@every 1h",
+		Task:     asynq.NewTask("event:start", []byte(`{"IDs":["0"]}`)),
+		Opts:     []asynq.Option{asynq.Queue("cron")},
+	}
+	m, err := NewManager(ManagerOpts{
+		RedisConnOpt:               asynq.RedisClientOpt{Addr: s.Addr()},
+		PeriodicTaskConfigProvider: staticProvider{config},
+	})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer m.Shutdown()
+
+	entries := m.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	next := time.Now().Truncate(time.Hour).Add(time.Hour)
+	if e.ID != entryID(hash(config)) || e.Spec != "@every 1h" || e.TaskType != "event:start" ||
+		len(e.Opts) != 1 || !e.Next.Equal(next) || !e.Prev.IsZero() {
+		t.Errorf("got entry %+v, want the next tick at %v", e, next)
+	}
+}
+
+func TestFireIsDeduplicated(t *testing.T) {
+	s := miniredis.RunT(t)
+	redisOpt := asynq.RedisClientOpt{Addr: s.Addr()}
+
+	config := &asynq.PeriodicTaskConfig{
+		Cronspec: "@every 5s",
+		Task:     asynq.NewTask("event:start", []byte(`{"IDs":["0"]}`)),
+		Opts:     []asynq.Option{asynq.Queue("cron")},
+	}
+	newEntry := func() (*Manager, *entry) {
+		m, err := NewManager(ManagerOpts{RedisConnOpt: redisOpt, PeriodicTaskConfigProvider: staticProvider{config}})
+		if err != nil {
+			t.Fatalf("NewManager failed: %v", err)
+		}
+		t.Cleanup(func() { m.client.Close() })
+		schedule, err := Parse(config.Cronspec)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		return m, &entry{key: hash(config), config: config, schedule: schedule}
+	}
+
+	processed := make(chan string, 10)
+	srv := asynq.NewServer(redisOpt, asynq.Config{Queues: map[string]int{"cron": 1}, LogLevel: asynq.FatalLevel})
+	if err := srv.Start(asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		id, _ := asynq.GetTaskID(ctx)
+		processed <- id
+		return nil
+	})); err != nil {
+		t.Fatalf("srv.Start failed: %v", err)
+	}
+	defer srv.Shutdown()
+
+	tick := time.Now().Truncate(5 * time.Second)
+	// Two replicas, or the same scheduler before and after a restart.
+	first, a := newEntry()
+	second, b := newEntry()
+
+	first.fire(a, tick)
+	select {
+	case <-processed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("task was not processed")
+	}
+	// The tick is rejected even after the first task completed.
+	second.fire(b, tick)
+	second.fire(b, tick.Add(5*time.Second))
+
+	var ids []string
+	timeout := time.After(3 * time.Second)
+	for len(ids) < 2 {
+		select {
+		case id := <-processed:
+			ids = append(ids, id)
+		case <-timeout:
+			if want := taskID(b.key, tick.Add(5*time.Second)); len(ids) != 1 || ids[0] != want {
+				t.Fatalf("got tasks %v after duplicate fires, want only %s", ids, want)
+			}
+			return
+		}
+	}
+	t.Fatalf("duplicate tick was processed: %v", ids)
+}
+
+// configsProvider returns the configs it is set to.
+type configsProvider struct {
+	mu      sync.Mutex
+	configs []*asynq.PeriodicTaskConfig
+}
+
+func (p *configsProvider) set(configs ...*asynq.PeriodicTaskConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configs = configs
+}
+
+func (p *configsProvider) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.configs, nil
+}
+
+func TestManagerTickLoop(t *testing.T) {
+	s := miniredis.RunT(t)
+	start := time.Now()
+	windowEnd := start.Truncate(time.Second).Add(3 * time.Second)
+	windowed := &asynq.PeriodicTaskConfig{
+		Cronspec: "@every 1s",
+		Task:     asynq.NewTask("event:start", []byte(`{"IDs":["0"]}`)),
+		Opts:     []asynq.Option{asynq.Queue("cron"), Window(time.Time{}, windowEnd)},
+	}
+	removed := &asynq.PeriodicTaskConfig{
+		Cronspec: "@every 1s",
+		Task:     asynq.NewTask("event:stop", []byte(`{"IDs":["0"]}`)),
+		Opts:     []asynq.Option{asynq.Queue("cron")},
+	}
+	provider := &configsProvider{}
+	provider.set(windowed, removed)
+
+	var mu sync.Mutex
+	enqueued := make(map[string][]time.Time) // by task type
+	conflicts := 0
+	postEnqueue := func(f Fire) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case errors.Is(f.Err, asynq.ErrTaskIDConflict):
+			conflicts++
+		case f.Err != nil:
+			t.Errorf("enqueue of %s failed: %v", f.TaskID, f.Err)
+		default:
+			enqueued[f.Task.Type()] = append(enqueued[f.Task.Type()], f.At)
+		}
+	}
+	// Two replicas fire the same ticks.
+	var managers []*Manager
+	for i := 0; i < 2; i++ {
+		m, err := NewManager(ManagerOpts{
+			RedisConnOpt:               asynq.RedisClientOpt{Addr: s.Addr()},
+			PeriodicTaskConfigProvider: provider,
+			SyncInterval:               time.Hour,
+			PostEnqueueFunc:            postEnqueue,
+		})
+		if err != nil {
+			t.Fatalf("NewManager failed: %v", err)
+		}
+		if err := m.Start(); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		defer m.Shutdown()
+		managers = append(managers, m)
+	}
+
+	// The windowed entry fires every second until its window ends, once per tick.
+	time.Sleep(time.Until(windowEnd.Add(1500 * time.Millisecond)))
+	mu.Lock()
+	ticks := enqueued["event:start"]
+	mu.Unlock()
+	var want []time.Time
+	for tick := start.Truncate(time.Second).Add(time.Second); tick.Before(windowEnd); tick = tick.Add(time.Second) {
+		want = append(want, tick)
+	}
+	if len(ticks) != len(want) {
+		t.Fatalf("got ticks %v, want %v", ticks, want)
+	}
+	for i := range want {
+		if !ticks[i].Equal(want[i]) {
+			t.Errorf("tick %d: got %v, want %v", i, ticks[i], want[i])
+		}
+		id := TaskID(windowed, want[i])
+		if _, err := asynq.NewInspector(asynq.RedisClientOpt{Addr: s.Addr()}).GetTaskInfo("cron", id); err != nil {
+			t.Errorf("tick %d: task %s not found: %v", i, id, err)
+		}
+	}
+	mu.Lock()
+	if n := len(enqueued["event:start"]) + len(enqueued["event:stop"]); conflicts != n {
+		t.Errorf("got %d conflicts for %d ticks, want the other replica's fire of every tick", conflicts, n)
+	}
+	mu.Unlock()
+	for _, e := range managers[0].Entries() {
+		if e.TaskType == "event:start" && (!e.Prev.Equal(want[len(want)-1]) || !e.Next.IsZero()) {
+			t.Errorf("got entry %+v, want the last tick and no next one", e)
+		}
+	}
+
+	// An entry whose config is gone stops firing.
+	provider.set(windowed)
+	for _, m := range managers {
+		m.Sync()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(managers[0].Entries()) != 1 || len(managers[1].Entries()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the removed config is still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	stops := len(enqueued["event:stop"])
+	mu.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if stops == 0 || len(enqueued["event:stop"]) != stops {
+		t.Errorf("got %d fires of the removed config, then %d, want some then none", stops, len(enqueued["event:stop"]))
+	}
+}
+
+func TestParseDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("time.LoadLocation failed: %v", err)
+	}
+	// 2024-03-10: 02:00 EST -> 03:00 EDT, 2024-11-03: 02:00 EDT -> 01:00 EST
+	springEve := time.Date(2024, 3, 9, 12, 0, 0, 0, ny)
+	fallEve := time.Date(2024, 11, 2, 12, 0, 0, 0, ny)
+
+	for _, tc := range []struct {
+		name  string
+		spec  string
+		start time.Time
+		want  []string // fire times in UTC
+	}{
+		{
+			name:  "skipped wall time fires at the transition",
+			spec:  "CRON_TZ=America/New_York 30 2 * * *",
+			start: springEve,
+			want:  []string{"2024-03-10 07:00:00", "2024-03-11 06:30:00"},
+		},
+		{
+			name:  "wall time before the gap is unchanged",
+			spec:  "CRON_TZ=America/New_York 30 1 * * *",
+			start: springEve,
+			want:  []string{"2024-03-10 06:30:00", "2024-03-11 05:30:00"},
+		},
+		{
+			name:  "skipped wall times fire once",
+			spec:  "CRON_TZ=America/New_York */30 1-3 * * *",
+			start: springEve,
+			want:  []string{"2024-03-10 06:00:00", "2024-03-10 06:30:00", "2024-03-10 07:00:00", "2024-03-10 07:30:00"},
+		},
+		{
+			name:  "repeated wall time fires once",
+			spec:  "CRON_TZ=America/New_York 30 1 * * *",
+			start: fallEve,
+			want:  []string{"2024-11-03 05:30:00", "2024-11-04 06:30:00"},
+		},
+		{
+			name:  "repeated wall times fire once",
+			spec:  "CRON_TZ=America/New_York 0,30 1-2 * * *",
+			start: fallEve,
+			want:  []string{"2024-11-03 05:00:00", "2024-11-03 05:30:00", "2024-11-03 07:00:00", "2024-11-03 07:30:00"},
+		},
+		{
+			name:  "every hour fires by elapsed time",
+			spec:  "CRON_TZ=America/New_York 0 * * * *",
+			start: time.Date(2024, 11, 3, 0, 30, 0, 0, ny),
+			want:  []string{"2024-11-03 05:00:00", "2024-11-03 06:00:00", "2024-11-03 07:00:00"},
+		},
+		{
+			name:  "location of the start time without CRON_TZ",
+			spec:  "30 2 * * *",
+			start: springEve,
+			want:  []string{"2024-03-10 07:00:00", "2024-03-11 06:30:00"},
+		},
+		{
+			name:  "other time zone",
+			spec:  "CRON_TZ=Europe/Paris 30 2 * * *", // 2024-03-31: 02:00 CET -> 03:00 CEST
+			start: time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC),
+			want:  []string{"2024-03-31 01:00:00", "2024-04-01 00:30:00"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Parse(tc.spec)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			next := tc.start
+			for i, want := range tc.want {
+				next = s.Next(next)
+				if got := next.UTC().Format(time.DateTime); got != want {
+					t.Fatalf("fire %d: got %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
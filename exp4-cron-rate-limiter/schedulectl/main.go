@@ -0,0 +1,575 @@
+// Command schedulectl manages the schedules stored in Redis.
+//
+//	schedulectl pause -type event:start [-id 0] [-by alice] [-reason maintenance]
+//	schedulectl resume -type event:start [-id 0] [-by alice]
+//	schedulectl paused
+//	schedulectl audit [-n 20]
+//	schedulectl notify
+//	schedulectl history -type event:stop -id 7 [-since 24h | -from 2024-03-01T00:00:00Z] [-to ...]
+//	schedulectl validate [-n 5] [-tz America/New_York] [-min-interval event:start=1m] [-strict] [-l team=aws]
+//	schedulectl import -f schedules.yaml [-apply] [-prune]
+//	schedulectl export [-format yaml|json] [-o schedules.yaml] [-l team=aws]
+//
+// The Redis address is read from REDIS_ADDR, like the scheduler.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `usage: schedulectl <command> [flags]
+
+commands:
+  pause    pause a task type, or one schedule with -id
+  resume   resume a task type, or one schedule with -id
+  paused   list paused task types and schedules
+  audit    show the last pause and resume actions
+  notify   tell the scheduler that schedules were changed with redis-cli
+  history  show the fires of a schedule and their outcome
+  validate check the stored schedules and show their next fire times
+  import   show or apply the changes that make the schedules match a manifest
+  export   write the stored schedules as a manifest
+
+Run schedulectl <command> -h for the flags of a command.
+`
+
+var (
+	errUsage   = errors.New("invalid usage")
+	errInvalid = errors.New("invalid schedules")
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	db.Close()
+	if errors.Is(err, errUsage) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "schedulectl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+	switch args[0] {
+	case "pause":
+		return pause(ctx, args[1:], stdout, stderr)
+	case "resume":
+		return resume(ctx, args[1:], stdout, stderr)
+	case "paused":
+		return paused(ctx, args[1:], stdout, stderr)
+	case "audit":
+		return audit(ctx, args[1:], stdout, stderr)
+	case "notify":
+		return notify(ctx, args[1:], stdout, stderr)
+	case "history":
+		return history(ctx, args[1:], stdout, stderr)
+	case "validate":
+		return validate(ctx, args[1:], stdout, stderr)
+	case "import":
+		return importManifest(ctx, args[1:], stdout, stderr)
+	case "export":
+		return exportManifest(ctx, args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return errUsage
+	}
+}
+
+// newFlagSet returns a flag set for a command that reports errors to stderr.
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("schedulectl "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parse parses the flags of a command, and rejects positional arguments.
+func parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// targetFlags adds the -type and -id flags to fs.
+func targetFlags(fs *flag.FlagSet) *db.Target {
+	var target db.Target
+	fs.StringVar(&target.TaskType, "type", "", "task type, e.g. event:start (required)")
+	fs.StringVar(&target.ID, "id", "", "schedule id, to pause a single schedule of the task type")
+	return &target
+}
+
+// selectorFlag adds the -l flag, a label selector like the scheduler's
+// SCHEDULE_SELECTOR.
+func selectorFlag(fs *flag.FlagSet) *string {
+	return fs.String("l", "", "only the schedules with these labels, as key=value[,key=value]")
+}
+
+// defaultBy identifies the user running the command in audit records.
+func defaultBy() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	if host, err := os.Hostname(); err == nil {
+		return user + "@" + host
+	}
+	return user
+}
+
+func pause(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("pause", stderr)
+	target := targetFlags(fs)
+	by := fs.String("by", defaultBy(), "who is pausing, for the audit record (informational, not checked)")
+	reason := fs.String("reason", "", "why, for the audit record")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if target.TaskType == "" {
+		fmt.Fprintln(stderr, "-type is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	if err := db.PauseTarget(ctx, *target, *by, *reason); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "paused %s\n", target)
+	return nil
+}
+
+func resume(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("resume", stderr)
+	target := targetFlags(fs)
+	by := fs.String("by", defaultBy(), "who is resuming, for the audit record (informational, not checked)")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if target.TaskType == "" {
+		fmt.Fprintln(stderr, "-type is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	if err := db.ResumeTarget(ctx, *target, *by); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "resumed %s\n", target)
+	return nil
+}
+
+func paused(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("paused", stderr)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	pauses, err := db.GetPauses(ctx)
+	if err != nil {
+		return err
+	}
+	targets := make([]db.Target, 0, len(pauses))
+	for target := range pauses {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].String() < targets[j].String() })
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tBY\tAT\tREASON")
+	for _, target := range targets {
+		p := pauses[target]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", target, p.By, p.At.Format(time.RFC3339), p.Reason)
+	}
+	return w.Flush()
+}
+
+func notify(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("notify", stderr)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	version, err := db.BumpScheduleVersion(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "schedules at version %d\n", version)
+	return nil
+}
+
+// timeFlag is a flag holding an RFC 3339 time, zero when not set.
+type timeFlag struct{ time.Time }
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(value string) error {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return err
+	}
+	f.Time = t
+	return nil
+}
+
+func history(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("history", stderr)
+	taskType := fs.String("type", "", "task type, e.g. event:stop (required)")
+	id := fs.String("id", "", "schedule id (required)")
+	var from, to timeFlag
+	fs.Var(&from, "from", "first fire time to show, RFC 3339")
+	fs.Var(&to, "to", "last fire time to show, RFC 3339")
+	since := fs.Duration("since", 0, "show the fires of this last duration, instead of -from")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if *taskType == "" || *id == "" {
+		fmt.Fprintln(stderr, "-type and -id are required")
+		fs.Usage()
+		return errUsage
+	}
+	if *since > 0 {
+		from.Time = time.Now().Add(-*since)
+	}
+
+	fires, err := db.GetHistory(ctx, *taskType, *id, from.Time, to.Time)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FIRE TIME\tTASK ID\tENQUEUED\tOUTCOME\tRETRIED\tERROR")
+	for _, f := range fires {
+		outcome, retried, errMsg := "pending", "", f.Error
+		if f.Outcome != nil {
+			outcome, retried = f.Outcome.Status, fmt.Sprint(f.Outcome.Retried)
+			if errMsg == "" {
+				errMsg = f.Outcome.Error
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\n", f.FireTime.Format(time.RFC3339), f.TaskID, f.Enqueued, outcome, retried, errMsg)
+	}
+	return w.Flush()
+}
+
+func audit(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("audit", stderr)
+	n := fs.Int64("n", 20, "number of records to show")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	records, err := db.GetAudit(ctx, *n)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AT\tACTION\tTARGET\tBY\tREASON")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.At.Format(time.RFC3339), r.Action, r.Target, r.By, r.Reason)
+	}
+	return w.Flush()
+}
+
+// defaultTimezone is the time zone of the scheduler when SCHEDULER_TIMEZONE is not set.
+const defaultTimezone = "America/New_York"
+
+// defaultMinIntervals are the shortest intervals validate accepts without a
+// warning. Start and stop events fan out one AWS event per id.
+var defaultMinIntervals = map[string]time.Duration{
+	tasks.TypeEventStart: 5 * time.Second,
+	tasks.TypeEventStop:  5 * time.Second,
+}
+
+// intervalsFlag is a repeatable flag of minimum intervals, as
+// <task type>=<duration>, or <duration> for any task type.
+type intervalsFlag map[string]time.Duration
+
+func (f intervalsFlag) String() string {
+	var values []string
+	for taskType, d := range f {
+		values = append(values, taskType+"="+d.String())
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+func (f intervalsFlag) Set(value string) error {
+	taskType, d, ok := strings.Cut(value, "=")
+	if !ok {
+		taskType, d = "", value
+	}
+	interval, err := time.ParseDuration(d)
+	if err != nil {
+		return err
+	}
+	f[taskType] = interval
+	return nil
+}
+
+func validate(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("validate", stderr)
+	count := fs.Int("n", 5, "number of next fire times to show")
+	timezone := os.Getenv("SCHEDULER_TIMEZONE")
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	tz := fs.String("tz", timezone, "time zone of cron specs without one, like the scheduler's SCHEDULER_TIMEZONE")
+	intervals := make(intervalsFlag)
+	for taskType, d := range defaultMinIntervals {
+		intervals[taskType] = d
+	}
+	fs.Var(intervals, "min-interval", "warn about schedules firing more often, as <task type>=<duration> or <duration> for any type (repeatable)")
+	strict := fs.Bool("strict", false, "fail on warnings too")
+	selector := selectorFlag(fs)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -tz: %v\n", err)
+		return errUsage
+	}
+	sel, err := db.ParseSelector(*selector)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -l: %v\n", err)
+		return errUsage
+	}
+
+	checks, err := db.ValidateSchedules(ctx, db.ValidateOpts{
+		Location:    loc,
+		Count:       *count,
+		TaskTypes:   []string{tasks.TypeEventStart, tasks.TypeEventStop},
+		MinInterval: intervals,
+		Selector:    sel,
+	})
+	if err != nil {
+		return err
+	}
+	var invalid, warned int
+	for _, c := range checks {
+		if c.Err != nil {
+			invalid++
+			fmt.Fprintf(stdout, "%s: invalid: %v\n", c.Key, c.Err)
+			continue
+		}
+		s := c.Schedule
+		spec := s.CronSpec
+		if s.OneShot() {
+			spec = db.FieldRunOnceAt + " " + s.RunOnceAt.Format(time.RFC3339)
+		}
+		zone := s.Timezone
+		if zone == "" {
+			zone = loc.String()
+		}
+		fmt.Fprintf(stdout, "%s: %s in %s\n", c.Key, spec, zone)
+		for _, t := range c.Next {
+			fmt.Fprintf(stdout, "  next %s\n", t.Format(time.RFC3339))
+		}
+		for _, w := range c.Warnings {
+			fmt.Fprintf(stdout, "  warning: %s\n", w)
+		}
+		if len(c.Warnings) > 0 {
+			warned++
+		}
+	}
+	fmt.Fprintf(stdout, "%d schedules, %d invalid, %d with warnings\n", len(checks), invalid, warned)
+	if invalid > 0 || (*strict && warned > 0) {
+		return errInvalid
+	}
+	return nil
+}
+
+// readManifest reads a manifest file, as JSON if its name ends in .json and
+// as YAML otherwise. Unknown fields are errors, to catch typos.
+func readManifest(name string) (db.Manifest, error) {
+	var m db.Manifest
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return m, err
+	}
+	if filepath.Ext(name) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&m)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&m)
+	}
+	if err != nil {
+		return m, fmt.Errorf("invalid manifest %s: %v", name, err)
+	}
+	return m, nil
+}
+
+func importManifest(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("import", stderr)
+	file := fs.String("f", "", "manifest file, YAML or JSON (required)")
+	apply := fs.Bool("apply", false, "apply the changes, rather than only showing them")
+	prune := fs.Bool("prune", false, "delete the stored schedules that are not in the manifest")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if *file == "" {
+		fmt.Fprintln(stderr, "-f is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	m, err := readManifest(*file)
+	if err != nil {
+		return err
+	}
+	changes, err := db.PlanManifest(ctx, m, *prune)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Kind]++
+		printChange(stdout, c)
+	}
+	unchanged := len(m.Schedules) - counts[db.ChangeCreate] - counts[db.ChangeUpdate]
+	fmt.Fprintf(stdout, "%d to create, %d to update, %d to delete, %d unchanged\n",
+		counts[db.ChangeCreate], counts[db.ChangeUpdate], counts[db.ChangeDelete], unchanged)
+	if !*apply {
+		if len(changes) > 0 {
+			fmt.Fprintln(stdout, "dry run, use -apply to apply the changes")
+		}
+		return nil
+	}
+	if err := db.ApplyChanges(ctx, changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "applied %d changes\n", len(changes))
+	return nil
+}
+
+// printChange writes a change as a diff of the fields of the schedule.
+func printChange(w io.Writer, c db.Change) {
+	switch c.Kind {
+	case db.ChangeCreate:
+		fmt.Fprintf(w, "+ %s\n", c.Key)
+	case db.ChangeUpdate:
+		fmt.Fprintf(w, "~ %s\n", c.Key)
+	case db.ChangeDelete:
+		fmt.Fprintf(w, "- %s\n", c.Key)
+		return
+	}
+	fields := make(map[string]bool)
+	for field := range c.Current {
+		fields[field] = true
+	}
+	for field := range c.Desired {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		current, inCurrent := c.Current[field]
+		desired, inDesired := c.Desired[field]
+		switch {
+		case !inCurrent:
+			fmt.Fprintf(w, "    + %s: %q\n", field, desired)
+		case !inDesired:
+			fmt.Fprintf(w, "    - %s: %q\n", field, current)
+		case current != desired:
+			fmt.Fprintf(w, "    %s: %q -> %q\n", field, current, desired)
+		}
+	}
+}
+
+func exportManifest(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("export", stderr)
+	format := fs.String("format", "yaml", "yaml or json")
+	out := fs.String("o", "", "file to write, default is stdout")
+	selector := selectorFlag(fs)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	sel, err := db.ParseSelector(*selector)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -l: %v\n", err)
+		return errUsage
+	}
+
+	m, invalid, err := db.ExportManifest(ctx)
+	if err != nil {
+		return err
+	}
+	if len(sel) > 0 {
+		selected := m.Schedules[:0]
+		for _, s := range m.Schedules {
+			if sel.Matches(s.Labels) {
+				selected = append(selected, s)
+			}
+		}
+		m.Schedules = selected
+	}
+	for _, e := range invalid {
+		fmt.Fprintf(stderr, "skipping %v\n", e)
+	}
+	var data []byte
+	switch *format {
+	case "yaml":
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err = enc.Encode(m); err == nil {
+			err = enc.Close()
+		}
+		data = buf.Bytes()
+	case "json":
+		data, err = json.MarshalIndent(m, "", "  ")
+		data = append(data, '\n')
+	default:
+		fmt.Fprintf(stderr, "invalid -format %q\n", *format)
+		fs.Usage()
+		return errUsage
+	}
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %v", err)
+	}
+	if *out == "" {
+		_, err = stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0o644)
+}
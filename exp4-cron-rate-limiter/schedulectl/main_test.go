@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"exp1/db"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	s.Set("schedule:event:start:1", "@every 5s")
+	s.Set("schedule:event:stop:0", "@every 5s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	exec := func(args ...string) string {
+		t.Helper()
+		var stdout bytes.Buffer
+		if err := run(ctx, args, &stdout, io.Discard); err != nil {
+			t.Fatalf("run %v failed: %v", args, err)
+		}
+		return stdout.String()
+	}
+	configs := func() map[string]int {
+		t.Helper()
+		configs, err := db.GetScheduleConfigs(ctx)
+		if err != nil {
+			t.Fatalf("db.GetScheduleConfigs failed: %v", err)
+		}
+		ids := make(map[string]int)
+		for config, batch := range configs {
+			ids[config.TaskType] += len(batch)
+		}
+		return ids
+	}
+
+	exec("pause", "-type", "event:start", "-id", "1", "-by", "alice")
+	exec("pause", "-type", "event:stop", "-by", "bob", "-reason", "maintenance")
+	if got := configs(); got["event:start"] != 1 || got["event:stop"] != 0 {
+		t.Errorf("paused: got scheduled ids %v, want event:start 1, event:stop 0", got)
+	}
+	out := exec("paused")
+	if !strings.Contains(out, "schedule:event:start:1  alice") || !strings.Contains(out, "type:event:stop         bob") {
+		t.Errorf("paused output:\n%s", out)
+	}
+
+	exec("resume", "-type", "event:stop", "-by", "carol")
+	if got := configs(); got["event:stop"] != 1 {
+		t.Errorf("resumed: got scheduled ids %v, want event:stop 1", got)
+	}
+	err := run(ctx, []string{"resume", "-type", "event:stop"}, io.Discard, io.Discard)
+	if !errors.Is(err, db.ErrNotPaused) {
+		t.Errorf("resume twice: got error %v, want %v", err, db.ErrNotPaused)
+	}
+	for _, args := range [][]string{
+		{"pause", "-type", "event:strat"},
+		{"pause", "-type", "event:start", "-id", "7"},
+		{"pause", "-type", "event"}, // only a prefix of event:start
+		{"resume", "-type", "event:start", "-id", "7"},
+	} {
+		if err := run(ctx, args, io.Discard, io.Discard); !errors.Is(err, db.ErrNoSchedule) {
+			t.Errorf("%v: got error %v, want %v", args, err, db.ErrNoSchedule)
+		}
+	}
+
+	// Newest first, and who did what.
+	records, err := db.GetAudit(ctx, 10)
+	if err != nil {
+		t.Fatalf("db.GetAudit failed: %v", err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Action+" "+r.Target.String()+" "+r.By+" "+r.Reason)
+	}
+	want := []string{
+		"resume type:event:stop carol ",
+		"pause type:event:stop bob maintenance",
+		"pause schedule:event:start:1 alice ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit: got %q, want %q", got, want)
+	}
+	if out := exec("audit", "-n", "1"); strings.Count(out, "\n") != 2 {
+		t.Errorf("audit -n 1 output:\n%s", out)
+	}
+
+	// Two pauses and a resume bumped the version.
+	if out := exec("notify"); out != "schedules at version 4\n" {
+		t.Errorf("notify output: %q", out)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, fire := range []db.FireRecord{
+		{TaskID: "periodic:abc:0", FireTime: base, Enqueued: true},
+		{TaskID: "periodic:abc:1", FireTime: base.Add(time.Hour), Error: "redis down"},
+		{TaskID: "periodic:abc:2", FireTime: base.Add(2 * time.Hour), Enqueued: true},
+	} {
+		if err := db.RecordFire(ctx, "event:stop", "7", fire); err != nil {
+			t.Fatalf("db.RecordFire %d failed: %v", i, err)
+		}
+	}
+	if _, err := db.RecordOutcome(ctx, "event:stop", "7", "periodic:abc:0", db.Outcome{Status: db.OutcomeSucceeded, At: base}); err != nil {
+		t.Fatalf("db.RecordOutcome failed: %v", err)
+	}
+
+	var stdout bytes.Buffer
+	args := []string{"history", "-type", "event:stop", "-id", "7", "-to", "2024-03-01T10:00:00Z"}
+	if err := run(ctx, args, &stdout, io.Discard); err != nil {
+		t.Fatalf("run %v failed: %v", args, err)
+	}
+	want := `FIRE TIME             TASK ID         ENQUEUED  OUTCOME    RETRIED  ERROR
+2024-03-01T09:00:00Z  periodic:abc:0  true      succeeded  0        
+2024-03-01T10:00:00Z  periodic:abc:1  false     pending             redis down
+`
+	if stdout.String() != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"unpause"}, {"pause"}, {"pause", "-type", "event:start", "extra"}} {
+		if err := run(context.Background(), args, io.Discard, io.Discard); !errors.Is(err, errUsage) {
+			t.Errorf("run %v: got error %v, want %v", args, err, errUsage)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.Set("schedule:event:start:0", "CRON_TZ=UTC 0 9 * * *")
+	s.Set("schedule:event:start:1", "@every 1s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	t.Setenv("SCHEDULER_TIMEZONE", "")
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	var stdout bytes.Buffer
+	if err := run(ctx, []string{"validate", "-n", "1"}, &stdout, io.Discard); err != nil {
+		t.Fatalf("run validate failed: %v", err)
+	}
+	for _, want := range []string{
+		"schedule:event:start:0: 0 9 * * * in UTC\n  next ",
+		"schedule:event:start:1: @every 1s in America/New_York\n",
+		"  warning: fires every 1s, more often than every 5s for event:start\n",
+		"2 schedules, 0 invalid, 1 with warnings\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, stdout.String())
+		}
+	}
+	if err := run(ctx, []string{"validate", "-strict"}, io.Discard, io.Discard); !errors.Is(err, errInvalid) {
+		t.Errorf("validate -strict with warnings: got error %v, want %v", err, errInvalid)
+	}
+	if err := run(ctx, []string{"validate", "-min-interval", "event:start=1s"}, io.Discard, io.Discard); err != nil {
+		t.Errorf("validate with a lower minimum: %v", err)
+	}
+
+	s.HSet("schedule:event:stop:0", "cron_spec", "0 18 * * *", "labels", `{"team":"aws"}`)
+	stdout.Reset()
+	if err := run(ctx, []string{"validate", "-l", "team=aws"}, &stdout, io.Discard); err != nil {
+		t.Errorf("validate -l team=aws: %v", err)
+	}
+	if !strings.HasPrefix(stdout.String(), "schedule:event:stop:0: 0 18 * * *") || !strings.HasSuffix(stdout.String(), "1 schedules, 0 invalid, 0 with warnings\n") {
+		t.Errorf("validate -l team=aws output:\n%s", stdout.String())
+	}
+
+	s.Set("schedule:event:start:2", "0 25 * * *")
+	if err := run(ctx, []string{"validate"}, io.Discard, io.Discard); !errors.Is(err, errInvalid) {
+		t.Errorf("validate with an invalid spec: got error %v, want %v", err, errInvalid)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	s.Set("schedule:event:start:99", "@every 5s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	exec := func(args ...string) string {
+		t.Helper()
+		var stdout bytes.Buffer
+		if err := run(ctx, args, &stdout, io.Discard); err != nil {
+			t.Fatalf("run %v failed: %v", args, err)
+		}
+		return stdout.String()
+	}
+
+	// The manifest of the repo, dry run first.
+	out := exec("import", "-f", "../schedules.yaml", "-prune")
+	if !strings.Contains(out, "+ schedule:event:start:10\n    + cron_spec: \"0 9 * * 1-5\"\n") ||
+		!strings.Contains(out, "- schedule:event:start:99\n") ||
+		!strings.HasSuffix(out, "22 to create, 0 to update, 1 to delete, 1 unchanged\ndry run, use -apply to apply the changes\n") {
+		t.Errorf("dry run output:\n%s", out)
+	}
+	if !s.Exists("schedule:event:start:99") {
+		t.Fatal("dry run deleted a schedule")
+	}
+	exec("import", "-f", "../schedules.yaml", "-prune", "-apply")
+	if out := exec("import", "-f", "../schedules.yaml", "-prune"); out != "0 to create, 0 to update, 0 to delete, 23 unchanged\n" {
+		t.Errorf("import after apply output:\n%s", out)
+	}
+
+	// Exports in both formats import back without changes.
+	for _, name := range []string{"schedules.yaml", "schedules.json"} {
+		file := filepath.Join(t.TempDir(), name)
+		exec("export", "-format", strings.TrimPrefix(filepath.Ext(name), "."), "-o", file)
+		if out := exec("import", "-f", file, "-prune"); out != "0 to create, 0 to update, 0 to delete, 23 unchanged\n" {
+			t.Errorf("import of %s output:\n%s", name, out)
+		}
+	}
+}
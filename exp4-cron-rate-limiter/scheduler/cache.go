@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"exp1/db"
+)
+
+// scheduleCache is the content of the schedule cache file.
+type scheduleCache struct {
+	SavedAt   time.Time     `json:"saved_at"`
+	Schedules []db.Schedule `json:"schedules"`
+}
+
+// writeCache saves the schedules to file. The file is replaced atomically,
+// so that a crash while writing does not leave a truncated cache behind.
+func writeCache(file string, schedules []db.Schedule) error {
+	data, err := json.Marshal(scheduleCache{SavedAt: time.Now().UTC(), Schedules: schedules})
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp failed: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp.Write failed: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp.Close failed: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("os.Rename failed: %v", err)
+	}
+	return nil
+}
+
+// readCache returns the schedules saved by writeCache.
+func readCache(file string) ([]db.Schedule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %v", err)
+	}
+	var cache scheduleCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %v", err)
+	}
+	return cache.Schedules, nil
+}
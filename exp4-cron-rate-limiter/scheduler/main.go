@@ -2,102 +2,636 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"exp1/db"
+	"exp1/health"
+	"exp1/leader"
+	"exp1/periodic"
 	"exp1/tasks"
 
 	"github.com/hibiken/asynq"
 	"github.com/lmittmann/tint"
 )
 
-const redisAddr = "127.0.0.1:6379"
+const (
+	defaultRedisAddr  = "127.0.0.1:6379"
+	defaultHealthAddr = ":8081"
+	defaultTimezone   = "America/New_York"
+	// The scheduler checks the schedule version every syncInterval, and
+	// reloads the schedules when it changed or every reloadInterval.
+	syncInterval          = 10 * time.Second
+	defaultReloadInterval = 5 * time.Minute
+	// Only the instance holding this lease runs the scheduler.
+	leaseName       = "scheduler"
+	defaultLeaseTTL = 15 * time.Second
+)
 
 type PeriodicTasks struct {
-	log *slog.Logger
+	ctx            context.Context
+	log            *slog.Logger
+	client         *asynq.Client
+	location       *time.Location
+	maxBatch       int
+	reloadInterval time.Duration
+	cacheFile      string
+	selector       db.Selector
+	lastSync       atomic.Int64 // unix nanoseconds of the last successful GetConfigs
+
+	// configs from the last full reload, returned as long as the schedule
+	// version does not change and they are not older than reloadInterval
+	loaded     bool
+	version    int64
+	lastReload time.Time
+	configs    []*asynq.PeriodicTaskConfig
+
+	good map[string]db.Schedule // last good schedules by key
+}
+
+// PeriodicTasksOpts configures a PeriodicTasks provider.
+type PeriodicTasksOpts struct {
+	// Required to enqueue one-shot schedules, which are not returned as configs.
+	Client *asynq.Client
+
+	// Optional: time zone of cron specs without a CRON_TZ= prefix, default is UTC
+	Location *time.Location
+
+	// Optional: ids sharing a cron spec are split into tasks of at most
+	// MaxBatch ids each; 1 gives every id its own periodic entry, and the
+	// default of 0 puts them all in one task.
+	MaxBatch int
+
+	// Optional: GetConfigs only reloads the schedules when their version
+	// changed, or when the last reload is older than ReloadInterval.
+	// The default of 0 reloads on every call.
+	ReloadInterval time.Duration
+
+	// Optional: file the last good schedules are saved to, and read from when
+	// Redis cannot be read before any reload succeeded.
+	CacheFile string
+
+	// Optional: only the schedules whose labels match Selector are fired,
+	// so that schedulers with disjoint selectors split the schedules between
+	// them. The default empty selector fires every schedule.
+	Selector db.Selector
 }
 
-func NewPeriodicTasks(log *slog.Logger) *PeriodicTasks {
-	return &PeriodicTasks{
-		log: log.With(slog.String("name", "periodic_tasks")),
+// NewPeriodicTasks returns a provider whose db reads are bound to ctx,
+// so that a sync in progress is abandoned once ctx is cancelled.
+func NewPeriodicTasks(ctx context.Context, log *slog.Logger, opts PeriodicTasksOpts) *PeriodicTasks {
+	p := &PeriodicTasks{
+		ctx:            ctx,
+		log:            log.With(slog.String("name", "periodic_tasks")),
+		client:         opts.Client,
+		location:       opts.Location,
+		maxBatch:       opts.MaxBatch,
+		reloadInterval: opts.ReloadInterval,
+		cacheFile:      opts.CacheFile,
+		selector:       opts.Selector,
 	}
+	if p.location == nil {
+		p.location = time.UTC
+	}
+	return p
 }
 
+// LastSync returns the time of the last successful GetConfigs call,
+// or the zero time if there was none yet.
+func (p *PeriodicTasks) LastSync() time.Time {
+	n := p.lastSync.Load()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// GetConfigs returns the configs of the schedules. When Redis cannot be
+// read, it returns the last good configs instead, so that the known
+// schedules keep firing, but LastSync is not updated.
 func (p *PeriodicTasks) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
-	// TODO: propagate context
-	ctx := context.Background()
-	configs, err := db.GetScheduleConfigs(ctx)
+	// The version is read first, so that a change made during the reload
+	// is seen by the next call.
+	version, err := db.GetScheduleVersion(p.ctx)
+	if err != nil {
+		return p.fallback(fmt.Errorf("db.GetScheduleVersion failed: %v", err))
+	}
+	if p.loaded && version == p.version && time.Since(p.lastReload) < p.reloadInterval {
+		p.log.Debug("schedules unchanged", slog.Int64("version", version))
+		p.lastSync.Store(time.Now().UnixNano())
+		return p.configs, nil
+	}
+	configs, err := p.reload()
+	if err != nil {
+		return p.fallback(err)
+	}
+	p.loaded, p.version, p.lastReload, p.configs = true, version, time.Now(), configs
+	p.lastSync.Store(time.Now().UnixNano())
+	return configs, nil
+}
+
+// fallback returns the last good configs, from memory or else from the
+// cache file, or err if there are none.
+func (p *PeriodicTasks) fallback(err error) ([]*asynq.PeriodicTaskConfig, error) {
+	if p.loaded {
+		p.log.Warn("could not read schedules, keeping the last good ones", tint.Err(err))
+		return p.configs, nil
+	}
+	if p.cacheFile == "" {
+		return nil, err
+	}
+	schedules, cacheErr := readCache(p.cacheFile)
+	if cacheErr != nil {
+		p.log.Error("could not read schedule cache", slog.String("file", p.cacheFile), tint.Err(cacheErr))
+		return nil, err
+	}
+	p.log.Warn("could not read schedules, using the cached ones", slog.String("file", p.cacheFile),
+		slog.Int("schedules", len(schedules)), tint.Err(err))
+	return p.build(schedules, time.Now()), nil
+}
+
+// reload reads the selected schedules, enqueues one-shot schedules, deletes
+// expired ones and returns the configs of the others.
+//
+// Invalid schedules are skipped and reported one by one. If a schedule was
+// valid before, its last good version keeps firing until it is fixed.
+func (p *PeriodicTasks) reload() ([]*asynq.PeriodicTaskConfig, error) {
+	schedules, invalid, err := db.GetSchedules(p.ctx)
 	if err != nil {
-		return nil, fmt.Errorf("db.GetScheduleConfigs failed: %v", err)
+		return nil, fmt.Errorf("db.GetSchedules failed: %v", err)
 	}
+	schedules = p.selected(schedules)
 
-	p.log.Debug("GetConfigs called", slog.Any("configs", configs))
+	now := time.Now()
+	p.maintain(schedules, now)
 
+	good := make(map[string]db.Schedule, len(schedules))
+	for _, s := range schedules {
+		good[s.Key] = s
+	}
+	for _, e := range invalid {
+		last, ok := p.good[e.Key]
+		if !ok && len(p.selector) > 0 {
+			// Its labels cannot be read, it is reported by every scheduler.
+			p.log.Warn("skipping invalid schedule, it may belong to another selector", slog.String("key", e.Key), tint.Err(e.Err))
+			continue
+		}
+		p.log.Error("skipping invalid schedule", slog.String("key", e.Key), slog.Bool("keeping_last_good", ok), tint.Err(e.Err))
+		if ok {
+			good[e.Key] = last
+			schedules = append(schedules, last)
+		}
+	}
+	p.good = good
+
+	if p.cacheFile != "" {
+		if err := writeCache(p.cacheFile, schedules); err != nil {
+			p.log.Error("could not write schedule cache", slog.String("file", p.cacheFile), tint.Err(err))
+		}
+	}
+	return p.build(schedules, now), nil
+}
+
+// selected returns the schedules matching the selector.
+func (p *PeriodicTasks) selected(schedules []db.Schedule) []db.Schedule {
+	if len(p.selector) == 0 {
+		return schedules
+	}
+	var selected []db.Schedule
+	for _, s := range schedules {
+		if p.selector.Matches(s.Labels) {
+			selected = append(selected, s)
+		}
+	}
+	return selected
+}
+
+// maintain enqueues the one-shot schedules, deletes the expired ones and
+// keeps track of the ticks the others handled (see CatchUp).
+func (p *PeriodicTasks) maintain(schedules []db.Schedule, now time.Time) {
+	var active []string
+	for _, s := range schedules {
+		switch {
+		case s.OneShot():
+			if s.Enabled && !s.Paused {
+				p.enqueueOnce(s)
+			}
+		case s.Expired(now):
+			p.log.Info("deleting expired schedule", slog.String("key", s.Key))
+			if err := db.DeleteSchedule(p.ctx, s.Key); err != nil {
+				p.log.Error("could not delete expired schedule", slog.String("key", s.Key), tint.Err(err))
+			}
+		case s.Paused || !s.Enabled:
+			if s.Paused {
+				p.log.Debug("skipping paused schedule", slog.String("key", s.Key))
+			}
+			// Their ticks are skipped on purpose, not to be caught up once they fire again.
+			if err := db.SetLastFire(p.ctx, s.Key, now); err != nil {
+				p.log.Error("could not record last fire", slog.String("key", s.Key), tint.Err(err))
+			}
+		default:
+			active = append(active, s.Key)
+		}
+	}
+	// New schedules are caught up from now on.
+	if err := db.InitLastFires(p.ctx, now, active...); err != nil {
+		p.log.Error("could not record last fires", tint.Err(err))
+	}
+}
+
+// build returns the configs of the cron schedules that fire at or after now.
+func (p *PeriodicTasks) build(schedules []db.Schedule, now time.Time) []*asynq.PeriodicTaskConfig {
 	var periodicTaskConfig []*asynq.PeriodicTaskConfig
+	for _, t := range p.periodicTasks(schedules, now) {
+		p.log.Info("adding task", slog.String("task_type", t.config.TaskType),
+			slog.String("cron_spec", t.config.CronSpec), slog.Any("ids", t.ids))
+		periodicTaskConfig = append(periodicTaskConfig, t.entry)
+	}
+	return periodicTaskConfig
+}
+
+// periodicTask is the periodic task of a batch of the ids sharing a config.
+type periodicTask struct {
+	config db.ScheduleConfig
+	ids    []string
+	entry  *asynq.PeriodicTaskConfig
+}
+
+// periodicTasks returns the periodic tasks of the cron schedules that fire
+// at or after now, the same from one call to the next for the same schedules.
+func (p *PeriodicTasks) periodicTasks(schedules []db.Schedule, now time.Time) []periodicTask {
+	configs := db.GroupSchedules(schedules, now)
+
+	p.log.Debug("grouped schedules", slog.Any("configs", configs))
+
+	var periodicTasks []periodicTask
 	for config, ids := range configs {
-		var err error
-		var task *asynq.Task
-		switch config.TaskType {
-		case tasks.TypeEventStart:
-			task, err = tasks.BuildEventStart(ids)
-			if err != nil {
-				p.log.Error("could not create start task", tint.Err(err))
-				continue
-			}
-		case tasks.TypeEventStop:
-			task, err = tasks.BuildEventStop(ids)
+		opts := taskOptions(config)
+		window, err := p.window(config, now)
+		if err != nil {
+			p.log.Error("could not compute schedule window", slog.String("cron_spec", config.CronSpec), tint.Err(err))
+			continue
+		}
+		if window != nil {
+			opts = append(opts, window)
+		}
+		for _, batch := range batches(ids, p.maxBatch) {
+			task, err := buildTask(config, batch)
 			if err != nil {
-				p.log.Error("could not create stop task", tint.Err(err))
+				p.log.Error("could not create task", slog.String("task_type", config.TaskType), tint.Err(err))
 				continue
 			}
-		default:
-			p.log.Warn("unknown task type", slog.String("task_type", config.TaskType))
-			continue
+			periodicTasks = append(periodicTasks, periodicTask{
+				config: config,
+				ids:    batch,
+				entry: &asynq.PeriodicTaskConfig{
+					Cronspec: cronSpec(config),
+					Task:     task,
+					Opts:     opts,
+				},
+			})
 		}
+	}
+	return periodicTasks
+}
 
-		p.log.Info("adding task", slog.String("task_type", config.TaskType),
-			slog.String("cron_spec", config.CronSpec), slog.Any("ids", ids))
-		periodicTaskConfig = append(periodicTaskConfig, &asynq.PeriodicTaskConfig{
-			Cronspec: config.CronSpec,
-			Task:     task,
-			Opts: []asynq.Option{
-				asynq.Queue("cron"), // All cron tasks go to the "cron" queue (event start and stop)
-			},
-		})
+// enqueueOnce enqueues a one-shot schedule to be processed at its
+// run_once_at, then deletes it. The task ID turns a second enqueue, after a
+// failed delete, into a no-op.
+func (p *PeriodicTasks) enqueueOnce(s db.Schedule) {
+	log := p.log.With(slog.String("key", s.Key), slog.Time("run_once_at", s.RunOnceAt))
+	task, err := buildTask(s.ScheduleConfig, []string{s.ID})
+	if err != nil {
+		log.Error("could not create task", tint.Err(err))
+		return
+	}
+	id := fmt.Sprintf("once:%s:%s:%d", s.TaskType, s.ID, s.RunOnceAt.Unix())
+	opts := append(taskOptions(s.ScheduleConfig), asynq.ProcessAt(s.RunOnceAt), asynq.TaskID(id))
+	_, err = p.client.EnqueueContext(p.ctx, task, opts...)
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		log.Error("could not enqueue one-shot schedule", tint.Err(err))
+		return
+	}
+	log.Info("enqueued one-shot schedule", slog.String("id", id))
+	if err := db.DeleteSchedule(p.ctx, s.Key); err != nil {
+		log.Error("could not delete one-shot schedule", tint.Err(err))
 	}
-	return periodicTaskConfig, nil
+}
+
+// maxBoundedRuns is the most runs left for which window computes the time of
+// the last one. Schedules with more are bounded once they get closer.
+const maxBoundedRuns = 1000
+
+// window returns the periodic.Window option of config, or nil if it has none.
+// Runs left before max_runs are turned into an end just after the last of
+// them, so that the manager stops firing without waiting for the next sync.
+func (p *PeriodicTasks) window(config db.ScheduleConfig, now time.Time) (asynq.Option, error) {
+	start, end := config.StartAt, config.EndAt
+	if config.RunsLeft > 0 && config.RunsLeft <= maxBoundedRuns {
+		schedule, err := periodic.Parse(cronSpec(config))
+		if err != nil {
+			return nil, err
+		}
+		last := now
+		if last.Before(start) {
+			last = start.Add(-time.Nanosecond)
+		}
+		last = last.In(p.location)
+		for i := 0; i < config.RunsLeft; i++ {
+			last = schedule.Next(last)
+		}
+		if end.IsZero() || last.Before(end) {
+			end = last.Add(time.Nanosecond).UTC()
+		}
+	}
+	if start.IsZero() && end.IsZero() {
+		return nil, nil
+	}
+	return periodic.Window(start, end), nil
+}
+
+// PreEnqueue records a fire in the history of the schedules of its ids
+// before it is enqueued, so that its outcome can be recorded however soon it
+// is processed. It is meant to be the manager's PreEnqueueFunc.
+func (p *PeriodicTasks) PreEnqueue(f periodic.Fire) {
+	p.recordFire(f, db.FireRecord{TaskID: f.TaskID, FireTime: f.At}, false)
+}
+
+// PostEnqueue records the result of the enqueue in the history, and counts
+// an enqueued fire towards the max_runs of the schedules of its ids and as
+// their last fire. A fire that was not enqueued is left to be caught up.
+// It is meant to be the manager's PostEnqueueFunc.
+func (p *PeriodicTasks) PostEnqueue(f periodic.Fire) {
+	// A conflict means that another fire of the same tick enqueued the task,
+	// and counted the run.
+	conflict := errors.Is(f.Err, asynq.ErrTaskIDConflict)
+	record := db.FireRecord{TaskID: f.TaskID, FireTime: f.At, Enqueued: f.Err == nil || conflict}
+	if f.Err != nil && !conflict {
+		record.Error = f.Err.Error()
+	}
+	p.recordFire(f, record, f.Err == nil)
+}
+
+// recordFire writes the record of a fire in the history of the schedules of
+// its ids, in one round trip however many ids the fire has (see db.RecordFires).
+func (p *PeriodicTasks) recordFire(f periodic.Fire, record db.FireRecord, run bool) {
+	if err := db.RecordFires(p.ctx, f.Task.Type(), p.scheduleIDs(f), record, run); err != nil {
+		p.log.Error("could not record fire", slog.String("id", f.TaskID), tint.Err(err))
+	}
+}
+
+// scheduleIDs returns the ids of the schedules a fire is for.
+func (p *PeriodicTasks) scheduleIDs(f periodic.Fire) []string {
+	var event struct{ IDs []string }
+	if err := json.Unmarshal(f.Task.Payload(), &event); err != nil {
+		p.log.Error("could not decode periodic task", slog.String("id", f.TaskID), tint.Err(err))
+		return nil
+	}
+	return event.IDs
+}
+
+// buildTask builds the task of a schedule for a batch of its ids.
+func buildTask(config db.ScheduleConfig, ids []string) (*asynq.Task, error) {
+	var payload json.RawMessage
+	if config.Payload != "" {
+		payload = json.RawMessage(config.Payload)
+	}
+	switch config.TaskType {
+	case tasks.TypeEventStart:
+		return tasks.BuildEventStart(ids, payload)
+	case tasks.TypeEventStop:
+		return tasks.BuildEventStop(ids, payload)
+	default:
+		return nil, fmt.Errorf("unknown task type %s", config.TaskType)
+	}
+}
+
+// cronSpec returns the cron spec of config, prefixed with its time zone if it has one.
+func cronSpec(config db.ScheduleConfig) string {
+	if config.Timezone == "" {
+		return config.CronSpec
+	}
+	return "CRON_TZ=" + config.Timezone + " " + config.CronSpec
+}
+
+// taskOptions turns the fields of a stored schedule into task options.
+func taskOptions(config db.ScheduleConfig) []asynq.Option {
+	// All cron tasks go to the "cron" queue (event start and stop) unless the schedule says otherwise
+	queue := "cron"
+	if config.Queue != "" {
+		queue = config.Queue
+	}
+	opts := []asynq.Option{asynq.Queue(queue)}
+	if config.MaxRetry != db.NoMaxRetry {
+		opts = append(opts, asynq.MaxRetry(config.MaxRetry))
+	}
+	if config.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(config.Timeout))
+	}
+	if config.UniqueTTL > 0 {
+		opts = append(opts, asynq.Unique(config.UniqueTTL))
+	}
+	return opts
+}
+
+// batches splits ids into consecutive slices of at most size ids.
+// A size of 0 or less returns all ids in a single batch.
+func batches(ids []string, size int) [][]string {
+	if size <= 0 || len(ids) <= size {
+		return [][]string{ids}
+	}
+	var res [][]string
+	for len(ids) > size {
+		res = append(res, ids[:size:size])
+		ids = ids[size:]
+	}
+	return append(res, ids)
 }
 
 func main() {
 	log := tasks.Logger(os.Stderr, os.Getenv("LOG_LEVEL"))
 
-	loc, err := time.LoadLocation("America/New_York")
+	if err := run(log); err != nil {
+		log.Error("could not run manager", tint.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run competes for the scheduler lease and runs the manager while it is the
+// leader, until SIGINT or SIGTERM is received.
+func run(log *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer db.Close()
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = defaultRedisAddr
+	}
+
+	healthCfg, err := health.ConfigFromEnv(defaultHealthAddr)
+	if err != nil {
+		return err
+	}
+
+	// Schedules without a time zone of their own fire in this one.
+	timezone := os.Getenv("SCHEDULER_TIMEZONE")
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+	loc, err := time.LoadLocation(timezone)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid SCHEDULER_TIMEZONE: %v", err)
 	}
 
-	provider := NewPeriodicTasks(log)
+	leaseTTL := defaultLeaseTTL
+	if value := os.Getenv("LEADER_LEASE_TTL"); value != "" {
+		if leaseTTL, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid LEADER_LEASE_TTL: %v", err)
+		}
+	}
 
-	manager, err := asynq.NewPeriodicTaskManager(
-		asynq.PeriodicTaskManagerOpts{
-			RedisConnOpt:               asynq.RedisClientOpt{Addr: "localhost:6379"},
-			PeriodicTaskConfigProvider: provider,         // struct that must implement the GetConfigs() method
-			SyncInterval:               10 * time.Second, // how often the GetConfigs() should be called
-			SchedulerOpts: &asynq.SchedulerOpts{
-				Location: loc,
-				LogLevel: asynq.WarnLevel,
-			},
-		})
+	// SCHEDULE_MODE=per-id gives every id its own periodic entry,
+	// otherwise ids sharing a cron spec are batched up to SCHEDULE_MAX_BATCH.
+	var maxBatch int
+	if value := os.Getenv("SCHEDULE_MAX_BATCH"); value != "" {
+		if maxBatch, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid SCHEDULE_MAX_BATCH: %v", err)
+		}
+		if maxBatch < 0 {
+			return fmt.Errorf("invalid SCHEDULE_MAX_BATCH: %d, want 0 or more", maxBatch)
+		}
+	}
+	reloadInterval := defaultReloadInterval
+	if value := os.Getenv("SCHEDULE_RELOAD_INTERVAL"); value != "" {
+		if reloadInterval, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid SCHEDULE_RELOAD_INTERVAL: %v", err)
+		}
+	}
+
+	switch mode := os.Getenv("SCHEDULE_MODE"); mode {
+	case "", "grouped":
+	case "per-id":
+		maxBatch = 1
+	default:
+		return fmt.Errorf("invalid SCHEDULE_MODE: %q", mode)
+	}
+
+	// SCHEDULE_SELECTOR=team=aws,env=prod only fires the schedules with these
+	// labels. Each selector elects its own leader.
+	selector, err := db.ParseSelector(os.Getenv("SCHEDULE_SELECTOR"))
 	if err != nil {
-		log.Error("could not create manager", tint.Err(err))
-		os.Exit(1)
+		return fmt.Errorf("invalid SCHEDULE_SELECTOR: %v", err)
+	}
+	lease := leaseName
+	if len(selector) > 0 {
+		lease += ":" + selector.String()
 	}
 
-	log.Info("starting manager", slog.String("addr", "localhost:6379"))
-	if err := manager.Run(); err != nil {
-		log.Error("could not run manager", tint.Err(err))
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+	defer client.Close()
+
+	provider := NewPeriodicTasks(ctx, log, PeriodicTasksOpts{
+		Client:         client,
+		Location:       loc,
+		MaxBatch:       maxBatch,
+		ReloadInterval: reloadInterval,
+		// SCHEDULE_CACHE_FILE keeps the schedules firing across a restart while Redis cannot be read.
+		CacheFile: os.Getenv("SCHEDULE_CACHE_FILE"),
+		Selector:  selector,
+	})
+	elector := leader.NewElector(log, lease, leaseTTL)
+
+	checks := health.NewHandler(healthCfg.CheckTimeout)
+	checks.AddReadinessCheck("redis", db.Ping)
+	checks.AddReadinessCheck("sync", func(ctx context.Context) error {
+		if !elector.IsLeader() {
+			return nil // followers do not sync
+		}
+		last := provider.LastSync()
+		if last.IsZero() {
+			return fmt.Errorf("no successful sync yet")
+		}
+		if age := time.Since(last); age > healthCfg.MaxSyncAge {
+			return fmt.Errorf("last successful sync %v ago", age.Round(time.Second))
+		}
+		return nil
+	})
+	// GET /entries lists the periodic tasks of the leader, like the
+	// scheduler entries of asynq's Inspector; followers list none.
+	var current atomic.Pointer[periodic.Manager]
+	checks.Handle("GET /entries", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries := []periodic.Entry{}
+		if manager := current.Load(); manager != nil {
+			entries = manager.Entries()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}))
+	if err := checks.Start(ctx, healthCfg.Addr); err != nil {
+		return fmt.Errorf("could not start health endpoints: %v", err)
 	}
+
+	log.Info("waiting for leadership", slog.String("addr", redisAddr), slog.String("health_addr", healthCfg.Addr),
+		slog.String("selector", selector.String()))
+	return elector.Run(ctx, func(ctx context.Context) error {
+		// A manager cannot be restarted after Shutdown, so each term gets a new one.
+		// It enqueues each fire with a task ID unique to the schedule and tick.
+		manager, err := periodic.NewManager(
+			periodic.ManagerOpts{
+				RedisConnOpt:               asynq.RedisClientOpt{Addr: redisAddr},
+				PeriodicTaskConfigProvider: provider,     // struct that must implement the GetConfigs() method
+				SyncInterval:               syncInterval, // how often the GetConfigs() should be called
+				Location:                   loc,
+				PreEnqueueFunc:             provider.PreEnqueue,  // records fires in the schedule history
+				PostEnqueueFunc:            provider.PostEnqueue, // and counts them towards max_runs
+				Logger:                     log,
+			})
+		if err != nil {
+			return fmt.Errorf("could not create manager: %v", err)
+		}
+
+		log.Info("starting manager")
+		if err := manager.Start(); err != nil {
+			return fmt.Errorf("manager.Start failed: %v", err)
+		}
+		current.Store(manager)
+		defer current.Store(nil)
+
+		// Fire the ticks missed while no scheduler was running, as their
+		// schedules' misfire policy says. Catching up to after the manager
+		// started leaves no tick in between; the ones both fire have the
+		// same task ID, and are enqueued once.
+		if err := provider.CatchUp(time.Now()); err != nil {
+			log.Error("could not catch up missed ticks", tint.Err(err))
+		}
+
+		// Sync as soon as the schedules change rather than at the next tick.
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			err := db.WatchScheduleChanges(ctx, func(version int64) {
+				log.Debug("schedules changed", slog.Int64("version", version))
+				manager.Sync()
+			})
+			if err != nil {
+				log.Error("could not watch schedule changes, syncing on the interval only", tint.Err(err))
+			}
+		}()
+
+		<-ctx.Done()
+		log.Info("shutting down manager")
+		<-watched
+		manager.Shutdown()
+		return nil
+	})
 }
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"exp1/db"
+	"exp1/periodic"
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestRunStopsOnSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		t.Run(sig.String(), func(t *testing.T) {
+			s := miniredis.RunT(t)
+			s.Set("schedule:event:start:0", "@every 5s")
+			t.Setenv("REDIS_ADDR", s.Addr())
+			t.Setenv("HEALTH_ADDR", "127.0.0.1:0")
+
+			done := make(chan error, 1)
+			go func() { done <- run(tasks.Logger(io.Discard, "")) }()
+
+			// The first connection is made by the initial sync, after the signal handler is installed.
+			waitFor(t, func() bool { return s.TotalConnectionCount() > 0 })
+			if err := syscall.Kill(syscall.Getpid(), sig); err != nil {
+				t.Fatalf("syscall.Kill failed: %v", err)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("run failed: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("run did not return after signal")
+			}
+
+			// The scheduler and db Redis clients are closed on the way out.
+			waitFor(t, func() bool { return s.CurrentConnectionCount() == 0 })
+		})
+	}
+}
+
+func TestRunRejectsInvalidConfig(t *testing.T) {
+	for name, value := range map[string]string{
+		"SCHEDULE_MAX_BATCH": "-1",
+		"SCHEDULE_MODE":      "per-key",
+		"SCHEDULE_SELECTOR":  "team",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("HEALTH_ADDR", "127.0.0.1:0")
+			t.Setenv(name, value)
+			if err := run(tasks.Logger(io.Discard, "")); err == nil {
+				t.Errorf("run with %s=%s: got no error", name, value)
+			}
+		})
+	}
+}
+
+func TestGetConfigsBatches(t *testing.T) {
+	s := miniredis.RunT(t)
+	for i := 0; i < 5; i++ {
+		s.Set(fmt.Sprintf("schedule:event:start:%d", i), "@every 5s")
+	}
+	s.Set("schedule:event:stop:0", "@every 5s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	for _, tc := range []struct {
+		maxBatch int
+		want     map[string][]int // batch sizes by task type
+	}{
+		{maxBatch: 0, want: map[string][]int{tasks.TypeEventStart: {5}, tasks.TypeEventStop: {1}}},
+		{maxBatch: 2, want: map[string][]int{tasks.TypeEventStart: {2, 2, 1}, tasks.TypeEventStop: {1}}},
+		{maxBatch: 1, want: map[string][]int{tasks.TypeEventStart: {1, 1, 1, 1, 1}, tasks.TypeEventStop: {1}}},
+	} {
+		p := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), PeriodicTasksOpts{MaxBatch: tc.maxBatch})
+		configs, err := p.GetConfigs()
+		if err != nil {
+			t.Fatalf("GetConfigs failed: %v", err)
+		}
+		got := make(map[string][]int)
+		seen := make(map[string]bool)
+		for _, c := range configs {
+			var e tasks.EventStart
+			if err := json.Unmarshal(c.Task.Payload(), &e); err != nil {
+				t.Fatalf("json.Unmarshal failed: %v", err)
+			}
+			got[c.Task.Type()] = append(got[c.Task.Type()], len(e.IDs))
+			for _, id := range e.IDs {
+				if seen[c.Task.Type()+id] {
+					t.Errorf("maxBatch %d: id %s scheduled twice", tc.maxBatch, id)
+				}
+				seen[c.Task.Type()+id] = true
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("maxBatch %d: got batch sizes %v, want %v", tc.maxBatch, got, tc.want)
+		}
+	}
+}
+
+func TestGetConfigsSelector(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.HSet("schedule:event:start:0", "cron_spec", "@every 5s", "labels", `{"team":"aws","env":"prod"}`)
+	s.HSet("schedule:event:start:1", "cron_spec", "@every 5s", "labels", `{"team":"gcp"}`)
+	s.HSet("schedule:event:start:2", "cron_spec", "@every 5s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	for _, tc := range []struct {
+		selector string
+		want     []string
+	}{
+		{selector: "", want: []string{"0", "1", "2"}},
+		{selector: "team=aws", want: []string{"0"}},
+		{selector: "team=gcp", want: []string{"1"}},
+		{selector: "team=aws,env=staging"},
+	} {
+		selector, err := db.ParseSelector(tc.selector)
+		if err != nil {
+			t.Fatalf("ParseSelector failed: %v", err)
+		}
+		p := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), PeriodicTasksOpts{Selector: selector})
+		configs, err := p.GetConfigs()
+		if err != nil {
+			t.Fatalf("GetConfigs failed: %v", err)
+		}
+		var got []string
+		for _, c := range configs {
+			var e tasks.EventStart
+			if err := json.Unmarshal(c.Task.Payload(), &e); err != nil {
+				t.Fatalf("json.Unmarshal failed: %v", err)
+			}
+			got = append(got, e.IDs...)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("selector %q: got ids %v, want %v", tc.selector, got, tc.want)
+		}
+	}
+}
+
+func TestGetConfigsWindows(t *testing.T) {
+	s := miniredis.RunT(t)
+	now := time.Now().UTC()
+	format := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+	s.HSet("schedule:event:start:0", "cron_spec", "@every 5s", "end_at", format(-time.Hour))
+	s.HSet("schedule:event:start:1", "cron_spec", "@every 5s", "max_runs", "2", "runs", "2")
+	s.HSet("schedule:event:start:2", "cron_spec", "@every 5s", "start_at", format(time.Hour))
+	s.HSet("schedule:event:start:3", "cron_spec", "0 0 1 1 *", "max_runs", "3", "runs", "1")
+	s.HSet("schedule:event:start:4", "run_once_at", format(time.Hour))
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: s.Addr()})
+	defer client.Close()
+	p := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), PeriodicTasksOpts{Client: client})
+	configs, err := p.GetConfigs()
+	if err != nil {
+		t.Fatalf("GetConfigs failed: %v", err)
+	}
+
+	windows := make(map[string]string) // by id
+	for _, c := range configs {
+		var e tasks.EventStart
+		if err := json.Unmarshal(c.Task.Payload(), &e); err != nil {
+			t.Fatalf("json.Unmarshal failed: %v", err)
+		}
+		windows[strings.Join(e.IDs, ",")] = fmt.Sprint(c.Opts[len(c.Opts)-1])
+	}
+	// Expired schedules are left out, the others fire in their window.
+	// Schedule 3 has two runs left, on the next two new years.
+	runsEnd := time.Date(now.Year()+2, 1, 1, 0, 0, 0, 1, time.UTC)
+	want := map[string]string{
+		"2": fmt.Sprint(periodic.Window(now.Add(time.Hour).Truncate(time.Second), time.Time{})),
+		"3": fmt.Sprint(periodic.Window(time.Time{}, runsEnd)),
+	}
+	if fmt.Sprint(windows) != fmt.Sprint(want) {
+		t.Errorf("got windows %v, want %v", windows, want)
+	}
+
+	// Expired and enqueued one-shot schedules are deleted.
+	for id, deleted := range map[string]bool{"0": true, "1": true, "2": false, "3": false, "4": true} {
+		if got := !s.Exists("schedule:event:start:" + id); got != deleted {
+			t.Errorf("schedule %s: deleted %v, want %v", id, got, deleted)
+		}
+	}
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: s.Addr()})
+	defer inspector.Close()
+	scheduled, err := inspector.ListScheduledTasks("cron")
+	if err != nil {
+		t.Fatalf("inspector.ListScheduledTasks failed: %v", err)
+	}
+	if len(scheduled) != 1 || !strings.HasPrefix(scheduled[0].ID, "once:event:start:4:") ||
+		!scheduled[0].NextProcessAt.Equal(now.Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("got scheduled tasks %+v, want the one-shot schedule", scheduled)
+	}
+
+	// A fire of schedule 3 is counted.
+	for _, c := range configs {
+		p.PostEnqueue(periodic.Fire{At: now, TaskID: "periodic:test", Task: c.Task, Info: &asynq.TaskInfo{}})
+	}
+	if got := s.HGet("schedule:event:start:3", "runs"); got != "2" {
+		t.Errorf("runs: got %s, want 2", got)
+	}
+}
+
+func TestGetConfigsReloadsOnChange(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	p := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), PeriodicTasksOpts{MaxBatch: 1, ReloadInterval: time.Hour})
+	count := func() int {
+		t.Helper()
+		configs, err := p.GetConfigs()
+		if err != nil {
+			t.Fatalf("GetConfigs failed: %v", err)
+		}
+		return len(configs)
+	}
+	if got := count(); got != 1 {
+		t.Fatalf("got %d configs, want 1", got)
+	}
+
+	// Not reloaded until the version changes.
+	s.Set("schedule:event:start:1", "@every 5s")
+	if got := count(); got != 1 {
+		t.Errorf("unchanged version: got %d configs, want 1", got)
+	}
+	if _, err := db.BumpScheduleVersion(context.Background()); err != nil {
+		t.Fatalf("db.BumpScheduleVersion failed: %v", err)
+	}
+	if got := count(); got != 2 {
+		t.Errorf("changed version: got %d configs, want 2", got)
+	}
+
+	// Nor until the reload interval has passed.
+	s.Set("schedule:event:start:2", "@every 5s")
+	p.lastReload = time.Now().Add(-time.Hour)
+	if got := count(); got != 3 {
+		t.Errorf("reload interval passed: got %d configs, want 3", got)
+	}
+}
+
+func TestGetConfigsKeepsLastGood(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.Set("schedule:event:start:0", "@every 5s")
+	s.Set("schedule:event:start:1", "@every 5s")
+	s.Set("schedule:bad", "@every 5s")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	cacheFile := filepath.Join(t.TempDir(), "schedules.json")
+	opts := PeriodicTasksOpts{MaxBatch: 1, CacheFile: cacheFile}
+	p := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), opts)
+	count := func(p *PeriodicTasks) int {
+		t.Helper()
+		configs, err := p.GetConfigs()
+		if err != nil {
+			t.Fatalf("GetConfigs failed: %v", err)
+		}
+		return len(configs)
+	}
+
+	// A bad key is skipped, and one that was good keeps its last good version.
+	if got := count(p); got != 2 {
+		t.Fatalf("got %d configs, want 2", got)
+	}
+	s.Set("schedule:event:start:1", "@every soon")
+	s.Set("schedule:event:start:2", "@every 5s")
+	if got := count(p); got != 3 {
+		t.Errorf("with an invalid schedule: got %d configs, want 3", got)
+	}
+
+	// While Redis is down, the last good configs are returned from memory,
+	// or from the cache file by a new provider.
+	synced := p.LastSync()
+	s.Close()
+	if got := count(p); got != 3 {
+		t.Errorf("from memory: got %d configs, want 3", got)
+	}
+	if !p.LastSync().Equal(synced) {
+		t.Error("LastSync changed while Redis was down")
+	}
+	if got := count(NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), opts)); got != 3 {
+		t.Errorf("from the cache file: got %d configs, want 3", got)
+	}
+	opts.CacheFile = ""
+	if _, err := NewPeriodicTasks(context.Background(), tasks.Logger(io.Discard, ""), opts).GetConfigs(); err == nil {
+		t.Error("GetConfigs without a cache: got no error")
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.HSet("schedule:event:start:0", "cron_spec", "0 * * * *")
+	s.HSet("schedule:event:start:1", "cron_spec", "0 * * * *", "misfire", "once")
+	s.HSet("schedule:event:start:2", "cron_spec", "0 * * * *", "misfire", "all", "misfire_limit", "3")
+	s.HSet("schedule:event:start:3", "cron_spec", "0 * * * *", "misfire", "all")
+	s.HSet("schedule:event:start:4", "cron_spec", "0 * * * *", "misfire", "all")
+	s.HSet("schedule:event:start:5", "cron_spec", "0 * * * *", "misfire", "all", "start_at", "2024-03-01T11:00:00Z")
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+
+	// The scheduler was down from 07:30 to 12:30, missing 5 hourly ticks.
+	ctx := context.Background()
+	last := time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)
+	now := last.Add(5 * time.Hour)
+	for _, id := range []string{"0", "1", "2", "3", "5", "9"} {
+		if err := db.SetLastFire(ctx, db.ScheduleKey(tasks.TypeEventStart, id), last); err != nil {
+			t.Fatalf("db.SetLastFire failed: %v", err)
+		}
+	}
+	if err := db.PauseTarget(ctx, db.Target{TaskType: tasks.TypeEventStart, ID: "3"}, "alice", ""); err != nil {
+		t.Fatalf("db.PauseTarget failed: %v", err)
+	}
+
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: s.Addr()})
+	defer client.Close()
+	p := NewPeriodicTasks(ctx, tasks.Logger(io.Discard, ""), PeriodicTasksOpts{Client: client})
+
+	// Missed ticks have the task ID the manager fires them with, and the
+	// manager enqueued the 12:00 tick of schedule 2 right before it died.
+	schedules, _, err := db.GetSchedules(ctx)
+	if err != nil {
+		t.Fatalf("db.GetSchedules failed: %v", err)
+	}
+	taskIDs := make(map[string]string) // of the 12:00 tick, by schedule id
+	for _, pt := range p.periodicTasks(schedules, now) {
+		taskIDs[pt.ids[0]] = periodic.TaskID(pt.entry, now.Truncate(time.Hour))
+		if pt.ids[0] == "2" {
+			if _, err := client.Enqueue(pt.entry.Task, asynq.Queue("cron"), asynq.TaskID(taskIDs["2"])); err != nil {
+				t.Fatalf("client.Enqueue failed: %v", err)
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ { // the second catch-up has nothing left to fire
+		if err := p.CatchUp(now); err != nil {
+			t.Fatalf("CatchUp failed: %v", err)
+		}
+	}
+
+	// Skipped, the last one, the last 3, paused, without a last fire, and
+	// the ones in the window.
+	want := map[string][]int{"0": nil, "1": {12}, "2": {10, 11, 12}, "3": nil, "4": nil, "5": {11, 12}}
+	for id, hours := range want {
+		fires, err := db.GetHistory(ctx, tasks.TypeEventStart, id, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatalf("db.GetHistory failed: %v", err)
+		}
+		var got []int
+		for _, f := range fires {
+			if !f.Enqueued {
+				t.Errorf("schedule %s: fire %s not enqueued: %s", id, f.TaskID, f.Error)
+			}
+			got = append(got, f.FireTime.UTC().Hour())
+			if f.FireTime.UTC().Hour() == 12 && f.TaskID != taskIDs[id] {
+				t.Errorf("schedule %s: got task ID %s, want %s", id, f.TaskID, taskIDs[id])
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(hours) {
+			t.Errorf("schedule %s: got fires at hours %v, want %v", id, got, hours)
+		}
+	}
+
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: s.Addr()})
+	defer inspector.Close()
+	if pending, err := inspector.ListPendingTasks("cron"); err != nil || len(pending) != 6 {
+		t.Errorf("got %d pending tasks, %v, want 6 with the tick enqueued before", len(pending), err)
+	}
+
+	// Every schedule is handled up to now, and deleted ones are forgotten.
+	lastFires, err := db.GetLastFires(ctx)
+	if err != nil {
+		t.Fatalf("db.GetLastFires failed: %v", err)
+	}
+	if len(lastFires) != len(want) {
+		t.Errorf("got last fires of %d schedules, want %d", len(lastFires), len(want))
+	}
+	for key, at := range lastFires {
+		if !at.Equal(now) {
+			t.Errorf("%s: got last fire %v, want %v", key, at, now)
+		}
+	}
+}
+
+func TestTaskOptions(t *testing.T) {
+	config := db.ScheduleConfig{CronSpec: "0 9 * * *", TaskType: tasks.TypeEventStart, MaxRetry: db.NoMaxRetry}
+	if got := fmt.Sprint(taskOptions(config)); got != `[Queue("cron")]` {
+		t.Errorf("default options: got %s", got)
+	}
+	if got := cronSpec(config); got != "0 9 * * *" {
+		t.Errorf("cron spec without time zone: got %s", got)
+	}
+
+	config.Queue = "critical"
+	config.Timezone = "Europe/Paris"
+	config.MaxRetry = 0
+	config.Timeout = 30 * time.Second
+	config.UniqueTTL = time.Minute
+	if got, want := fmt.Sprint(taskOptions(config)), `[Queue("critical") MaxRetry(0) Timeout(30s) Unique(1m0s)]`; got != want {
+		t.Errorf("options: got %s, want %s", got, want)
+	}
+	if got := cronSpec(config); got != "CRON_TZ=Europe/Paris 0 9 * * *" {
+		t.Errorf("cron spec with time zone: got %s", got)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
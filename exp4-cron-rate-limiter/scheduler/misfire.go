@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"exp1/db"
+	"exp1/periodic"
+
+	"github.com/hibiken/asynq"
+	"github.com/lmittmann/tint"
+)
+
+const (
+	// maxMissedTicks bounds the ticks of a schedule that CatchUp goes
+	// through, so that a frequent schedule missed for long is not a long loop.
+	maxMissedTicks = 10000
+	// catchUpRetention is how long a caught up task is kept once processed,
+	// like the manager's fires, so that a second catch-up of it is a no-op.
+	catchUpRetention = time.Hour
+)
+
+// CatchUp handles the ticks that the schedules missed since their last fire
+// and up to now, while no scheduler was running, according to their misfire
+// policy. Only the selected schedules are caught up.
+//
+// The missed ticks are enqueued with the task and task ID of the manager's
+// periodic task (see periodic.TaskID), so that a tick that the manager
+// enqueued too, before a crash or since it started, is enqueued once. It is
+// meant to be called when a scheduler becomes the leader, right after its
+// manager started.
+func (p *PeriodicTasks) CatchUp(now time.Time) error {
+	schedules, invalid, err := db.GetSchedules(p.ctx)
+	if err != nil {
+		return fmt.Errorf("db.GetSchedules failed: %v", err)
+	}
+	lastFires, err := db.GetLastFires(p.ctx)
+	if err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool, len(schedules)+len(invalid))
+	for _, e := range invalid {
+		exists[e.Key] = true
+	}
+	for _, s := range schedules {
+		exists[s.Key] = true
+	}
+	schedules = p.selected(schedules)
+	for _, t := range p.periodicTasks(schedules, now) {
+		p.catchUp(t, lastFires, now)
+	}
+	for _, s := range schedules {
+		if s.OneShot() {
+			continue
+		}
+		// Whether they were fired or dropped, the ticks up to now are handled.
+		if err := db.SetLastFire(p.ctx, s.Key, now); err != nil {
+			p.log.Error("could not record last fire", slog.String("key", s.Key), tint.Err(err))
+		}
+	}
+
+	var deleted []string
+	for key := range lastFires {
+		if !exists[key] {
+			deleted = append(deleted, key)
+		}
+	}
+	return db.DeleteLastFires(p.ctx, deleted...)
+}
+
+// catchUp enqueues the ticks of t missed after the last fire of its ids and
+// up to now that their misfire policy keeps. The ids of a batch fire
+// together, from the latest of their last fires, so that none fires a tick
+// from before it was added. Batches without a last fire are new.
+func (p *PeriodicTasks) catchUp(t periodicTask, lastFires map[string]time.Time, now time.Time) {
+	var last time.Time
+	for _, id := range t.ids {
+		if at, ok := lastFires[db.ScheduleKey(t.config.TaskType, id)]; ok && at.After(last) {
+			last = at
+		}
+	}
+	if last.IsZero() {
+		return
+	}
+	log := p.log.With(slog.String("task_type", t.config.TaskType), slog.Any("ids", t.ids),
+		slog.String("misfire", t.config.Misfire), slog.Time("last_fire", last))
+
+	limit := 0
+	switch t.config.Misfire {
+	case db.MisfireOnce:
+		limit = 1
+	case db.MisfireAll:
+		limit = t.config.MisfireLimit
+		if limit == 0 {
+			limit = db.DefaultMisfireLimit
+		}
+	}
+	if t.config.RunsLeft > 0 && t.config.RunsLeft < limit {
+		limit = t.config.RunsLeft
+	}
+	ticks, missed, err := p.missedTicks(t.config, last, now, limit)
+	if err != nil {
+		log.Error("could not compute missed ticks", tint.Err(err))
+		return
+	}
+	if missed == 0 {
+		return
+	}
+	if len(ticks) == 0 {
+		log.Info("skipping missed ticks", slog.Int("missed", missed))
+		return
+	}
+	log.Info("catching up missed ticks", slog.Int("missed", missed), slog.Int("firing", len(ticks)))
+
+	opts := append([]asynq.Option{asynq.Retention(catchUpRetention)}, taskOptions(t.config)...)
+	for _, at := range ticks {
+		f := periodic.Fire{At: at, TaskID: periodic.TaskID(t.entry, at), Task: t.entry.Task}
+		p.PreEnqueue(f)
+		f.Info, f.Err = p.client.EnqueueContext(p.ctx, f.Task, append(opts, asynq.TaskID(f.TaskID))...)
+		p.PostEnqueue(f)
+		if f.Err != nil && !errors.Is(f.Err, asynq.ErrTaskIDConflict) {
+			log.Error("could not enqueue missed tick", slog.Time("fire_time", at), tint.Err(f.Err))
+		}
+	}
+}
+
+// missedTicks returns the ticks of config after last and at or before now,
+// within its window: the most recent limit of them, oldest first, and how
+// many there are. It stops counting at maxMissedTicks.
+func (p *PeriodicTasks) missedTicks(config db.ScheduleConfig, last, now time.Time, limit int) ([]time.Time, int, error) {
+	schedule, err := periodic.Parse(cronSpec(config))
+	if err != nil {
+		return nil, 0, err
+	}
+	var ticks []time.Time
+	missed := 0
+	for t := schedule.Next(last.In(p.location)); !t.IsZero() && !t.After(now) && missed < maxMissedTicks; t = schedule.Next(t) {
+		if !config.EndAt.IsZero() && !t.Before(config.EndAt) {
+			break
+		}
+		if t.Before(config.StartAt) {
+			continue
+		}
+		missed++
+		if limit > 0 {
+			if len(ticks) == limit {
+				ticks = ticks[1:]
+			}
+			ticks = append(ticks, t)
+		}
+	}
+	return ticks, missed, nil
+}
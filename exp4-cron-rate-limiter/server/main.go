@@ -1,22 +1,82 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"exp1/db"
+	"exp1/health"
 	"exp1/tasks"
 
 	"github.com/hibiken/asynq"
 	"github.com/lmittmann/tint"
 )
 
-const redisAddr = "127.0.0.1:6379"
+const (
+	defaultRedisAddr  = "127.0.0.1:6379"
+	defaultHealthAddr = ":8082"
+)
+
+// Server states reported by the readiness check.
+const (
+	stateActive  = "active"  // processing tasks
+	stateQuiet   = "quiet"   // not processing new tasks after SIGTSTP
+	stateStopped = "stopped" // shutting down
+)
 
 func main() {
 	log := tasks.Logger(os.Stderr, os.Getenv("LOG_LEVEL"))
 
+	if err := run(log); err != nil {
+		log.Error("could not run server", tint.Err(err))
+		os.Exit(1)
+	}
+}
+
+// run starts the server and blocks until SIGINT or SIGTERM is received.
+// SIGTSTP stops the server from processing new tasks, as asynq's Server.Run does.
+func run(log *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	defer db.Close()
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = defaultRedisAddr
+	}
+
+	healthCfg, err := health.ConfigFromEnv(defaultHealthAddr)
+	if err != nil {
+		return err
+	}
+	// AWS events are published to SNS when SNS_PUBLISH is true, or only logged.
+	var publisher tasks.EventPublisher = tasks.LogPublisher{Log: log}
+	snsCfg, ok, err := tasks.SNSConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if ok {
+		if publisher, err = tasks.NewSNSPublisher(ctx, snsCfg); err != nil {
+			return err
+		}
+	}
+	// Webhooks are signed with WEBHOOK_SECRET.
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		log.Warn("WEBHOOK_SECRET is not set, webhooks are not signed")
+	}
+	var redisStatus health.Status
+	var state atomic.Value
+	state.Store(stateStopped)
+
 	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
 	defer client.Close()
 
@@ -27,27 +87,101 @@ func main() {
 			Concurrency: 10,
 			// Optionally specify multiple queues with different priority.
 			Queues: map[string]int{
-				"aws":  5,
-				"cron": 5,
+				"aws":     5,
+				"cron":    5,
+				"webhook": 3,
 			},
 			LogLevel: asynq.WarnLevel,
 			// If error is due to rate limit, don't count the error as a failure.
 			IsFailure:      func(err error) bool { return !tasks.IsRateLimitError(err) },
 			RetryDelayFunc: retryDelay,
+			// asynq pings Redis on this interval and reports the result.
+			HealthCheckFunc:     redisStatus.Set,
+			HealthCheckInterval: healthCfg.RedisCheckInterval,
 		},
 	)
 
 	// mux maps a type to a handler
 	mux := asynq.NewServeMux()
+	mux.Use(recordOutcome(log))
 	mux.Handle(tasks.TypeEventStart, tasks.NewProcessStartEvent(log, client))
 	mux.Handle(tasks.TypeEventStop, tasks.NewProcessStopEvent(log, client))
-	mux.Handle(tasks.TypeEventAWS, tasks.NewProcessEventAWS(log))
+	mux.Handle(tasks.TypeEventAWS, tasks.NewProcessEventAWS(log, publisher))
+	mux.Handle(tasks.TypeWebhookDeliver, tasks.NewProcessWebhookDeliver(log, []byte(webhookSecret)))
+
+	checks := health.NewHandler(healthCfg.CheckTimeout)
+	checks.AddReadinessCheck("redis", redisStatus.Check)
+	checks.AddReadinessCheck("server", func(ctx context.Context) error {
+		if s := state.Load().(string); s != stateActive {
+			return fmt.Errorf("server is %s", s)
+		}
+		return nil
+	})
+	if err := checks.Start(ctx, healthCfg.Addr); err != nil {
+		return fmt.Errorf("could not start health endpoints: %v", err)
+	}
 
 	// Run server
-	log.Info("starting server", slog.String("addr", redisAddr))
-	if err := srv.Run(mux); err != nil {
-		log.Error("could not run server", tint.Err(err))
-		os.Exit(1)
+	log.Info("starting server", slog.String("addr", redisAddr), slog.String("health_addr", healthCfg.Addr))
+	if err := srv.Start(mux); err != nil {
+		return fmt.Errorf("srv.Start failed: %v", err)
+	}
+	state.Store(stateActive)
+
+	tstp := make(chan os.Signal, 1)
+	signal.Notify(tstp, syscall.SIGTSTP)
+	defer signal.Stop(tstp)
+
+	for ctx.Err() == nil {
+		select {
+		case <-tstp:
+			log.Info("stopping server from processing new tasks")
+			srv.Stop()
+			state.Store(stateQuiet)
+		case <-ctx.Done():
+		}
+	}
+
+	// Shutdown waits for in-flight handlers and cancels their context on timeout.
+	log.Info("shutting down server")
+	state.Store(stateStopped)
+	srv.Shutdown()
+	return nil
+}
+
+// recordOutcome returns a middleware that records the outcome of the event
+// tasks fired by the scheduler in the history of their schedules.
+func recordOutcome(log *slog.Logger) asynq.MiddlewareFunc {
+	return func(next asynq.Handler) asynq.Handler {
+		return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+			err := next.ProcessTask(ctx, task)
+			if task.Type() != tasks.TypeEventStart && task.Type() != tasks.TypeEventStop {
+				return err
+			}
+
+			taskID, _ := asynq.GetTaskID(ctx)
+			retried, _ := asynq.GetRetryCount(ctx)
+			outcome := db.Outcome{Status: db.OutcomeSucceeded, Retried: retried, At: time.Now().UTC()}
+			if err != nil {
+				outcome.Status = db.OutcomeFailed
+				outcome.Error = err.Error()
+			}
+			var event struct{ IDs []string }
+			if jsonErr := json.Unmarshal(task.Payload(), &event); jsonErr != nil {
+				return err // the handler reported it already
+			}
+
+			// The handler may have failed because ctx is done, record it anyway.
+			recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			for _, id := range event.IDs {
+				// Tasks that were not fired by the scheduler are not in the history.
+				if _, recordErr := db.RecordOutcome(recordCtx, task.Type(), id, taskID, outcome); recordErr != nil {
+					log.Error("could not record outcome", slog.String("id", taskID), slog.String("schedule_id", id), tint.Err(recordErr))
+				}
+			}
+			return err
+		})
 	}
 }
 
@@ -56,5 +190,8 @@ func retryDelay(n int, err error, task *asynq.Task) time.Duration {
 	if errors.As(err, &ratelimitErr) {
 		return ratelimitErr.RetryIn
 	}
+	if task.Type() == tasks.TypeWebhookDeliver {
+		return tasks.WebhookRetryDelay(n, err, task)
+	}
 	return asynq.DefaultRetryDelayFunc(n, err, task)
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"exp1/db"
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestRunStopsOnSignal(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		t.Run(sig.String(), func(t *testing.T) {
+			s := miniredis.RunT(t)
+			t.Setenv("REDIS_ADDR", s.Addr())
+			t.Setenv("HEALTH_ADDR", "127.0.0.1:0")
+
+			done := make(chan error, 1)
+			go func() { done <- run(tasks.Logger(io.Discard, "")) }()
+
+			// The server heartbeat is written after the signal handler is installed.
+			waitFor(t, func() bool { return s.Exists("asynq:servers") })
+			if err := syscall.Kill(syscall.Getpid(), sig); err != nil {
+				t.Fatalf("syscall.Kill failed: %v", err)
+			}
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("run failed: %v", err)
+				}
+			case <-time.After(15 * time.Second):
+				t.Fatal("run did not return after signal")
+			}
+
+			if s.Exists("asynq:servers") {
+				t.Error("server state was not cleared on shutdown")
+			}
+		})
+	}
+}
+
+func TestRecordOutcome(t *testing.T) {
+	s := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", s.Addr())
+	db.Close()
+	t.Cleanup(func() { db.Close() })
+	redisOpt := asynq.RedisClientOpt{Addr: s.Addr()}
+	ctx := context.Background()
+	fireTime := time.Now().Truncate(time.Second)
+
+	// The scheduler recorded the fire of ids 7 and 8, but not of id 9.
+	for _, id := range []string{"7", "8"} {
+		if err := db.RecordFire(ctx, tasks.TypeEventStop, id, db.FireRecord{TaskID: "periodic:abc:1", FireTime: fireTime}); err != nil {
+			t.Fatalf("db.RecordFire failed: %v", err)
+		}
+	}
+
+	mux := asynq.NewServeMux()
+	mux.Use(recordOutcome(tasks.Logger(io.Discard, "")))
+	mux.HandleFunc(tasks.TypeEventStop, func(ctx context.Context, task *asynq.Task) error {
+		return errors.New("boom")
+	})
+	srv := asynq.NewServer(redisOpt, asynq.Config{Queues: map[string]int{"cron": 1}, LogLevel: asynq.FatalLevel})
+	if err := srv.Start(mux); err != nil {
+		t.Fatalf("srv.Start failed: %v", err)
+	}
+	defer srv.Shutdown()
+
+	client := asynq.NewClient(redisOpt)
+	defer client.Close()
+	task, err := tasks.BuildEventStop([]string{"7", "8", "9"}, nil)
+	if err != nil {
+		t.Fatalf("tasks.BuildEventStop failed: %v", err)
+	}
+	if _, err := client.Enqueue(task, asynq.Queue("cron"), asynq.TaskID("periodic:abc:1"), asynq.MaxRetry(0)); err != nil {
+		t.Fatalf("client.Enqueue failed: %v", err)
+	}
+
+	for _, id := range []string{"7", "8"} {
+		var fires []db.FireRecord
+		waitFor(t, func() bool {
+			fires, err = db.GetHistory(ctx, tasks.TypeEventStop, id, time.Time{}, time.Time{})
+			return err == nil && len(fires) == 1 && fires[0].Outcome != nil
+		})
+		if o := fires[0].Outcome; o.Status != db.OutcomeFailed || o.Error != "boom" {
+			t.Errorf("id %s: got outcome %+v, want failed with boom", id, o)
+		}
+	}
+	if fires, err := db.GetHistory(ctx, tasks.TypeEventStop, "9", time.Time{}, time.Time{}); err != nil || len(fires) != 0 {
+		t.Errorf("id 9: got fires %+v, %v, want none", fires, err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
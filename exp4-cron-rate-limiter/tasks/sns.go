@@ -0,0 +1,213 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/hibiken/asynq"
+)
+
+// EventPublisher publishes AWS events. Errors wrapping asynq.SkipRetry
+// will fail the same way if retried, *RateLimitErrors are retried in their
+// RetryIn without counting as failures; other errors are worth retrying.
+type EventPublisher interface {
+	Publish(ctx context.Context, arn string, payload json.RawMessage) error
+}
+
+// LogPublisher logs AWS events instead of publishing them, for running
+// without AWS.
+type LogPublisher struct {
+	Log *slog.Logger
+}
+
+func (p LogPublisher) Publish(ctx context.Context, arn string, payload json.RawMessage) error {
+	p.Log.Info("🚀 Processing Event AWS", slog.String("arn", arn))
+	return nil
+}
+
+// SNSConfig configures an SNSPublisher. Credentials are read like the AWS
+// CLI does: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, AWS_PROFILE, or
+// the role of the instance.
+type SNSConfig struct {
+	Region string // default AWS_REGION
+
+	// Optional: URL of a local stand-in of SNS, such as LocalStack
+	// (http://localhost:4566) or an httptest server.
+	Endpoint string
+}
+
+// SNSConfigFromEnv reads the SNS configuration: SNS_PUBLISH, AWS_REGION and
+// SNS_ENDPOINT. It returns ok false if SNS_PUBLISH is not true.
+func SNSConfigFromEnv() (cfg SNSConfig, ok bool, err error) {
+	if value := os.Getenv("SNS_PUBLISH"); value != "" {
+		if ok, err = strconv.ParseBool(value); err != nil {
+			return cfg, false, fmt.Errorf("invalid SNS_PUBLISH: %v", err)
+		}
+	}
+	if !ok {
+		return cfg, false, nil
+	}
+	cfg.Region = os.Getenv("AWS_REGION")
+	cfg.Endpoint = os.Getenv("SNS_ENDPOINT")
+	return cfg, true, nil
+}
+
+// SNSPublisher publishes AWS events to SNS topics. The ARN of an event is
+// the ARN of its topic, optionally followed by /<id>: the message is
+// {"id": "<id>", "payload": <payload>}, with an id message attribute.
+type SNSPublisher struct {
+	client      *sns.Client
+	credentials aws.CredentialsProvider
+	// throttles counts the consecutive throttles of the publisher, that
+	// back off the retries of throttled events.
+	throttles atomic.Int64
+}
+
+func NewSNSPublisher(ctx context.Context, cfg SNSConfig) (*SNSPublisher, error) {
+	var opts []func(*config.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, config.WithRegion(cfg.Region))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("config.LoadDefaultConfig failed: %v", err)
+	}
+	if awsCfg.Region == "" {
+		return nil, errors.New("an AWS region is required to publish to SNS")
+	}
+	client := sns.NewFromConfig(awsCfg, func(o *sns.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		// asynq retries the task, see classifySNSError.
+		o.Retryer = aws.NopRetryer{}
+	})
+	return &SNSPublisher{client: client, credentials: awsCfg.Credentials}, nil
+}
+
+// Publish publishes the event. Throttling is a *RateLimitError, retried
+// after a delay that grows with the consecutive throttles, and
+// missing credentials and other client errors, such as a denied access or
+// an unknown topic, wrap asynq.SkipRetry.
+func (p *SNSPublisher) Publish(ctx context.Context, arn string, payload json.RawMessage) error {
+	topic, id, _ := strings.Cut(arn, "/")
+	message, err := json.Marshal(struct {
+		ID      string          `json:"id,omitempty"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}{ID: id, Payload: payload})
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	// The credentials are cached by the SDK, until they expire. Without
+	// them, retrying does not help until the configuration is fixed.
+	if p.credentials != nil {
+		if _, err := p.credentials.Retrieve(ctx); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("could not read AWS credentials: %w", err)
+			}
+			return fmt.Errorf("could not read AWS credentials: %v: %w", err, asynq.SkipRetry)
+		}
+	}
+	input := &sns.PublishInput{TopicArn: aws.String(topic), Message: aws.String(string(message))}
+	if id != "" {
+		input.MessageAttributes = map[string]types.MessageAttributeValue{
+			"id": {DataType: aws.String("String"), StringValue: aws.String(id)},
+		}
+	}
+	if _, err := p.client.Publish(ctx, input); err != nil {
+		err = classifySNSError(err)
+		var ratelimitErr *RateLimitError
+		if errors.As(err, &ratelimitErr) {
+			ratelimitErr.RetryIn = throttleDelay(int(p.throttles.Add(1) - 1))
+		}
+		return err
+	}
+	p.throttles.Store(0)
+	return nil
+}
+
+// snsThrottleCodes are the error codes of throttling by SNS, in addition
+// to the ones of the SDK.
+var snsThrottleCodes = map[string]struct{}{
+	"Throttled":     {},
+	"KMSThrottling": {},
+}
+
+// snsAuthCodes are the error codes of requests that AWS does not
+// authenticate or authorize, whatever their HTTP status.
+var snsAuthCodes = map[string]struct{}{
+	"AccessDenied":                {},
+	"AccessDeniedException":       {},
+	"AuthorizationError":          {},
+	"ExpiredToken":                {},
+	"IncompleteSignature":         {},
+	"InvalidClientTokenId":        {},
+	"MissingAuthenticationToken":  {},
+	"SignatureDoesNotMatch":       {},
+	"UnrecognizedClientException": {},
+}
+
+const (
+	throttleMinDelay = time.Second
+	throttleMaxDelay = 5 * time.Minute
+)
+
+// throttleDelay is the delay before retrying an event after n consecutive
+// throttles: it doubles from 1s, up to 5 minutes, with up to 20% of jitter
+// so that the retries of a burst are spread.
+func throttleDelay(n int) time.Duration {
+	delay := throttleMaxDelay
+	if n < 16 {
+		delay = min(throttleMinDelay<<n, throttleMaxDelay)
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/5)))
+}
+
+// classifySNSError turns throttling into a *RateLimitError, and marks the
+// authentication errors and the other client errors, such as a denied
+// access or an unknown topic, as not worth retrying. Server and network
+// errors are returned as is.
+func classifySNSError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		_, throttled := retry.DefaultThrottleErrorCodes[code]
+		if _, ok := snsThrottleCodes[code]; ok {
+			throttled = true
+		}
+		if throttled {
+			return newRateLimitError()
+		}
+		if _, ok := snsAuthCodes[code]; ok {
+			return fmt.Errorf("sns.Publish failed: %v: %w", err, asynq.SkipRetry)
+		}
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		switch {
+		case status == http.StatusTooManyRequests:
+			return newRateLimitError()
+		case status >= 400 && status < 500:
+			return fmt.Errorf("sns.Publish failed: %v: %w", err, asynq.SkipRetry)
+		}
+	}
+	return fmt.Errorf("sns.Publish failed: %w", err)
+}
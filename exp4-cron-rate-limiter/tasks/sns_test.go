@@ -0,0 +1,197 @@
+package tasks_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+)
+
+// fakeSNS answers Publish requests of the SNS query API with status and,
+// for errors, the error code, and keeps the forms it receives.
+type fakeSNS struct {
+	*httptest.Server
+	status int
+	code   string
+
+	mu    sync.Mutex
+	forms []url.Values
+}
+
+func newFakeSNS(t *testing.T, status int, code string) *fakeSNS {
+	t.Helper()
+	f := &fakeSNS{status: status, code: code}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		f.forms = append(f.forms, r.PostForm)
+		status, code := f.status, f.code
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			io.WriteString(w, `<PublishResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><PublishResult><MessageId>m1</MessageId></PublishResult><ResponseMetadata><RequestId>r1</RequestId></ResponseMetadata></PublishResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<ErrorResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><Error><Type>Sender</Type><Code>%s</Code><Message>nope</Message></Error><RequestId>r1</RequestId></ErrorResponse>`, code)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newSNSPublisher(t *testing.T, endpoint string) *tasks.SNSPublisher {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	p, err := tasks.NewSNSPublisher(context.Background(), tasks.SNSConfig{Region: "us-east-1", Endpoint: endpoint})
+	if err != nil {
+		t.Fatalf("NewSNSPublisher failed: %v", err)
+	}
+	return p
+}
+
+func TestProcessEventAWSPublishes(t *testing.T) {
+	f := newFakeSNS(t, http.StatusOK, "")
+	h := tasks.NewProcessEventAWS(tasks.Logger(io.Discard, ""), newSNSPublisher(t, f.URL))
+	task, err := tasks.BuildEventAWS("arn:aws:sns:us-east-1:123456789012:start-event/7", json.RawMessage(`{"zone":"a"}`))
+	if err != nil {
+		t.Fatalf("BuildEventAWS failed: %v", err)
+	}
+	if err := h.ProcessTask(context.Background(), task); err != nil {
+		t.Fatalf("ProcessTask failed: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.forms) != 1 {
+		t.Fatalf("got %d requests, want 1", len(f.forms))
+	}
+	form := f.forms[0]
+	if form.Get("Action") != "Publish" || form.Get("TopicArn") != "arn:aws:sns:us-east-1:123456789012:start-event" ||
+		form.Get("Message") != `{"id":"7","payload":{"zone":"a"}}` {
+		t.Errorf("got form %v", form)
+	}
+	if form.Get("MessageAttributes.entry.1.Name") != "id" || form.Get("MessageAttributes.entry.1.Value.StringValue") != "7" {
+		t.Errorf("got form %v, want the id attribute", form)
+	}
+}
+
+func TestProcessEventAWSErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		code      string
+		rateLimit bool
+		skipRetry bool
+	}{
+		{status: http.StatusBadRequest, code: "Throttling", rateLimit: true},
+		{status: http.StatusTooManyRequests, code: "Throttled", rateLimit: true},
+		{status: http.StatusForbidden, code: "AuthorizationError", skipRetry: true},
+		{status: http.StatusForbidden, code: "InvalidClientTokenId", skipRetry: true},
+		{status: http.StatusInternalServerError, code: "ExpiredToken", skipRetry: true},
+		{status: http.StatusNotFound, code: "NotFound", skipRetry: true},
+		{status: http.StatusInternalServerError, code: "InternalError"},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			f := newFakeSNS(t, tc.status, tc.code)
+			h := tasks.NewProcessEventAWS(tasks.Logger(io.Discard, ""), newSNSPublisher(t, f.URL))
+			task, _ := tasks.BuildEventAWS("arn:aws:sns:us-east-1:123456789012:stop-event/8", nil)
+
+			err := h.ProcessTask(context.Background(), task)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if tasks.IsRateLimitError(err) != tc.rateLimit {
+				t.Errorf("got error %v, want a rate limit error %v", err, tc.rateLimit)
+			}
+			if errors.Is(err, asynq.SkipRetry) != tc.skipRetry {
+				t.Errorf("got error %v, want skip retry %v", err, tc.skipRetry)
+			}
+			// The SDK does not retry, asynq does.
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(f.forms) != 1 {
+				t.Errorf("got %d requests, want 1", len(f.forms))
+			}
+		})
+	}
+}
+
+func TestProcessEventAWSWithoutCredentials(t *testing.T) {
+	f := newFakeSNS(t, http.StatusOK, "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	p, err := tasks.NewSNSPublisher(context.Background(), tasks.SNSConfig{Region: "us-east-1", Endpoint: f.URL})
+	if err != nil {
+		t.Fatalf("NewSNSPublisher failed: %v", err)
+	}
+	h := tasks.NewProcessEventAWS(tasks.Logger(io.Discard, ""), p)
+	task, _ := tasks.BuildEventAWS("arn:aws:sns:us-east-1:123456789012:stop-event/8", nil)
+
+	// The credentials are read when the request is signed, before it is sent.
+	if err := h.ProcessTask(context.Background(), task); !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("got error %v, want skip retry", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.forms) != 0 {
+		t.Errorf("got %d requests, want none", len(f.forms))
+	}
+}
+
+func TestSNSPublisherThrottles(t *testing.T) {
+	f := newFakeSNS(t, http.StatusBadRequest, "Throttling")
+	p := newSNSPublisher(t, f.URL)
+	const arn = "arn:aws:sns:us-east-1:123456789012:stop-event/8"
+	retryIn := func() time.Duration {
+		t.Helper()
+		var ratelimitErr *tasks.RateLimitError
+		if err := p.Publish(context.Background(), arn, nil); !errors.As(err, &ratelimitErr) {
+			t.Fatalf("got error %v, want a rate limit error", err)
+		}
+		return ratelimitErr.RetryIn
+	}
+
+	// The delay doubles from 1s with the consecutive throttles, up to 5 minutes.
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if d := retryIn(); d < want*4/5 || d > want {
+			t.Fatalf("throttle %d: got delay %v, want up to %v", n, d, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		retryIn()
+	}
+	if d := retryIn(); d < 4*time.Minute || d > 5*time.Minute {
+		t.Errorf("got delay %v, want up to 5m", d)
+	}
+
+	// A publish resets it.
+	f.mu.Lock()
+	f.status = http.StatusOK
+	f.mu.Unlock()
+	if err := p.Publish(context.Background(), arn, nil); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	f.mu.Lock()
+	f.status = http.StatusBadRequest
+	f.mu.Unlock()
+	if d := retryIn(); d > time.Second {
+		t.Errorf("got delay %v after a publish, want up to 1s", d)
+	}
+}
@@ -3,11 +3,11 @@ package tasks
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math/rand"
-	"os"
 	"strings"
 	"time"
 
@@ -45,31 +45,59 @@ func Logger(w io.Writer, levelAsString string) *slog.Logger {
 
 // A list of task types.
 const (
-	TypeEventStart = "event:start"
-	TypeEventStop  = "event:stop"
-	TypeEventAWS   = "event:aws"
+	TypeEventStart     = "event:start"
+	TypeEventStop      = "event:stop"
+	TypeEventAWS       = "event:aws"
+	TypeWebhookDeliver = "webhook:deliver"
 )
 
 type EventStart struct {
-	EventUUID uuid.UUID
+	EventUUID uuid.UUID // nil from BuildEventStart, see eventUUID
 	IDs       []string
+	Payload   json.RawMessage `json:",omitempty"` // from the schedule, passed on to each AWS event
 }
 
 type EventStop struct {
-	EventUUID uuid.UUID
+	EventUUID uuid.UUID // nil from BuildEventStop, see eventUUID
 	IDs       []string
+	Payload   json.RawMessage `json:",omitempty"` // from the schedule, passed on to each AWS event
 }
 
 type EventAWS struct {
-	ARN string
+	ARN     string
+	Payload json.RawMessage `json:",omitempty"`
 }
 
 // Task builders
 
-func BuildEventStart(ids []string) (*asynq.Task, error) {
+// eventUUID identifies the event of a task. The payload of a periodic task
+// is the same at every fire, so that the scheduler sees an unchanged schedule,
+// and the builders leave its UUID nil: it is derived from the task ID, which
+// includes the fire time (see periodic.Manager), or from the payload outside
+// an asynq server. A UUID set in the payload is kept.
+func eventUUID(ctx context.Context, t *asynq.Task, u uuid.UUID) uuid.UUID {
+	if u != uuid.Nil {
+		return u
+	}
+	if id, ok := asynq.GetTaskID(ctx); ok {
+		return uuid.NewSHA1(uuid.NameSpaceOID, []byte(id))
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, t.Payload())
+}
+
+// eventID identifies the event being processed: the task ID when run by an
+// asynq server, the event UUID otherwise.
+func eventID(ctx context.Context, eventUUID uuid.UUID) string {
+	if id, ok := asynq.GetTaskID(ctx); ok {
+		return id
+	}
+	return eventUUID.String()
+}
+
+func BuildEventStart(ids []string, data json.RawMessage) (*asynq.Task, error) {
 	payload, err := json.Marshal(EventStart{
-		EventUUID: uuid.New(),
-		IDs:       ids,
+		IDs:     ids,
+		Payload: data,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %v", err)
@@ -77,10 +105,10 @@ func BuildEventStart(ids []string) (*asynq.Task, error) {
 	return asynq.NewTask(TypeEventStart, payload), nil
 }
 
-func BuildEventStop(ids []string) (*asynq.Task, error) {
-	payload, err := json.Marshal(EventStart{
-		EventUUID: uuid.New(),
-		IDs:       ids,
+func BuildEventStop(ids []string, data json.RawMessage) (*asynq.Task, error) {
+	payload, err := json.Marshal(EventStop{
+		IDs:     ids,
+		Payload: data,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %v", err)
@@ -88,8 +116,8 @@ func BuildEventStop(ids []string) (*asynq.Task, error) {
 	return asynq.NewTask(TypeEventStop, payload), nil
 }
 
-func BuildEventAWS(arn string) (*asynq.Task, error) {
-	payload, err := json.Marshal(EventAWS{ARN: arn})
+func BuildEventAWS(arn string, data json.RawMessage) (*asynq.Task, error) {
+	payload, err := json.Marshal(EventAWS{ARN: arn, Payload: data})
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %v", err)
 	}
@@ -114,24 +142,11 @@ func (p *ProcessStartEvent) ProcessTask(ctx context.Context, t *asynq.Task) erro
 	if err := json.Unmarshal(t.Payload(), &e); err != nil {
 		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
-	p.Log.Info("✅ Enqueueing AWS start event", slog.String("event_uuid", e.EventUUID.String()),
-		slog.Any("ids", e.IDs))
+	event := eventUUID(ctx, t, e.EventUUID)
+	p.Log.Info("✅ Enqueueing AWS start event", slog.String("event_uuid", event.String()),
+		slog.String("event_id", eventID(ctx, event)), slog.Any("ids", e.IDs))
 
-	for _, id := range e.IDs {
-		// Enqueue AWS event
-		task, err := BuildEventAWS("arn:aws:sns:us-east-1:123456789012:start-event/" + id)
-		if err != nil {
-			return fmt.Errorf("BuildEventAWS failed: %v", err)
-		}
-		info, err := p.client.Enqueue(task, asynq.Queue("aws"))
-		if err != nil {
-			p.Log.Error("could not enqueue task", tint.Err(err))
-			os.Exit(1)
-		}
-		p.Log.Info("enqueued task", slog.String("id", info.ID), slog.String("queue", info.Queue), slog.Any("state", info.State),
-			slog.String("task_type", task.Type()))
-	}
-	return nil
+	return fanOutEventAWS(ctx, p.Log, p.client, eventID(ctx, event), "arn:aws:sns:us-east-1:123456789012:start-event/", e.IDs, e.Payload)
 }
 
 type ProcessStopEvent struct {
@@ -151,34 +166,57 @@ func (p *ProcessStopEvent) ProcessTask(ctx context.Context, t *asynq.Task) error
 	if err := json.Unmarshal(t.Payload(), &e); err != nil {
 		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
 	}
-	p.Log.Info("🚫 Enqueueing AWS stop event", slog.String("event_uuid", e.EventUUID.String()),
-		slog.Any("ids", e.IDs))
+	event := eventUUID(ctx, t, e.EventUUID)
+	p.Log.Info("🚫 Enqueueing AWS stop event", slog.String("event_uuid", event.String()),
+		slog.String("event_id", eventID(ctx, event)), slog.Any("ids", e.IDs))
 
-	for _, id := range e.IDs {
+	return fanOutEventAWS(ctx, p.Log, p.client, eventID(ctx, event), "arn:aws:sns:us-east-1:123456789012:stop-event/", e.IDs, e.Payload)
+}
+
+// fanOutRetention is how long the AWS events of a fan-out are kept once
+// processed, so that their task IDs still dedupe the retries of the
+// fan-out: asynq frees the ID of a task deleted when it completes.
+const fanOutRetention = 24 * time.Hour
+
+// fanOutEventAWS enqueues one AWS event per id. The task ID is derived from
+// the event and the id, and kept for fanOutRetention, so when the fan-out
+// is interrupted by a shutdown and retried, ids that were already enqueued
+// are not enqueued twice.
+func fanOutEventAWS(ctx context.Context, log *slog.Logger, client *asynq.Client, event string, arnPrefix string, ids []string, data json.RawMessage) error {
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			log.Warn("fan-out interrupted", slog.String("event_id", event), tint.Err(err))
+			return fmt.Errorf("fan-out interrupted: %w", err)
+		}
 		// Enqueue AWS event
-		task, err := BuildEventAWS("arn:aws:sns:us-east-1:123456789012:stop-event/" + id)
+		task, err := BuildEventAWS(arnPrefix+id, data)
 		if err != nil {
 			return fmt.Errorf("BuildEventAWS failed: %v", err)
 		}
-		info, err := p.client.Enqueue(task, asynq.Queue("aws"))
+		info, err := client.EnqueueContext(ctx, task, asynq.Queue("aws"), asynq.TaskID(event+":"+id), asynq.Retention(fanOutRetention))
+		if errors.Is(err, asynq.ErrTaskIDConflict) {
+			log.Debug("task already enqueued", slog.String("id", id))
+			continue
+		}
 		if err != nil {
-			p.Log.Error("could not enqueue task", tint.Err(err))
-			os.Exit(1)
+			return fmt.Errorf("client.Enqueue failed: %w", err)
 		}
-		p.Log.Info("enqueued task", slog.String("id", info.ID), slog.String("queue", info.Queue), slog.Any("state", info.State),
+		log.Info("enqueued task", slog.String("id", info.ID), slog.String("queue", info.Queue), slog.Any("state", info.State),
 			slog.String("task_type", task.Type()))
 	}
 	return nil
 }
 
 type ProcessEventAWS struct {
-	Log     *slog.Logger
-	limiter *rate.Limiter
+	Log       *slog.Logger
+	Publisher EventPublisher
+	limiter   *rate.Limiter
 }
 
-func NewProcessEventAWS(log *slog.Logger) *ProcessEventAWS {
+func NewProcessEventAWS(log *slog.Logger, publisher EventPublisher) *ProcessEventAWS {
 	return &ProcessEventAWS{
-		Log: log.With(slog.String("event_type", TypeEventAWS)),
+		Log:       log.With(slog.String("event_type", TypeEventAWS)),
+		Publisher: publisher,
 		// Rate is 5 events/sec and permits burst of at most 10 events.
 		limiter: rate.NewLimiter(5, 10),
 	}
@@ -191,12 +229,16 @@ func (p *ProcessEventAWS) ProcessTask(ctx context.Context, t *asynq.Task) error
 	}
 	if !p.limiter.Allow() {
 		p.Log.Warn("❗rate limited", slog.String("arn", e.ARN))
-		return &RateLimitError{
-			RetryIn: time.Duration(rand.Intn(3)) * time.Second,
-		}
+		return newRateLimitError()
 	}
 
-	p.Log.Info("🚀 Processing Event AWS", slog.String("arn", e.ARN))
+	if err := p.Publisher.Publish(ctx, e.ARN, e.Payload); err != nil {
+		if IsRateLimitError(err) {
+			p.Log.Warn("❗rate limited by AWS", slog.String("arn", e.ARN))
+		}
+		return fmt.Errorf("could not publish %s: %w", e.ARN, err)
+	}
+	p.Log.Debug("event published", slog.String("arn", e.ARN))
 	return nil
 }
 
@@ -204,11 +246,19 @@ type RateLimitError struct {
 	RetryIn time.Duration
 }
 
+// newRateLimitError returns a RateLimitError retrying in up to 2 seconds,
+// so that the retries of a burst are spread.
+func newRateLimitError() *RateLimitError {
+	return &RateLimitError{
+		RetryIn: time.Duration(rand.Intn(3)) * time.Second,
+	}
+}
+
 func (e *RateLimitError) Error() string {
 	return fmt.Sprintf("rate limited (retry in  %v)", e.RetryIn)
 }
 
 func IsRateLimitError(err error) bool {
-	_, ok := err.(*RateLimitError)
-	return ok
+	var ratelimitErr *RateLimitError
+	return errors.As(err, &ratelimitErr)
 }
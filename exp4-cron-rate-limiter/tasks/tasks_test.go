@@ -0,0 +1,59 @@
+package tasks_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"exp1/tasks"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+)
+
+func TestProcessStartEventStopsOnCancel(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: s.Addr()})
+	defer client.Close()
+
+	task, err := tasks.BuildEventStart([]string{"0", "1", "2"}, nil)
+	if err != nil {
+		t.Fatalf("BuildEventStart failed: %v", err)
+	}
+	h := tasks.NewProcessStartEvent(tasks.Logger(io.Discard, ""), client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.ProcessTask(ctx, task); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ProcessTask with cancelled context: got %v, want %v", err, context.Canceled)
+	}
+	if s.Exists("asynq:{aws}:pending") {
+		t.Fatal("tasks were enqueued after cancellation")
+	}
+
+	// A retried fan-out does not enqueue ids twice.
+	for i := 0; i < 2; i++ {
+		if err := h.ProcessTask(context.Background(), task); err != nil {
+			t.Fatalf("ProcessTask failed: %v", err)
+		}
+	}
+	pending, err := s.List("asynq:{aws}:pending")
+	if err != nil {
+		t.Fatalf("s.List failed: %v", err)
+	}
+	if len(pending) != 3 {
+		t.Errorf("got %d pending aws tasks, want 3", len(pending))
+	}
+	// The IDs are kept once the tasks are processed.
+	infos, err := asynq.NewInspector(asynq.RedisClientOpt{Addr: s.Addr()}).ListPendingTasks("aws")
+	if err != nil {
+		t.Fatalf("inspector.ListPendingTasks failed: %v", err)
+	}
+	for _, info := range infos {
+		if info.Retention != 24*time.Hour {
+			t.Errorf("got task %s retained %v, want 24h", info.ID, info.Retention)
+		}
+	}
+}
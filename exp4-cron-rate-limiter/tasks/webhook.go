@@ -0,0 +1,214 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Webhooks are delivered from their own queue, one attempt at a time
+// bounded by webhookTimeout, and retried with WebhookRetryDelay.
+const (
+	webhookQueue    = "webhook"
+	webhookTimeout  = 30 * time.Second
+	webhookMaxRetry = 12 // about 4 hours of retries
+
+	// maxWebhookResponse is the most of a response that is read.
+	maxWebhookResponse = 64 << 10
+)
+
+// Headers of a webhook request. The signature is
+// t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">, see
+// WebhookSignature.
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookIDHeader        = "X-Webhook-Id" // task ID, the same for every attempt
+)
+
+type WebhookDeliver struct {
+	URL  string
+	Body json.RawMessage
+}
+
+// BuildWebhookDeliver builds the delivery of body, a JSON value, to url.
+func BuildWebhookDeliver(url string, body json.RawMessage) (*asynq.Task, error) {
+	if err := validateWebhookURL(url); err != nil {
+		return nil, err
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("webhook body is not valid JSON")
+	}
+	payload, err := json.Marshal(WebhookDeliver{URL: url, Body: body})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	return asynq.NewTask(TypeWebhookDeliver, payload, asynq.Queue(webhookQueue),
+		asynq.Timeout(webhookTimeout), asynq.MaxRetry(webhookMaxRetry)), nil
+}
+
+func validateWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q, want an http or https URL", rawURL)
+	}
+	return nil
+}
+
+// WebhookSignature returns the signature header of body sent at t.
+// Receivers compute it again with their copy of the secret and the time of
+// the header, and should reject old times to prevent replays.
+func WebhookSignature(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookError is a response to a webhook request that is not a 2xx.
+type WebhookError struct {
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header, 0 if none
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("webhook replied %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Permanent reports whether delivering again would fail the same way:
+// client errors are permanent, except timeouts, too early and rate
+// limiting, and so are redirects, which are not followed.
+func (e *WebhookError) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode < 500
+}
+
+func (e *WebhookError) Unwrap() error {
+	if e.Permanent() {
+		return asynq.SkipRetry
+	}
+	return nil
+}
+
+// webhookClient does not follow redirects: clients turn a redirected POST
+// into a GET, and the signature is meant for the URL of the webhook.
+var webhookClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+type ProcessWebhookDeliver struct {
+	Log    *slog.Logger
+	Secret []byte       // signing secret, requests are not signed if empty
+	Client *http.Client // default webhookClient
+}
+
+func NewProcessWebhookDeliver(log *slog.Logger, secret []byte) *ProcessWebhookDeliver {
+	return &ProcessWebhookDeliver{
+		Log:    log.With(slog.String("event_type", TypeWebhookDeliver)),
+		Secret: secret,
+	}
+}
+
+// ProcessTask posts the body of the webhook. It times out with ctx, or
+// after webhookTimeout for tasks without a deadline. Errors wrap
+// asynq.SkipRetry when the response is permanent (see WebhookError);
+// network errors and other responses are retried.
+func (p *ProcessWebhookDeliver) ProcessTask(ctx context.Context, t *asynq.Task) error {
+	var w WebhookDeliver
+	if err := json.Unmarshal(t.Payload(), &w); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+	if err := validateWebhookURL(w.URL); err != nil {
+		return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, webhookTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(w.Body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest failed: %v: %w", err, asynq.SkipRetry)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id, ok := asynq.GetTaskID(ctx); ok {
+		req.Header.Set(WebhookIDHeader, id)
+	}
+	if len(p.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(p.Secret, time.Now(), w.Body))
+	}
+
+	client := p.Client
+	if client == nil {
+		client = webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		p.Log.Info("📬 Webhook delivered", slog.String("url", w.URL), slog.Int("status", resp.StatusCode))
+		return nil
+	}
+	werr := &WebhookError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	return fmt.Errorf("could not deliver webhook to %s: %w", w.URL, werr)
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(value); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Bounds of WebhookRetryDelay.
+const (
+	webhookMinDelay = 10 * time.Second
+	webhookMaxDelay = time.Hour
+)
+
+// WebhookRetryDelay is an asynq.RetryDelayFunc for webhooks: the delay
+// doubles from 10s with every retry, up to an hour, with up to 20% of
+// jitter, or is the Retry-After of the response if it is longer.
+func WebhookRetryDelay(n int, err error, t *asynq.Task) time.Duration {
+	delay := webhookMaxDelay
+	if n < 16 {
+		delay = min(webhookMinDelay<<n, webhookMaxDelay)
+	}
+	delay -= time.Duration(rand.Int63n(int64(delay / 5)))
+	var werr *WebhookError
+	if errors.As(err, &werr) && werr.RetryAfter > delay {
+		delay = min(werr.RetryAfter, 24*time.Hour)
+	}
+	return delay
+}
@@ -0,0 +1,150 @@
+package tasks_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"exp1/tasks"
+
+	"github.com/hibiken/asynq"
+)
+
+func TestProcessWebhookDeliver(t *testing.T) {
+	secret := []byte("s3cret")
+	var got *http.Request
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	task, err := tasks.BuildWebhookDeliver(srv.URL+"/hooks", json.RawMessage(`{"event":"start","id":"7"}`))
+	if err != nil {
+		t.Fatalf("BuildWebhookDeliver failed: %v", err)
+	}
+	h := tasks.NewProcessWebhookDeliver(tasks.Logger(io.Discard, ""), secret)
+	if err := h.ProcessTask(context.Background(), task); err != nil {
+		t.Fatalf("ProcessTask failed: %v", err)
+	}
+	if got.Method != http.MethodPost || got.URL.Path != "/hooks" || got.Header.Get("Content-Type") != "application/json" ||
+		string(gotBody) != `{"event":"start","id":"7"}` {
+		t.Errorf("got %s %s %q with body %s", got.Method, got.URL.Path, got.Header.Get("Content-Type"), gotBody)
+	}
+
+	// The receiver checks the signature with the time of the header.
+	signature := got.Header.Get(tasks.WebhookSignatureHeader)
+	ts, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)) > time.Minute {
+		t.Fatalf("got signature %q, want a recent time", signature)
+	}
+	if want := tasks.WebhookSignature(secret, time.Unix(sec, 0), gotBody); signature != want {
+		t.Errorf("got signature %q, want %q", signature, want)
+	}
+	if tasks.WebhookSignature([]byte("other"), time.Unix(sec, 0), gotBody) == signature {
+		t.Error("signature does not depend on the secret")
+	}
+
+	for _, tc := range []struct {
+		url  string
+		body string
+	}{
+		{"ftp://example.com/hooks", `{}`},
+		{"/hooks", `{}`},
+		{"https://example.com/hooks", `{`},
+	} {
+		if _, err := tasks.BuildWebhookDeliver(tc.url, json.RawMessage(tc.body)); err == nil {
+			t.Errorf("BuildWebhookDeliver(%q, %q): got no error", tc.url, tc.body)
+		}
+	}
+}
+
+func TestProcessWebhookDeliverErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status     int
+		retryAfter string
+		skipRetry  bool
+		wantAfter  time.Duration
+	}{
+		{status: http.StatusBadRequest, skipRetry: true},
+		{status: http.StatusGone, skipRetry: true},
+		{status: http.StatusFound, skipRetry: true}, // not followed
+		{status: http.StatusRequestTimeout},
+		{status: http.StatusTooManyRequests, retryAfter: "120", wantAfter: 2 * time.Minute},
+		{status: http.StatusServiceUnavailable},
+		{status: http.StatusInternalServerError, retryAfter: "soon"},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				if tc.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer srv.Close()
+			task, _ := tasks.BuildWebhookDeliver(srv.URL, json.RawMessage(`{}`))
+			h := tasks.NewProcessWebhookDeliver(tasks.Logger(io.Discard, ""), nil)
+
+			err := h.ProcessTask(context.Background(), task)
+			var werr *tasks.WebhookError
+			if !errors.As(err, &werr) || werr.StatusCode != tc.status || werr.RetryAfter != tc.wantAfter {
+				t.Fatalf("got error %v, want a WebhookError %d with Retry-After %v", err, tc.status, tc.wantAfter)
+			}
+			if errors.Is(err, asynq.SkipRetry) != tc.skipRetry {
+				t.Errorf("got error %v, want skip retry %v", err, tc.skipRetry)
+			}
+		})
+	}
+
+	// The request is bounded by the deadline of the task.
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer slow.Close()
+	defer close(release)
+	task, _ := tasks.BuildWebhookDeliver(slow.URL, json.RawMessage(`{}`))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := tasks.NewProcessWebhookDeliver(tasks.Logger(io.Discard, ""), nil).ProcessTask(ctx, task)
+	if err == nil || errors.Is(err, asynq.SkipRetry) || time.Since(start) > 5*time.Second {
+		t.Errorf("slow receiver: got %v after %v, want a retryable timeout", err, time.Since(start))
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	task, _ := tasks.BuildWebhookDeliver("https://example.com/hooks", json.RawMessage(`{}`))
+	err := errors.New("connection refused")
+	for _, tc := range []struct {
+		n        int
+		min, max time.Duration
+	}{
+		{0, 8 * time.Second, 10 * time.Second},
+		{1, 16 * time.Second, 20 * time.Second},
+		{5, 256 * time.Second, 320 * time.Second},
+		{20, 48 * time.Minute, time.Hour},
+		{100, 48 * time.Minute, time.Hour},
+	} {
+		for i := 0; i < 20; i++ {
+			if d := tasks.WebhookRetryDelay(tc.n, err, task); d < tc.min || d > tc.max {
+				t.Fatalf("retry %d: got delay %v, want between %v and %v", tc.n, d, tc.min, tc.max)
+			}
+		}
+	}
+	limited := &tasks.WebhookError{StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Minute}
+	if d := tasks.WebhookRetryDelay(0, limited, task); d != 10*time.Minute {
+		t.Errorf("Retry-After: got delay %v, want 10m", d)
+	}
+}